@@ -0,0 +1,321 @@
+package caddy2
+
+import (
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nicolasazrak/caddy-cache/core"
+	"go.uber.org/zap"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+	httpcaddyfile.RegisterHandlerDirective("cache", parseCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("cache", httpcaddyfile.Before, "reverse_proxy")
+}
+
+/**
+ * Handler is the caddy v2 module http.handlers.cache.
+ * The common settings have their own fields and the rules keep the arguments of their directive,
+ * the other directives of the cache block are listed with their name followed by their arguments:
+ *
+ *     {"handler": "cache", "storage": ["mmap", "/tmp/caddy-cache"], "match": [["path", "/assets"]],
+ *      "default_max_age": "5m", "status_header": "X-Cache-Status", "directives": [["compress"]]}
+ */
+type Handler struct {
+	// Arguments of the storage and zone directives, like ["mmap", "/tmp/caddy-cache"]
+	Storage []string `json:"storage,omitempty"`
+	Zone    []string `json:"zone,omitempty"`
+
+	// Arguments of each match and bypass rule, like ["path", "/assets"]
+	Match  [][]string `json:"match,omitempty"`
+	Bypass [][]string `json:"bypass,omitempty"`
+
+	DefaultMaxAge caddy.Duration `json:"default_max_age,omitempty"`
+	LockTimeout   caddy.Duration `json:"lock_timeout,omitempty"`
+	StatusHeader  string         `json:"status_header,omitempty"`
+	MaxVariants   int            `json:"max_variants,omitempty"`
+
+	// The other directives, each one with its name followed by its arguments
+	Directives [][]string `json:"directives,omitempty"`
+
+	handler *core.CacheHandler
+	logger  *zap.Logger
+
+	// Caddy v2 only gives the next handler with the requests, so the cache is warmed in the first one
+	warmOnce *sync.Once
+}
+
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.cache",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+func (h *Handler) Provision(ctx caddy.Context) error {
+	h.logger = ctx.Logger()
+
+	config, err := h.config()
+	if err != nil {
+		return err
+	}
+
+	// Messages go to the logs of caddy unless the log directive has a file
+	if config.LogFile == "" {
+		config.Logger = core.NewSinkLogger(config.LogLevel, h.log)
+	}
+
+	handler, err := core.NewCacheHandler(config)
+	if err != nil {
+		return err
+	}
+	handler.OnDecision = setPlaceholders
+	if err := handler.Setup(); err != nil {
+		return err
+	}
+	h.handler = handler
+	h.warmOnce = &sync.Once{}
+	return nil
+}
+
+/**
+ * Builds the config applying the fields as the directives they replace, so they are
+ * checked the same way. The settings are applied after Directives, so they win over them.
+ */
+func (h *Handler) config() (*core.Config, error) {
+	config := core.DefaultConfig()
+	if runtime.GOOS != "windows" {
+		config.Storage = core.NewMMapStorage(path.Join("/", "tmp", "caddy-cache"))
+	}
+
+	directives := [][]string{}
+	if len(h.Storage) > 0 {
+		directives = append(directives, append([]string{"storage"}, h.Storage...))
+	}
+	if len(h.Zone) > 0 {
+		directives = append(directives, append([]string{"zone"}, h.Zone...))
+	}
+	for _, rule := range h.Match {
+		directives = append(directives, append([]string{"match"}, rule...))
+	}
+	for _, rule := range h.Bypass {
+		directives = append(directives, append([]string{"bypass"}, rule...))
+	}
+	directives = append(directives, h.Directives...)
+	if h.StatusHeader != "" {
+		directives = append(directives, []string{"status_header", h.StatusHeader})
+	}
+	if h.MaxVariants != 0 {
+		directives = append(directives, []string{"max_variants", strconv.Itoa(h.MaxVariants)})
+	}
+
+	for _, directive := range directives {
+		if len(directive) == 0 {
+			return nil, errors.New("empty cache directive")
+		}
+		if err := core.ApplyDirective(config, directive[0], directive[1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// Durations are set after the directives, lock_timeout also sets how stale values are used
+	if h.DefaultMaxAge < 0 || h.LockTimeout < 0 {
+		return nil, errors.New("cache durations can't be negative")
+	}
+	if h.DefaultMaxAge != 0 {
+		config.DefaultMaxAge = time.Duration(h.DefaultMaxAge)
+	}
+	if h.LockTimeout != 0 {
+		config.LockTimeout = time.Duration(h.LockTimeout)
+	}
+	return config, nil
+}
+
+func (h *Handler) Validate() error {
+	return h.handler.Config.Validate()
+}
+
+func (h *Handler) Cleanup() error {
+	if h.handler == nil {
+		return nil
+	}
+	return h.handler.Close()
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	upstream := nextUpstream{next: next}
+	h.warmOnce.Do(func() {
+		h.startWarming(upstream, r.Host)
+	})
+
+	handler := *h.handler
+	handler.Next = upstream
+	code, err := handler.ServeHTTP(w, r)
+	if err == nil {
+		return nil
+	}
+
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) {
+		return err
+	}
+	return caddyhttp.Error(code, err)
+}
+
+// Relative urls are warmed with the host of the first request
+func (h *Handler) startWarming(upstream core.Upstream, host string) {
+	if h.handler.Warmer == nil {
+		return
+	}
+
+	warmHandler := *h.handler
+	warmHandler.Next = upstream
+	h.handler.Warmer.Handler = &warmHandler
+	if h.handler.Warmer.Host == "" {
+		h.handler.Warmer.Host = host
+	}
+	go h.handler.Warmer.Warm()
+}
+
+// Sends the messages of the cache to the zap logger of caddy
+func (h *Handler) log(level core.LogLevel, msg string, fields core.LogFields) {
+	names := []string{}
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	zapFields := make([]zap.Field, 0, len(fields))
+	for _, name := range names {
+		zapFields = append(zapFields, zap.Any(name, fields[name]))
+	}
+
+	switch level {
+	case core.LOG_DEBUG:
+		h.logger.Debug(msg, zapFields...)
+	case core.LOG_INFO:
+		h.logger.Info(msg, zapFields...)
+	case core.LOG_WARNING:
+		h.logger.Warn(msg, zapFields...)
+	default:
+		h.logger.Error(msg, zapFields...)
+	}
+}
+
+/**
+ * UnmarshalCaddyfile reads the same directives of caddy v1:
+ *
+ *     cache {
+ *         match path /assets
+ *         status_header X-Cache-Status
+ *     }
+ */
+func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // Skip "cache" literal
+	if len(d.RemainingArgs()) > 0 {
+		return d.ArgErr()
+	}
+
+	// They are applied to check them, so errors have the line where they are
+	config := core.DefaultConfig()
+	for d.NextBlock(0) {
+		directive := append([]string{d.Val()}, d.RemainingArgs()...)
+		if err := core.ApplyDirective(config, directive[0], directive[1:]); err != nil {
+			return d.Err(err.Error())
+		}
+		h.setDirective(directive[0], directive[1:], config)
+	}
+
+	if err := config.Validate(); err != nil {
+		return d.Err(err.Error())
+	}
+	return nil
+}
+
+// Sets the field of the directive, the directives without one are kept in Directives
+func (h *Handler) setDirective(name string, args []string, config *core.Config) {
+	switch name {
+	case "storage":
+		h.Storage = args
+	case "zone":
+		h.Zone = args
+	case "match":
+		h.Match = append(h.Match, args)
+	case "bypass":
+		h.Bypass = append(h.Bypass, args)
+	case "status_header":
+		h.StatusHeader = config.StatusHeader
+	// A zero would be taken as the field not set, so it is kept as a directive
+	case "default_max_age":
+		if config.DefaultMaxAge == 0 {
+			h.Directives = append(h.Directives, append([]string{name}, args...))
+		}
+		h.DefaultMaxAge = caddy.Duration(config.DefaultMaxAge)
+	case "max_variants":
+		if config.MaxVariants == 0 {
+			h.Directives = append(h.Directives, append([]string{name}, args...))
+		}
+		h.MaxVariants = config.MaxVariants
+	default:
+		// lock_timeout has more arguments than the duration, so it is kept as it is
+		h.Directives = append(h.Directives, append([]string{name}, args...))
+	}
+}
+
+func parseCaddyfile(helper httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	handler := new(Handler)
+	err := handler.UnmarshalCaddyfile(helper.Dispenser)
+	return handler, err
+}
+
+/**
+ * The next handler of caddy v2 as Upstream of the cache.
+ * Errors not written are returned with their status so the cache can store them.
+ */
+type nextUpstream struct {
+	next caddyhttp.Handler
+}
+
+func (u nextUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	err := u.next.ServeHTTP(w, r)
+	if err == nil {
+		return 0, nil
+	}
+
+	var handlerErr caddyhttp.HandlerError
+	if errors.As(err, &handlerErr) && handlerErr.StatusCode != 0 {
+		return handlerErr.StatusCode, err
+	}
+	return http.StatusInternalServerError, err
+}
+
+/**
+ * Sets the {http.cache.status} and {http.cache.key} placeholders,
+ * so they can be used in the logs and other handlers.
+ */
+func setPlaceholders(w http.ResponseWriter, r *http.Request, key string, status string) {
+	if replacer, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		replacer.Set("http.cache.status", status)
+		replacer.Set("http.cache.key", key)
+	}
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Handler)(nil)
+	_ caddy.Validator             = (*Handler)(nil)
+	_ caddy.CleanerUpper          = (*Handler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
+	_ caddyfile.Unmarshaler       = (*Handler)(nil)
+	_ core.Upstream               = nextUpstream{}
+)
@@ -0,0 +1,157 @@
+package caddy2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/nicolasazrak/caddy-cache/core"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+		expect    Handler
+	}{
+		{"cache", false, Handler{}},
+		{"cache {\n match path /assets\n status_header X-Cache-Status\n}", false, Handler{
+			Match:        [][]string{{"path", "/assets"}},
+			StatusHeader: "X-Cache-Status",
+		}},
+		{"cache {\n storage memory\n default_max_age 30\n max_variants 4\n}", false, Handler{
+			Storage:       []string{"memory"},
+			DefaultMaxAge: caddy.Duration(30 * time.Second),
+			MaxVariants:   4,
+		}},
+		{"cache {\n bypass path /admin\n compress\n lock_timeout 5s stale\n}", false, Handler{
+			Bypass:     [][]string{{"path", "/admin"}},
+			Directives: [][]string{{"compress"}, {"lock_timeout", "5s", "stale"}},
+		}},
+		{"cache {\n default_max_age 0\n}", false, Handler{Directives: [][]string{{"default_max_age", "0"}}}},
+		{"cache /assets", true, Handler{}},
+		{"cache {\n unknown_directive\n}", true, Handler{}},
+		{"cache {\n default_max_age many\n}", true, Handler{}},
+		{"cache {\n warm_endpoint /_cache/warm\n}", true, Handler{}},
+	}
+
+	for i, test := range tests {
+		handler := new(Handler)
+		err := handler.UnmarshalCaddyfile(caddyfile.NewTestDispenser(test.input))
+		if test.shouldErr {
+			assert.Error(t, err, "Expected error in test %d", i)
+			continue
+		}
+		assert.NoError(t, err, "Unexpected error in test %d", i)
+		assert.Equal(t, test.expect, *handler, "Different handler in test %d", i)
+	}
+}
+
+func provisionHandler(t *testing.T, directives ...[]string) *Handler {
+	handler := &Handler{Storage: []string{"memory"}, Directives: directives}
+	assert.NoError(t, handler.Provision(caddy.Context{Context: context.Background()}))
+	assert.NoError(t, handler.Validate())
+	return handler
+}
+
+func TestProvisionJSON(t *testing.T) {
+	handler := new(Handler)
+	err := json.Unmarshal([]byte(`{
+		"storage": ["memory"],
+		"match": [["path", "/assets"]],
+		"default_max_age": "5m",
+		"lock_timeout": "2s",
+		"status_header": "X-Cache-Status",
+		"max_variants": 3,
+		"directives": [["status_header", "X-Overridden"], ["compress"]]
+	}`), handler)
+	assert.NoError(t, err)
+	assert.NoError(t, handler.Provision(caddy.Context{Context: context.Background()}))
+	defer handler.Cleanup()
+
+	config := handler.handler.Config
+	assert.IsType(t, &core.MemoryStorage{}, config.Storage)
+	assert.Len(t, config.CacheRules, 1)
+	assert.Equal(t, 5*time.Minute, config.DefaultMaxAge)
+	assert.Equal(t, 2*time.Second, config.LockTimeout)
+	assert.Equal(t, "X-Cache-Status", config.StatusHeader, "Fields win over directives")
+	assert.Equal(t, 3, config.MaxVariants)
+	assert.True(t, config.Compress)
+}
+
+func TestProvisionErrors(t *testing.T) {
+	handler := &Handler{Directives: [][]string{{"default_max_age", "many"}}}
+	assert.Error(t, handler.Provision(caddy.Context{Context: context.Background()}))
+
+	handler = &Handler{Directives: [][]string{{}}}
+	assert.Error(t, handler.Provision(caddy.Context{Context: context.Background()}))
+
+	handler = &Handler{Match: [][]string{{"unknown", "x"}}}
+	assert.Error(t, handler.Provision(caddy.Context{Context: context.Background()}))
+
+	handler = &Handler{DefaultMaxAge: caddy.Duration(-time.Second)}
+	assert.Error(t, handler.Provision(caddy.Context{Context: context.Background()}))
+}
+
+func TestServeHTTP(t *testing.T) {
+	handler := provisionHandler(t, []string{"match", "path", "/assets"}, []string{"status_header", "X-Cache-Status"})
+	defer handler.Cleanup()
+
+	timesCalled := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		timesCalled++
+		w.Write([]byte("Hello :)"))
+		return nil
+	})
+
+	for i, status := range []string{"miss", "hit"} {
+		replacer := caddy.NewReplacer()
+		req := httptest.NewRequest("GET", "/assets/a.css", nil)
+		req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, replacer))
+
+		w := httptest.NewRecorder()
+		assert.NoError(t, handler.ServeHTTP(w, req, next), i)
+		assert.Equal(t, "Hello :)", w.Body.String(), i)
+		assert.Equal(t, status, w.Header().Get("X-Cache-Status"), i)
+
+		value, _ := replacer.Get("http.cache.status")
+		assert.Equal(t, status, value, i)
+		key, _ := replacer.Get("http.cache.key")
+		assert.NotEmpty(t, key, i)
+	}
+	assert.Equal(t, 1, timesCalled)
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	handler := provisionHandler(t, []string{"cache_errors", "502", "1m"})
+	defer handler.Cleanup()
+
+	timesCalled := 0
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		timesCalled++
+		return caddyhttp.Error(http.StatusBadGateway, errors.New("upstream is down"))
+	})
+
+	for i := 0; i < 2; i++ {
+		err := handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), next)
+		var handlerErr caddyhttp.HandlerError
+		assert.True(t, errors.As(err, &handlerErr), i)
+		assert.Equal(t, http.StatusBadGateway, handlerErr.StatusCode, i)
+	}
+	assert.Equal(t, 1, timesCalled, "The 502 must be cached")
+
+	next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("plain error")
+	})
+	err := handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/plain", nil), next)
+	var handlerErr caddyhttp.HandlerError
+	assert.True(t, errors.As(err, &handlerErr), "Errors are returned as caddyhttp errors")
+	assert.Equal(t, http.StatusInternalServerError, handlerErr.StatusCode)
+}
@@ -0,0 +1,454 @@
+package core
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const bucketsSize = 256
+
+type Cache struct {
+	// This are the Read/Write locks shared by key
+	// So the prevents to lock all keys when only one is being written
+	entriesLock [bucketsSize]*sync.RWMutex
+	entries     [bucketsSize]map[string]*CacheEntry
+	storage     Storage
+
+	// Max number of values stored by key, 0 means unlimited
+	// When it is exceeded the least recently used values are dropped
+	MaxVariants int
+
+	// Max time a request waits for another one that is fetching the same key, 0 means forever
+	// After it the request uses the value found, even if it is stale, or goes upstream
+	LockTimeout time.Duration
+
+	// Time values are kept after they expire, so they can be used after LockTimeout
+	StaleTTL time.Duration
+
+	// Number of values dropped because of MaxVariants, it must be accessed atomically
+	droppedVariants uint64
+	sequence        uint64
+}
+
+type CacheEntry struct {
+	// This lock is used to prevent concurrent access to the same upstream
+	// Only one request by key fetches it, the others wait until it is stored
+	fetchLock entryLock
+
+	// This lock protects the values, index and varies of the entry
+	// It is not meant to protect access to contents, the `mutex` of storage is used for that.
+	valuesLock *sync.Mutex
+
+	// Values ordered from the most to the least recently used
+	values *list.List
+
+	// Values indexed by the Vary of their response and the variant of their request
+	index map[string]*list.Element
+
+	// Number of values by Vary of their response
+	// Used to know which variants of a request have to be searched
+	varies map[string]int
+}
+
+/**
+ * A VariantFunc returns the variant of the current request given the
+ * headers listed in the Vary of a stored response.
+ * Values are only found by requests with the same variant of the request that stored them.
+ */
+type VariantFunc func(vary string) string
+
+type Value struct {
+	expiration time.Time
+
+	// The Vary of the response and the variant of the request, used as index in the entry
+	vary    string
+	variant string
+
+	// Incremented each time a value is pushed, the most recent value wins
+	// when a request matches many of them
+	sequence uint64
+
+	// Number of times the value was found in GetOrSet
+	// It is only modified while holding the valuesLock of the entry
+	hits int
+
+	// This lock prevents deleting the content on disk
+	// While there is a request reading from it
+	refLock *sync.RWMutex
+
+	// ref is a previous request/response stored
+	// This can easily be a Clear() interface but
+	// Using HttpCacheEntry prevents having to cast
+	// everywhere. This is because the lock of the map
+	// Is used to prevent deleting it from the map
+	// But the lock is released after the entry is read from the map
+	// It does not mean that some go routine is not using it
+	ref *HttpCacheEntry
+}
+
+var errLockTimeout = errors.New("timeout waiting for the lock of the key")
+
+// entryLock is a mutex that can stop waiting for the lock
+type entryLock chan struct{}
+
+/**
+ * Locks it or returns an error if the context is done or the timeout
+ * is reached first. A timeout of 0 waits forever.
+ */
+func (l entryLock) lock(ctx context.Context, timeout time.Duration) error {
+	select {
+	case l <- struct{}{}:
+		return nil
+	default:
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case l <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-expired:
+		return errLockTimeout
+	}
+}
+
+func (l entryLock) unlock() {
+	<-l
+}
+
+func NewCache(storage Storage) *Cache {
+	return &Cache{storage: storage}
+}
+
+func (s *Cache) Setup() error {
+	for i := 0; i < int(bucketsSize); i++ {
+		s.entriesLock[i] = new(sync.RWMutex)
+		s.entries[i] = make(map[string]*CacheEntry)
+	}
+
+	if err := s.storage.Setup(); err != nil {
+		return err
+	}
+	if storage, ok := s.storage.(RestorableStorage); ok {
+		return storage.Restore(s.restore)
+	}
+	return nil
+}
+
+// Pushes an entry restored by the storage, the ones expired are cleared
+func (s *Cache) restore(key string, variant string, entry *HttpCacheEntry) {
+	if !entry.Expiration.Add(s.StaleTTL).After(time.Now().UTC()) {
+		entry.Clear()
+		return
+	}
+	s.push(key, s.getEntry(key), entry, func(string) string { return variant })
+}
+
+/**
+ * Closes the storage if it holds resources like open files or connections,
+ * it is done when caddy stops or reloads the config and the cache is not used anymore.
+ */
+func (s *Cache) Close() error {
+	if closer, ok := s.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func (s *Cache) Clear() error {
+	// TODO
+	return nil
+	// return s.storage.Clean()
+}
+
+func (s *Cache) getEntry(key string) *CacheEntry {
+	i := s.getBucketIndexForKey(key)
+
+	s.entriesLock[i].Lock()
+	entry, ok := s.entries[i][key]
+	if !ok {
+		s.entries[i][key] = &CacheEntry{
+			values:     list.New(),
+			index:      make(map[string]*list.Element),
+			varies:     make(map[string]int),
+			fetchLock:  make(entryLock, 1),
+			valuesLock: new(sync.Mutex),
+		}
+		entry = s.entries[i][key]
+	}
+	s.entriesLock[i].Unlock()
+
+	return entry
+}
+
+/**
+ * Given a key and the variant of the request it fetches the searched value.
+ * If it exists it calls the handler with that value.
+ * If it doesn't it calls the value with nil and the return value
+ * of the handler will be pushed.
+ */
+func (s *Cache) GetOrSet(key string, variant VariantFunc, handler func(*HttpCacheEntry) (*HttpCacheEntry, error)) error {
+	return s.GetOrSetContext(context.Background(), key, variant, handler)
+}
+
+/**
+ * Like GetOrSet but it stops waiting for the request that is fetching the same key
+ * when the context is done, returning its error, or when LockTimeout is reached.
+ * After LockTimeout the handler is called with the value found, even if it is stale,
+ * or with nil so it goes upstream without waiting.
+ */
+func (s *Cache) GetOrSetContext(ctx context.Context, key string, variant VariantFunc, handler func(*HttpCacheEntry) (*HttpCacheEntry, error)) error {
+	entry := s.getEntry(key)
+
+	// While searching the values is important that nobody else fetches them
+	// Until the resource is found in the entries' list or is fetched
+	if err := entry.fetchLock.lock(ctx, s.LockTimeout); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return s.getOrSetWithoutWaiting(key, entry, variant, handler)
+	}
+
+	entry.valuesLock.Lock()
+	if value := entry.find(variant); value != nil && value.isFresh() {
+		// The searched resource if found, others can search it too
+		entry.fetchLock.unlock()
+		return s.handleValue(key, entry, value, variant, handler)
+	}
+	entry.valuesLock.Unlock()
+
+	// If the entry is not on the list wait until it is fetched from upstream
+	defer entry.fetchLock.unlock()
+
+	newValue, err := handler(nil)
+	if err != nil || newValue == nil {
+		return err
+	}
+
+	s.push(key, entry, newValue, variant)
+	return nil
+}
+
+/**
+ * Used after LockTimeout, it fetches the value without holding the fetchLock.
+ * The value found is used if it is fresh, or if it is stale and StaleTTL allows stale values.
+ */
+func (s *Cache) getOrSetWithoutWaiting(key string, entry *CacheEntry, variant VariantFunc, handler func(*HttpCacheEntry) (*HttpCacheEntry, error)) error {
+	entry.valuesLock.Lock()
+	if value := entry.find(variant); value != nil && (s.StaleTTL > 0 || value.isFresh()) {
+		return s.handleValue(key, entry, value, variant, handler)
+	}
+	entry.valuesLock.Unlock()
+
+	newValue, err := handler(nil)
+	if err != nil || newValue == nil {
+		return err
+	}
+
+	s.push(key, entry, newValue, variant)
+	return nil
+}
+
+/**
+ * Calls the handler with the found value.
+ * It must be called with valuesLock, which is released before calling the handler.
+ */
+func (s *Cache) handleValue(key string, entry *CacheEntry, value *Value, variant VariantFunc, handler func(*HttpCacheEntry) (*HttpCacheEntry, error)) error {
+	// Read lock the content so it is not expired while using it in the handler
+	value.refLock.RLock()
+	defer value.refLock.RUnlock()
+
+	value.hits++
+	hits := value.hits
+	entry.valuesLock.Unlock()
+
+	s.notifyHit(value.ref, hits)
+
+	// Call the handler
+	newValue, err := handler(value.ref)
+
+	// The case when newValue is not nil is when a previous time called
+	// was not cacheable but now it is. Should rarely happen
+	if err == nil && newValue != nil {
+		s.push(key, entry, newValue, variant)
+	}
+
+	return err
+}
+
+func (value *Value) isFresh() bool {
+	return value.expiration.After(time.Now().UTC())
+}
+
+/**
+ * Looks for the value of each Vary stored in the entry and returns the most recent.
+ * The found value is moved to the front of the list, it must be called with valuesLock.
+ */
+func (entry *CacheEntry) find(variant VariantFunc) *Value {
+	var found *list.Element
+	for vary := range entry.varies {
+		element, ok := entry.index[indexKey(vary, variant(vary))]
+		if ok && (found == nil || element.Value.(*Value).sequence > found.Value.(*Value).sequence) {
+			found = element
+		}
+	}
+
+	if found == nil {
+		return nil
+	}
+
+	entry.values.MoveToFront(found)
+	return found.Value.(*Value)
+}
+
+// remove deletes the value from the entry, it must be called with valuesLock
+func (entry *CacheEntry) remove(element *list.Element) *Value {
+	value := entry.values.Remove(element).(*Value)
+	delete(entry.index, indexKey(value.vary, value.variant))
+	entry.varies[value.vary]--
+	if entry.varies[value.vary] == 0 {
+		delete(entry.varies, value.vary)
+	}
+	return value
+}
+
+func indexKey(vary string, variant string) string {
+	return vary + "\n" + variant
+}
+
+func (s *Cache) unsafePush(key string, entry *CacheEntry, newValue *HttpCacheEntry, variant VariantFunc) {
+	vary := newValue.Vary()
+	value := &Value{
+		ref:        newValue,
+		refLock:    new(sync.RWMutex),
+		expiration: newValue.Expiration,
+		vary:       vary,
+		variant:    variant(vary),
+		sequence:   atomic.AddUint64(&s.sequence, 1),
+	}
+
+	// A previous value of the same variant is replaced
+	if previous, ok := entry.index[indexKey(value.vary, value.variant)]; ok {
+		go s.clearValue(entry.remove(previous))
+	}
+
+	// This pushes the new entry on top of the list
+	// This is useful to use the most recent values first
+	entry.index[indexKey(value.vary, value.variant)] = entry.values.PushFront(value)
+	entry.varies[value.vary]++
+
+	// Drop the least recently used values
+	for s.MaxVariants > 0 && entry.values.Len() > s.MaxVariants {
+		go s.clearValue(entry.remove(entry.values.Back()))
+		atomic.AddUint64(&s.droppedVariants, 1)
+	}
+
+	// Launch a new go routine that will expire the content, stale values are kept StaleTTL more
+	go s.expire(key, newValue.Expiration.Add(s.StaleTTL))
+}
+
+/**
+ * Stores the value without looking for the current one, replacing the value of the same variant.
+ * It is used to refresh values in background while the current one is still served.
+ */
+func (s *Cache) Push(key string, variant VariantFunc, value *HttpCacheEntry) {
+	s.push(key, s.getEntry(key), value, variant)
+}
+
+/**
+ * Removes the value of the variant if it is still ref, like when its content can't be read.
+ * Its content is cleared once nobody reads it.
+ */
+func (s *Cache) Evict(key string, variant VariantFunc, ref *HttpCacheEntry) {
+	entry := s.getEntry(key)
+	entry.valuesLock.Lock()
+	defer entry.valuesLock.Unlock()
+
+	vary := ref.Vary()
+	element, ok := entry.index[indexKey(vary, variant(vary))]
+	if ok && element.Value.(*Value).ref == ref {
+		go s.clearValue(entry.remove(element))
+	}
+}
+
+func (s *Cache) push(key string, entry *CacheEntry, value *HttpCacheEntry, variant VariantFunc) {
+	entry.valuesLock.Lock()
+	defer entry.valuesLock.Unlock()
+	s.unsafePush(key, entry, value, variant)
+}
+
+// DroppedVariants returns how many values were dropped because a key exceeded MaxVariants
+func (s *Cache) DroppedVariants() uint64 {
+	return atomic.LoadUint64(&s.droppedVariants)
+}
+
+// notifyHit lets the content know how many times it was used
+// So storages like TieredStorage can move it to a faster storage
+func (s *Cache) notifyHit(ref *HttpCacheEntry, hits int) {
+	if ref == nil || ref.Response == nil {
+		return
+	}
+	if content, ok := ref.Response.Body.(HitAwareContent); ok {
+		content.Hit(hits)
+	}
+}
+
+func (s *Cache) getBucketIndexForKey(key string) uint32 {
+	return uint32(math.Mod(float64(crc32.ChecksumIEEE([]byte(key))), float64(bucketsSize)))
+}
+
+func (s *Cache) NewContent(key string) (StorageContent, error) {
+	return s.storage.NewContent(key)
+}
+
+func (s *Cache) expire(key string, expiration time.Time) {
+	// Sleep until is time to cleanup entry
+	time.Sleep(expiration.Sub(time.Now().UTC()))
+
+	// Get bucket and lock
+	bucket := s.getBucketIndexForKey(key)
+	s.entriesLock[bucket].Lock()
+	entry, ok := s.entries[bucket][key]
+	s.entriesLock[bucket].Unlock()
+
+	if !ok {
+		// Possible bug, how it ended here?
+		return
+	}
+
+	entry.valuesLock.Lock()
+	defer entry.valuesLock.Unlock()
+
+	for element := entry.values.Front(); element != nil; {
+		next := element.Next()
+		// Check which entry for the key is expired
+		if !element.Value.(*Value).expiration.Add(s.StaleTTL).After(time.Now().UTC()) {
+			// Clear the content in other go routine
+			// If it is being red it can block others
+			go s.clearValue(entry.remove(element)) // Copying the pointer to the go routine is required to avoid reading an invalid value
+		}
+		element = next
+	}
+}
+
+// clearValue waits until nobody is reading the value and deletes its content
+func (s *Cache) clearValue(value *Value) {
+	// Get lock to prevent any other go routine read from it
+	value.refLock.Lock()
+	// Delete it if it is on disk
+	value.ref.Clear()
+}
@@ -0,0 +1,370 @@
+package core
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+func noVariant(vary string) string {
+	return ""
+}
+
+func variant(name string) VariantFunc {
+	return func(vary string) string {
+		return name
+	}
+}
+
+func push(m *Cache, key string, value *HttpCacheEntry) {
+	pushVariant(m, key, "", value)
+}
+
+func pushVariant(m *Cache, key string, name string, value *HttpCacheEntry) {
+	m.GetOrSet(key, variant(name), func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		return value, nil
+	})
+}
+
+// TODO create a get helper
+
+/* Actual tests */
+
+func TestGetSet(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	a := &HttpCacheEntry{
+		Response:   nil,
+		Expiration: time.Now().Add(time.Duration(5) * time.Second),
+	}
+
+	push(m, "a", a)
+	err := m.GetOrSet("a", noVariant, func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, a, found, "Could not found searched value")
+		return nil, nil
+	})
+
+	assert.NoError(t, err, "Should not have been an error")
+}
+
+func TestGetNonExistentKey(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	a := &HttpCacheEntry{
+		Response:   nil,
+		Expiration: time.Now().Add(time.Duration(5) * time.Second),
+	}
+
+	push(m, "a", a)
+	err := m.GetOrSet("b", noVariant, func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Nil(t, found, "Should not have found element")
+		return nil, nil
+	})
+
+	assert.NoError(t, err, "Should not have been an error")
+}
+
+func TestPushManyValuesInSameKey(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	inFiveSeconds := time.Now().UTC().Add(time.Duration(5) * time.Second)
+	inTwoSeconds := time.Now().UTC().Add(time.Duration(2) * time.Second)
+
+	a := &HttpCacheEntry{Response: nil, Expiration: inFiveSeconds}
+	b := &HttpCacheEntry{Response: &Response{}, Expiration: inTwoSeconds}
+
+	pushVariant(m, "a", "a", a)
+	pushVariant(m, "a", "b", b)
+
+	err := m.GetOrSet("a", variant("a"), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, a, found, "Got another value")
+		return nil, nil
+	})
+
+	assert.NoError(t, err, "Error while getting first value of a")
+
+	err = m.GetOrSet("a", variant("b"), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, b, found, "Got another value")
+		return nil, nil
+	})
+	assert.NoError(t, err, "Error while getting second value of a")
+}
+
+func TestPushManyValuesToDifferentKeys(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	inFiveSeconds := time.Now().UTC().Add(time.Duration(5) * time.Second)
+	inTwoSeconds := time.Now().UTC().Add(time.Duration(2) * time.Second)
+
+	a := &HttpCacheEntry{Response: nil, Expiration: inFiveSeconds}
+	b := &HttpCacheEntry{Response: &Response{}, Expiration: inTwoSeconds}
+
+	push(m, "a", a)
+	push(m, "b", b)
+
+	err := m.GetOrSet("a", noVariant, func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, a, found, "Got another value")
+		return nil, nil
+	})
+	assert.NoError(t, err, "Error while getting first value of a")
+
+	err = m.GetOrSet("b", noVariant, func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, b, found, "Got another value")
+		return nil, nil
+	})
+	assert.NoError(t, err, "Error while getting second value of a")
+}
+
+func TestMaxVariants(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	m.MaxVariants = 2
+	inFiveSeconds := time.Now().UTC().Add(time.Duration(5) * time.Second)
+
+	a := &HttpCacheEntry{Response: &Response{Code: 1}, Expiration: inFiveSeconds}
+	b := &HttpCacheEntry{Response: &Response{Code: 2}, Expiration: inFiveSeconds}
+	c := &HttpCacheEntry{Response: &Response{Code: 3}, Expiration: inFiveSeconds}
+
+	pushVariant(m, "a", "a", a)
+	pushVariant(m, "a", "b", b)
+	pushVariant(m, "a", "c", c)
+
+	assertFound := func(name string, shouldExist bool) {
+		m.GetOrSet("a", variant(name), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+			if shouldExist {
+				assert.NotNil(t, found, "A recent variant was dropped")
+			} else {
+				assert.Nil(t, found, "The oldest variant should have been dropped")
+			}
+			return nil, nil
+		})
+	}
+
+	assertFound("a", false)
+	assertFound("b", true)
+	assertFound("c", true)
+	assert.Equal(t, uint64(1), m.DroppedVariants())
+
+	// Using b makes c the least recently used
+	assertFound("b", true)
+	pushVariant(m, "a", "d", &HttpCacheEntry{Response: &Response{Code: 4}, Expiration: inFiveSeconds})
+	assertFound("b", true)
+	assertFound("c", false)
+	assertFound("d", true)
+	assert.Equal(t, uint64(2), m.DroppedVariants())
+}
+
+func TestPushSameVariantReplacesValue(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	inFiveSeconds := time.Now().UTC().Add(time.Duration(5) * time.Second)
+
+	a := &HttpCacheEntry{Response: &Response{Code: 1}, Expiration: inFiveSeconds}
+	b := &HttpCacheEntry{Response: &Response{Code: 2}, Expiration: inFiveSeconds}
+
+	push(m, "a", a)
+	push(m, "a", b)
+
+	entry := m.getEntry("a")
+	assert.Equal(t, 1, entry.values.Len(), "The previous value should have been replaced")
+	m.GetOrSet("a", noVariant, func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Equal(t, b, found, "Got the replaced value")
+		return nil, nil
+	})
+}
+
+func TestExpire(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	in10Milliseconds := time.Now().UTC().Add(time.Duration(10) * time.Millisecond)
+	in40Milliseconds := time.Now().UTC().Add(time.Duration(40) * time.Millisecond)
+	in80Milliseconds := time.Now().UTC().Add(time.Duration(80) * time.Millisecond)
+
+	a := &HttpCacheEntry{Response: nil, Expiration: in10Milliseconds}
+	b := &HttpCacheEntry{Response: &Response{}, Expiration: in40Milliseconds}
+	c := &HttpCacheEntry{Response: &Response{}, Expiration: in80Milliseconds}
+
+	pushVariant(m, "a", "nil", a)
+	pushVariant(m, "a", "notNil", b)
+	pushVariant(m, "b", "notNil", c)
+
+	assertExpiration := func(key string, responseIsNil bool, shouldExist bool) {
+		name := "notNil"
+		if responseIsNil {
+			name = "nil"
+		}
+		m.GetOrSet(key, variant(name), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+			if shouldExist {
+				assert.NotNil(t, found, "An entry that should exist was expired")
+			} else {
+				assert.Nil(t, found, "An entry that should be expired was not")
+			}
+			return nil, nil
+		})
+	}
+
+	assertExpiration("a", true, true)
+	assertExpiration("a", false, true)
+	assertExpiration("b", false, true)
+
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	assertExpiration("a", true, false)
+	assertExpiration("a", false, true)
+	assertExpiration("b", false, true)
+
+	time.Sleep(time.Duration(40) * time.Millisecond)
+
+	assertExpiration("a", true, false)
+	assertExpiration("a", false, false)
+	assertExpiration("b", false, true)
+
+	time.Sleep(time.Duration(40) * time.Millisecond)
+
+	assertExpiration("a", true, false)
+	assertExpiration("a", false, false)
+	assertExpiration("b", false, false)
+}
+
+func TestMMapExpire(t *testing.T) {
+	m := NewCache(NewMMapStorage("/tmp/caddy-cache-tests"))
+	m.Setup()
+	in10Milliseconds := time.Now().UTC().Add(time.Duration(10) * time.Millisecond)
+	key := "a"
+
+	content := []byte("Hello")
+	mmap, err := m.NewContent(key)
+	assert.NoError(t, err, "Failed creating new content")
+	mmap.Write(content)
+	mmap.Close()
+
+	a := &HttpCacheEntry{Response: &Response{Body: mmap}, Expiration: in10Milliseconds}
+	push(m, key, a)
+	filename := ""
+	err = m.GetOrSet(key, noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.NotNil(t, entry, "Entry was not found")
+		filename = entry.Response.Body.(*MMapContent).name
+		return nil, nil
+	})
+	assert.NoError(t, err, "There was an error in get")
+	readContent, err := ioutil.ReadFile(filename)
+	assert.NoError(t, err, "Error reading file")
+	assert.Equal(t, content, readContent, "Saved content does not match")
+
+	// Lock the content for 20 milliseconds
+	go m.GetOrSet(key, noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		time.Sleep(time.Duration(20) * time.Millisecond)
+		return nil, nil
+	})
+
+	// After 10 ms entry should be deleted but content should still be available
+	time.Sleep(time.Duration(15) * time.Millisecond)
+	m.GetOrSet(key, noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Nil(t, entry, "Content should have expired")
+		return nil, nil
+	})
+
+	// Read the content again
+	_, err = ioutil.ReadFile(filename)
+	assert.NoError(t, err, "Error reading file")
+
+	// Wait 10 ms and the content should be deleted
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	_, err = ioutil.ReadFile(filename)
+	assert.Error(t, err, "File still exists")
+}
+
+// Starts fetching the key in other go routine, the fetch takes the given duration
+func fetchSlowly(m *Cache, key string, duration time.Duration) {
+	started := make(chan bool)
+	go m.GetOrSet(key, noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		started <- true
+		time.Sleep(duration)
+		return &HttpCacheEntry{Expiration: time.Now().UTC().Add(time.Minute)}, nil
+	})
+	<-started
+}
+
+func TestLockTimeoutGoesUpstream(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	m.LockTimeout = time.Duration(20) * time.Millisecond
+
+	fetchSlowly(m, "a", time.Duration(300)*time.Millisecond)
+
+	start := time.Now()
+	called := false
+	err := m.GetOrSet("a", noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Nil(t, entry, "There is no value to use")
+		called = true
+		return nil, nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, called)
+	assert.True(t, time.Since(start) < time.Duration(200)*time.Millisecond, "It should not have waited the other fetch")
+}
+
+func TestLockTimeoutWithoutStaleIgnoresExpiredValue(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	m.LockTimeout = time.Duration(20) * time.Millisecond
+
+	// It is pushed with StaleTTL so it is still there after it expires
+	m.StaleTTL = time.Minute
+	push(m, "a", &HttpCacheEntry{Expiration: time.Now().UTC().Add(time.Duration(10) * time.Millisecond)})
+	m.StaleTTL = 0
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	fetchSlowly(m, "a", time.Duration(300)*time.Millisecond)
+
+	called := false
+	m.GetOrSet("a", noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Nil(t, entry, "Expired values are only used with stale")
+		called = true
+		return nil, nil
+	})
+	assert.True(t, called)
+}
+
+func TestLockTimeoutUsesStaleValue(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+	m.LockTimeout = time.Duration(20) * time.Millisecond
+	m.StaleTTL = time.Minute
+
+	stale := &HttpCacheEntry{Expiration: time.Now().UTC().Add(time.Duration(10) * time.Millisecond)}
+	push(m, "a", stale)
+	time.Sleep(time.Duration(20) * time.Millisecond)
+
+	// The stale value is not used by the request that gets the lock
+	fetchSlowly(m, "a", time.Duration(300)*time.Millisecond)
+
+	var found *HttpCacheEntry
+	m.GetOrSet("a", noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		found = entry
+		return nil, nil
+	})
+	assert.Equal(t, stale, found, "The stale value should have been used after the timeout")
+}
+
+func TestLockWaitStopsWithContext(t *testing.T) {
+	m := NewCache(NewMemoryStorage())
+	m.Setup()
+
+	fetchSlowly(m, "a", time.Duration(300)*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(20)*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := m.GetOrSetContext(ctx, "a", noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.Fail(t, "The handler should not have been called")
+		return nil, nil
+	})
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.True(t, time.Since(start) < time.Duration(200)*time.Millisecond, "It should have stopped waiting")
+}
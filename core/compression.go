@@ -0,0 +1,179 @@
+package core
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const GZIP_ENCODING = "gzip"
+
+// Bodies smaller than this are not worth compressing
+const MIN_COMPRESS_SIZE = 256
+
+var DEFAULT_COMPRESS_TYPES = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"image/svg+xml",
+}
+
+/**
+ * GzipContent compresses everything written to it before storing it
+ * in the wrapped StorageContent. Bytes returns the compressed content.
+ */
+type GzipContent struct {
+	wrappedContent
+	writer *gzip.Writer
+}
+
+func NewGzipContent(content StorageContent) *GzipContent {
+	return &GzipContent{
+		wrappedContent: wrappedContent{content},
+		writer:         gzip.NewWriter(content),
+	}
+}
+
+func (c *GzipContent) Write(p []byte) (int, error) {
+	return c.writer.Write(p)
+}
+
+func (c *GzipContent) Close() error {
+	if err := c.writer.Close(); err != nil {
+		return err
+	}
+	return c.StorageContent.Close()
+}
+
+/**
+ * Returns true if the pattern matches the media type of contentType
+ * Patterns can use wildcards like image/* or *
+ */
+func mediaTypeMatches(pattern string, contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	pattern = strings.ToLower(pattern)
+
+	if pattern == "*" || pattern == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*"))
+	}
+	return mediaType == pattern
+}
+
+/**
+ * Returns the q value that Accept-Encoding values give to the encoding
+ * 0 means the encoding is not accepted
+ */
+func encodingQuality(values []string, encoding string) float64 {
+	wildcard := float64(0)
+	for _, accepted := range parseQualityValues(values) {
+		name := strings.ToLower(accepted.value)
+		if name == encoding {
+			return accepted.quality
+		}
+		if name == "*" {
+			wildcard = accepted.quality
+		}
+	}
+	return wildcard
+}
+
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	return encodingQuality(r.Header["Accept-Encoding"], encoding) > 0
+}
+
+/**
+ * Decides if a response being stored should be compressed
+ */
+func (h *CacheHandler) shouldCompress(code int, header http.Header) bool {
+	if !h.Config.Compress || code == http.StatusNoContent || code == http.StatusPartialContent {
+		return false
+	}
+
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < MIN_COMPRESS_SIZE {
+		return false
+	}
+
+	contentType := header.Get("Content-Type")
+	for _, pattern := range h.Config.CompressTypes {
+		if mediaTypeMatches(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Decompresses a stored body for the clients that don't accept gzip while it is sent.
+ * A broken gzip header is found before anything is sent, so the body can still be fetched again,
+ * errors in the rest of the data are returned by Read and kept in err.
+ */
+type gunzipBody struct {
+	reader *gzip.Reader
+	body   io.Closer
+	err    error
+}
+
+func decompressBody(body io.ReadCloser) (*gunzipBody, error) {
+	reader, err := gzip.NewReader(body)
+	if err != nil {
+		return nil, err
+	}
+	return &gunzipBody{reader: reader, body: body}, nil
+}
+
+func (b *gunzipBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// Closes the stored body too
+func (b *gunzipBody) Close() error {
+	b.reader.Close()
+	return b.body.Close()
+}
+
+/**
+ * Sends a body that was compressed when it was stored.
+ * Clients that accept gzip receive it as it is, with a weak ETag because
+ * the bytes differ from the ones upstream sent. The others receive the
+ * body decompressed by decompressBody while it is sent.
+ */
+func respondCompressed(response *Response, body io.Reader, w http.ResponseWriter, r *http.Request) {
+	addVary(w.Header(), "Accept-Encoding")
+
+	if acceptsEncoding(r, GZIP_ENCODING) {
+		w.Header().Set("Content-Encoding", GZIP_ENCODING)
+		w.Header().Del("Content-Length")
+		if etag := w.Header().Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			w.Header().Set("ETag", "W/"+etag)
+		}
+	}
+	w.WriteHeader(response.Code)
+	io.Copy(w, body)
+}
+
+func addVary(header http.Header, name string) {
+	for _, vary := range header["Vary"] {
+		for _, existing := range strings.Split(vary, ",") {
+			if strings.EqualFold(strings.TrimSpace(existing), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
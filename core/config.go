@@ -0,0 +1,134 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const DEFAULT_MAX_AGE = time.Duration(60) * time.Second
+
+// Time values are kept after they expire when lock_timeout uses stale values
+const DEFAULT_STALE_TTL = time.Duration(5) * time.Minute
+
+// Responses with Last-Modified are fresh for a fraction of their age, up to a max
+const DEFAULT_HEURISTIC_FACTOR = 0.1
+const DEFAULT_HEURISTIC_MAX_AGE = time.Duration(24) * time.Hour
+
+// Errors cached when cache_errors is used without status codes
+var DEFAULT_ERROR_TTLS = map[int]time.Duration{
+	http.StatusNotFound:            time.Duration(10) * time.Second,
+	http.StatusGone:                time.Duration(10) * time.Second,
+	http.StatusInternalServerError: time.Duration(5) * time.Second,
+	http.StatusBadGateway:          time.Duration(5) * time.Second,
+	http.StatusServiceUnavailable:  time.Duration(5) * time.Second,
+	http.StatusGatewayTimeout:      time.Duration(5) * time.Second,
+}
+
+type Config struct {
+	Storage       Storage
+	CacheRules    []CacheRule
+	DefaultMaxAge time.Duration
+	StatusHeader  string
+	Compress      bool
+	CompressTypes []string
+
+	VaryNormalizers map[string]VaryNormalizer
+	MaxVariants     int
+
+	// TTL by status code for responses matched by a rule without TTL and without an explicit expiration
+	StatusTTLs map[int]time.Duration
+
+	// Error responses are cached only for the status codes in ErrorTTLs
+	ErrorTTLs map[int]time.Duration
+
+	// Requests matching any of these rules skip the cache
+	BypassRules []CacheRule
+
+	// Store responses with Set-Cookie removing the header, otherwise they are not stored
+	StripSetCookie bool
+
+	// Freshness of responses with Last-Modified and without explicit expiration
+	// A factor of 0 disables it. HeuristicWarning adds Warning: 113 to hits older than a day
+	HeuristicFactor  float64
+	HeuristicMaxAge  time.Duration
+	HeuristicWarning bool
+
+	// Cache-Control headers targeted to this cache, checked before CDN-Cache-Control and Surrogate-Control
+	TargetedHeaders []string
+
+	// Defenses against web cache deception and poisoning
+	// Requests with UnkeyedHeaders skip the cache or get them stripped if StripUnkeyedHeaders is set
+	Harden              bool
+	UnkeyedHeaders      []string
+	StripUnkeyedHeaders bool
+
+	// Entries with RefreshMinHits are refreshed in background when they are in the last
+	// RefreshFactor of their lifetime or by XFetch if RefreshBeta is set. 0 disables them
+	RefreshFactor  float64
+	RefreshBeta    float64
+	RefreshMinHits int
+
+	// Requests waiting LockTimeout for the request fetching the same key go upstream
+	// If StaleTTL is set values are kept that time after they expire and are used instead
+	LockTimeout time.Duration
+	StaleTTL    time.Duration
+
+	// URLs stored at startup and when WarmEndpoint is requested from a WarmAllowed address
+	WarmSources     []WarmSource
+	WarmConcurrency int
+	WarmEndpoint    string
+	WarmAllowed     *IPCacheRule
+
+	// The host of the relative URLs warmed
+	WarmHost string
+
+	// A zone shared with other sites, used instead of Storage. Site is the name
+	// its stored bytes are accounted to, the host of the requests if it is empty
+	Zone *Zone
+	Site string
+
+	// Shares the responses stored with other instances, set with storages like RESPStorage
+	Index SharedIndex
+
+	// Messages below LogLevel are discarded, they are written to LogFile if it is set
+	// Logger is created with them when the handler is created if it is nil
+	LogLevel LogLevel
+	LogFile  string
+	Logger   *Logger
+}
+
+/**
+ * Returns a config with the default values, responses are stored in memory.
+ */
+func DefaultConfig() *Config {
+	return &Config{
+		Storage:         NewMemoryStorage(),
+		CacheRules:      []CacheRule{},
+		DefaultMaxAge:   DEFAULT_MAX_AGE,
+		HeuristicFactor: DEFAULT_HEURISTIC_FACTOR,
+		HeuristicMaxAge: DEFAULT_HEURISTIC_MAX_AGE,
+	}
+}
+
+/**
+ * Parses ranges like 10.0.0.0/8 or single addresses like 127.0.0.1 or ::1
+ */
+func ParseNetwork(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %s", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	return network, err
+}
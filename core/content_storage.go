@@ -0,0 +1,243 @@
+// +build !windows
+
+package core
+
+import (
+	"bytes"
+	"encoding/base32"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync/atomic"
+	"syscall"
+)
+
+/* Storage */
+type Storage interface {
+	Setup() error
+	NewContent(string) (StorageContent, error)
+}
+
+type StorageContent interface {
+	io.WriteCloser
+	Bytes() []byte
+	Clear() error
+}
+
+// Takes an exclusive lock of the file, it fails if other process has it
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+/* Memory Storage */
+
+type MemoryStorage struct{}
+
+type MemoryData struct {
+	content *bytes.Buffer
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{}
+}
+
+func (s *MemoryStorage) Setup() error {
+	return nil
+}
+
+func (s *MemoryStorage) NewContent(key string) (StorageContent, error) {
+	return &MemoryData{content: new(bytes.Buffer)}, nil
+}
+
+func (buff *MemoryData) Write(p []byte) (int, error) {
+	return buff.content.Write(p)
+}
+
+func (buff *MemoryData) Bytes() []byte {
+	return buff.content.Bytes()
+}
+
+func (buff *MemoryData) Close() error {
+	// TODO should this return an error if it was already closed?
+	return nil
+}
+
+func (buff *MemoryData) Clear() error {
+	return nil
+}
+
+/*
+ *
+ * MMap Storage
+ *
+ */
+
+var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
+
+func randSeq(n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letters[rand.Intn(len(letters))]
+	}
+	return string(b)
+}
+
+// Files are only open while they are written, so this is the max number of responses being stored
+// when the limit of open files of the process can't be read
+const DEFAULT_MMAP_MAX_OPEN_FILES = int64(1024)
+
+/**
+ * defaultMMapMaxOpenFiles returns half of the soft limit of open files of the process,
+ * so the storage leaves the other half to the connections and the rest of the server.
+ */
+func defaultMMapMaxOpenFiles() int64 {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil || limit.Cur < 2 {
+		return DEFAULT_MMAP_MAX_OPEN_FILES
+	}
+
+	return int64(limit.Cur / 2)
+}
+
+// Returned by NewContent when MaxOpenFiles files are being written, the response is not stored
+var ErrTooManyOpenFiles = errors.New("too many open files in mmap storage")
+
+/**
+ * MMapStorage writes each content to a file and maps it to memory once it is closed.
+ * The file is closed after it is mapped because the mapping survives it,
+ * so only the contents being written keep a file descriptor open.
+ */
+type MMapStorage struct {
+	path string
+
+	// Max number of files open at the same time, 0 means unlimited
+	MaxOpenFiles int64
+
+	// Number of files open, it must be accessed atomically
+	openFiles int64
+}
+
+type MMapContent struct {
+	storage *MMapStorage
+	name    string
+	file    *os.File
+	mapping []byte
+
+	// The first error writing the file, the content is not mapped if there was one
+	err error
+}
+
+func NewMMapStorage(path string) *MMapStorage {
+	return &MMapStorage{path: path, MaxOpenFiles: defaultMMapMaxOpenFiles()}
+}
+
+func (s *MMapStorage) Setup() error {
+	return os.MkdirAll(s.path, 0700)
+}
+
+// Returns how many files are open, which are the ones being written
+func (s *MMapStorage) OpenFiles() int64 {
+	return atomic.LoadInt64(&s.openFiles)
+}
+
+func (s *MMapStorage) NewContent(key string) (StorageContent, error) {
+	if open := atomic.AddInt64(&s.openFiles, 1); s.MaxOpenFiles > 0 && open > s.MaxOpenFiles {
+		atomic.AddInt64(&s.openFiles, -1)
+		return nil, ErrTooManyOpenFiles
+	}
+
+	filename := path.Join(s.path, base32.StdEncoding.EncodeToString([]byte(key))+randSeq(10))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		atomic.AddInt64(&s.openFiles, -1)
+		return nil, err
+	}
+	return &MMapContent{storage: s, name: filename, file: file}, nil
+}
+
+func (data *MMapContent) Write(p []byte) (int, error) {
+	if data.err != nil {
+		return 0, data.err
+	}
+	n, err := data.file.Write(p)
+	if err != nil {
+		data.err = err
+	}
+	return n, err
+}
+
+func (data *MMapContent) Bytes() []byte {
+	return data.mapping
+}
+
+// closeFile closes the file if it is open and releases it from the open files
+func (data *MMapContent) closeFile() error {
+	if data.file == nil {
+		return nil
+	}
+	err := data.file.Close()
+	data.file = nil
+	atomic.AddInt64(&data.storage.openFiles, -1)
+	return err
+}
+
+/**
+ * Maps the file to memory and closes it. If writing or mapping failed
+ * it returns the error and the content must not be used.
+ */
+func (data *MMapContent) Close() error {
+	if data.file == nil {
+		return nil
+	}
+	if data.err != nil {
+		data.closeFile()
+		return data.err
+	}
+
+	mapping, err := data.mmap()
+	if closeErr := data.closeFile(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		if mapping != nil {
+			syscall.Munmap(mapping)
+		}
+		data.err = err
+		return err
+	}
+	data.mapping = mapping
+	return nil
+}
+
+func (data *MMapContent) mmap() ([]byte, error) {
+	if err := data.file.Sync(); err != nil {
+		return nil, err
+	}
+
+	info, err := data.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// Empty files can't be mapped
+	if info.Size() == 0 {
+		return []byte{}, nil
+	}
+	fd := int(data.file.Fd())
+	flags := syscall.PROT_READ | syscall.PROT_WRITE
+	return syscall.Mmap(fd, 0, int(info.Size()), flags, syscall.MAP_SHARED)
+}
+
+func (s *MMapContent) Clear() error {
+	if len(s.mapping) > 0 {
+		if err := syscall.Munmap(s.mapping); err != nil {
+			return err
+		}
+	}
+	s.mapping = nil
+	if err := s.closeFile(); err != nil {
+		return err
+	}
+	return os.Remove(s.name)
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"syscall"
+	"testing"
+)
+
+func TestMMapMaxOpenFilesFollowsTheProcessLimit(t *testing.T) {
+	var limit syscall.Rlimit
+	assert.NoError(t, syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit))
+
+	storage := NewMMapStorage("/tmp/caddy-cache-tests")
+	assert.Equal(t, int64(limit.Cur/2), storage.MaxOpenFiles, "Half of the open files are left to the rest of the server")
+}
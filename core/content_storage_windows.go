@@ -1,4 +1,4 @@
-package cache
+package core
 
 import (
 	"bytes"
@@ -20,6 +20,11 @@ type StorageContent interface {
 	Clear() error
 }
 
+// Files are not locked on windows, a file is not shared by two processes only when they use different paths
+func lockFile(file *os.File) error {
+	return nil
+}
+
 /* Memory Storage */
 
 type MemoryStorage struct{}
@@ -73,11 +78,15 @@ func randSeq(n int) string {
 	return string(b)
 }
 
+var ErrTooManyOpenFiles = errors.New("too many open files in mmap storage")
+
 type MMapStorage struct {
-	path string
+	path         string
+	MaxOpenFiles int64
 }
 
 type MMapContent struct {
+	name    string
 	file    *os.File
 	mapping []byte
 }
@@ -90,6 +99,10 @@ func (s *MMapStorage) Setup() error {
 	return errors.New("MMap is not available on windows")
 }
 
+func (s *MMapStorage) OpenFiles() int64 {
+	return 0
+}
+
 func (s *MMapStorage) NewContent(key string) (StorageContent, error) {
 	return nil, errors.New("Not available")
 }
@@ -0,0 +1,726 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * Applies a directive of the cache block, like match or storage, with its arguments to the config.
+ * The Caddyfiles of caddy v1 and v2 use it, so both support the same directives.
+ */
+func ApplyDirective(config *Config, parameter string, args []string) error {
+	switch parameter {
+
+	case "match":
+		if len(args) == 0 {
+			return errors.New("Invalid usage of match in cache config.")
+		} else {
+			cacheRule, err := parseMatchRules(args)
+			if err != nil {
+				return err
+			}
+			config.CacheRules = append(config.CacheRules, cacheRule)
+		}
+	case "bypass":
+		if len(args) == 0 {
+			return errors.New("Invalid usage of bypass in cache config.")
+		}
+		bypassRule, err := parseBypassRules(args)
+		if err != nil {
+			return err
+		}
+		config.BypassRules = append(config.BypassRules, bypassRule)
+	case "strip_set_cookie":
+		if len(args) != 0 {
+			return errors.New("Invalid usage of strip_set_cookie in cache config.")
+		}
+		config.StripSetCookie = true
+	case "heuristic_freshness":
+		if len(args) == 0 || len(args) > 3 {
+			return errors.New("Invalid usage of heuristic_freshness in cache config.")
+		}
+		if err := parseHeuristic(args, config); err != nil {
+			return err
+		}
+	case "lock_timeout":
+		if len(args) == 0 || len(args) > 3 {
+			return errors.New("Invalid usage of lock_timeout in cache config, use lock_timeout <duration> [origin|stale] [stale_ttl]")
+		}
+		if err := parseLockTimeout(args, config); err != nil {
+			return err
+		}
+	case "refresh_ahead":
+		if len(args) == 0 || len(args) > 3 {
+			return errors.New("Invalid usage of refresh_ahead in cache config, use refresh_ahead <percent|xfetch> [min_hits] [beta]")
+		}
+		if err := parseRefreshAhead(args, config); err != nil {
+			return err
+		}
+	case "warm":
+		if len(args) != 2 || (args[0] != "file" && args[0] != "sitemap") {
+			return errors.New("Invalid usage of warm in cache config, use warm <file|sitemap> <location>")
+		}
+		config.WarmSources = append(config.WarmSources, WarmSource{
+			Sitemap:  args[0] == "sitemap",
+			Location: args[1],
+		})
+	case "warm_concurrency":
+		if len(args) != 1 {
+			return errors.New("Invalid usage of warm_concurrency in cache config.")
+		}
+		val, err := strconv.Atoi(args[0])
+		if err != nil || val <= 0 {
+			return errors.New("Invalid value of warm_concurrency")
+		}
+		config.WarmConcurrency = val
+	case "warm_endpoint":
+		if len(args) == 0 || !strings.HasPrefix(args[0], "/") {
+			return errors.New("Invalid usage of warm_endpoint in cache config, use warm_endpoint <path> [ip ranges...]")
+		}
+		config.WarmEndpoint = args[0]
+		ranges := args[1:]
+		if len(ranges) == 0 {
+			ranges = DEFAULT_WARM_ALLOWED
+		}
+		config.WarmAllowed = &IPCacheRule{}
+		for _, value := range ranges {
+			network, err := ParseNetwork(value)
+			if err != nil {
+				return errors.New("Invalid ip range " + value + " in warm_endpoint")
+			}
+			config.WarmAllowed.Networks = append(config.WarmAllowed.Networks, network)
+		}
+	case "log":
+		if len(args) == 0 || len(args) > 2 {
+			return errors.New("Invalid usage of log in cache config, use log <debug|info|warning|error> [file]")
+		}
+		level, ok := ParseLogLevel(args[0])
+		if !ok {
+			return errors.New("Unknown log level " + args[0])
+		}
+		config.LogLevel = level
+		if len(args) == 2 {
+			config.LogFile = args[1]
+		}
+	case "targeted_cache_control":
+		if len(args) == 0 {
+			return errors.New("Invalid usage of targeted_cache_control in cache config.")
+		}
+		for _, name := range args {
+			if !strings.HasSuffix(strings.ToLower(name), "-cache-control") {
+				name += "-Cache-Control"
+			}
+			config.TargetedHeaders = append(config.TargetedHeaders, http.CanonicalHeaderKey(name))
+		}
+	case "harden":
+		config.Harden = true
+		config.UnkeyedHeaders = DEFAULT_UNKEYED_HEADERS
+		if len(args) > 0 && (args[0] == "strip" || args[0] == "bypass") {
+			config.StripUnkeyedHeaders = args[0] == "strip"
+			args = args[1:]
+		}
+		if len(args) > 0 {
+			config.UnkeyedHeaders = []string{}
+			for _, header := range args {
+				config.UnkeyedHeaders = append(config.UnkeyedHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+	case "storage":
+		storage, err := parseStorage(args)
+		if err != nil {
+			return err
+		}
+		config.Storage = storage
+		config.shareThrough(storage)
+	case "zone":
+		zone, err := parseZone(args)
+		if err != nil {
+			return err
+		}
+		config.Zone = zone
+		config.shareThrough(zone.Storage)
+	case "default_max_age":
+		if len(args) != 1 {
+			return errors.New("Invalid usage of default_max_age in cache config.")
+		} else {
+			val, err := strconv.Atoi(args[0])
+			if err != nil || val < 0 {
+				return errors.New("Invalid value of default_max_age")
+			}
+			config.DefaultMaxAge = time.Duration(val) * time.Second
+		}
+	case "status_header":
+		if len(args) != 1 {
+			return errors.New("Invalid usage of status_header in cache config.")
+		} else {
+			config.StatusHeader = args[0]
+		}
+	case "compress":
+		config.Compress = true
+		if len(args) == 0 {
+			config.CompressTypes = DEFAULT_COMPRESS_TYPES
+		} else {
+			config.CompressTypes = args
+		}
+	case "vary_normalize":
+		if len(args) == 0 {
+			return errors.New("Invalid usage of vary_normalize in cache config.")
+		}
+		normalizer, err := parseVaryNormalizer(args)
+		if err != nil {
+			return err
+		}
+		if config.VaryNormalizers == nil {
+			config.VaryNormalizers = map[string]VaryNormalizer{}
+		}
+		config.VaryNormalizers[http.CanonicalHeaderKey(args[0])] = normalizer
+	case "ttl_by_status":
+		if config.StatusTTLs == nil {
+			config.StatusTTLs = map[int]time.Duration{}
+		}
+		if err := parseStatusTTLs(parameter, args, config.StatusTTLs); err != nil {
+			return err
+		}
+	case "cache_errors":
+		if config.ErrorTTLs == nil {
+			config.ErrorTTLs = map[int]time.Duration{}
+		}
+		if len(args) == 0 {
+			for code, ttl := range DEFAULT_ERROR_TTLS {
+				config.ErrorTTLs[code] = ttl
+			}
+		} else if err := parseStatusTTLs(parameter, args, config.ErrorTTLs); err != nil {
+			return err
+		}
+	case "max_variants":
+		if len(args) != 1 {
+			return errors.New("Invalid usage of max_variants in cache config.")
+		}
+		val, err := strconv.Atoi(args[0])
+		if err != nil || val < 0 {
+			return errors.New("Invalid value of max_variants")
+		}
+		config.MaxVariants = val
+	default:
+		return errors.New("Unknown cache parameter: " + parameter)
+	}
+	return nil
+}
+
+/**
+ * Checks the directives that depend on others once all of them are applied
+ */
+func (config *Config) Validate() error {
+	if config.WarmEndpoint != "" && len(config.WarmSources) == 0 {
+		return errors.New("warm_endpoint requires at least one warm source.")
+	}
+	if config.Zone != nil {
+		return config.Zone.configure(config)
+	}
+	return nil
+}
+
+func parseVaryNormalizer(args []string) (VaryNormalizer, error) {
+	switch http.CanonicalHeaderKey(args[0]) {
+	case "Accept-Encoding":
+		if len(args) == 1 {
+			return &AcceptEncodingNormalizer{Supported: DEFAULT_SUPPORTED_ENCODINGS}, nil
+		}
+		return &AcceptEncodingNormalizer{Supported: args[1:]}, nil
+	case "Accept-Language":
+		if len(args) == 1 {
+			return nil, errors.New("Specify the locales to normalize Accept-Language")
+		}
+		return &AcceptLanguageNormalizer{Locales: args[1:]}, nil
+	case "User-Agent":
+		if len(args) != 1 {
+			return nil, errors.New("Invalid number of arguments to normalize User-Agent")
+		}
+		return &DeviceClassNormalizer{}, nil
+	default:
+		return nil, fmt.Errorf("There is no normalizer for header %s", args[0])
+	}
+}
+
+/**
+ * Parses heuristic_freshness <percent|off> [max_age] [warning]
+ */
+func parseHeuristic(args []string, config *Config) error {
+	if args[0] == "off" {
+		if len(args) > 1 {
+			return errors.New("heuristic_freshness off does not have more arguments.")
+		}
+		config.HeuristicFactor = 0
+		return nil
+	}
+
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return errors.New("Invalid percent " + args[0] + " in heuristic_freshness")
+	}
+	config.HeuristicFactor = percent / 100
+
+	for _, arg := range args[1:] {
+		if arg == "warning" {
+			config.HeuristicWarning = true
+			continue
+		}
+		maxAge, err := ParseDuration(arg)
+		if err != nil || maxAge <= 0 {
+			return errors.New("Invalid max age " + arg + " in heuristic_freshness")
+		}
+		config.HeuristicMaxAge = maxAge
+	}
+	return nil
+}
+
+/**
+ * Parses lock_timeout <duration> [origin|stale] [stale_ttl]
+ */
+func parseLockTimeout(args []string, config *Config) error {
+	timeout, err := ParseDuration(args[0])
+	if err != nil || timeout <= 0 {
+		return errors.New("Invalid duration " + args[0] + " in lock_timeout")
+	}
+	config.LockTimeout = timeout
+
+	if len(args) == 1 || args[1] == "origin" {
+		if len(args) > 2 {
+			return errors.New("stale_ttl of lock_timeout can only be used with stale")
+		}
+		return nil
+	}
+	if args[1] != "stale" {
+		return errors.New("Unknown fallback " + args[1] + " in lock_timeout, use origin or stale")
+	}
+
+	config.StaleTTL = DEFAULT_STALE_TTL
+	if len(args) > 2 {
+		staleTTL, err := ParseDuration(args[2])
+		if err != nil || staleTTL <= 0 {
+			return errors.New("Invalid stale_ttl " + args[2] + " in lock_timeout")
+		}
+		config.StaleTTL = staleTTL
+	}
+	return nil
+}
+
+/**
+ * Parses refresh_ahead <percent|xfetch> [min_hits] [beta]
+ */
+func parseRefreshAhead(args []string, config *Config) error {
+	config.RefreshMinHits = DEFAULT_REFRESH_MIN_HITS
+	if args[0] == "xfetch" {
+		config.RefreshBeta = DEFAULT_XFETCH_BETA
+	} else {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(args[0], "%"), 64)
+		if err != nil || percent <= 0 || percent >= 100 {
+			return errors.New("Invalid percent " + args[0] + " in refresh_ahead")
+		}
+		config.RefreshFactor = percent / 100
+	}
+
+	if len(args) > 1 {
+		hits, err := strconv.Atoi(args[1])
+		if err != nil || hits < 0 {
+			return errors.New("Invalid min hits " + args[1] + " in refresh_ahead")
+		}
+		config.RefreshMinHits = hits
+	}
+
+	if len(args) > 2 {
+		beta, err := strconv.ParseFloat(args[2], 64)
+		if err != nil || beta <= 0 || config.RefreshBeta == 0 {
+			return errors.New("Invalid beta " + args[2] + " in refresh_ahead, it is only used by xfetch")
+		}
+		config.RefreshBeta = beta
+	}
+	return nil
+}
+
+/**
+ * Parses pairs of <status> <ttl> of the given directive into ttls
+ */
+func parseStatusTTLs(directive string, args []string, ttls map[int]time.Duration) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return errors.New("Invalid usage of " + directive + " in cache config, specify pairs of <status> <ttl>")
+	}
+	for i := 0; i < len(args); i += 2 {
+		code, err := strconv.Atoi(args[i])
+		if err != nil || code < 100 || code > 599 {
+			return errors.New("Invalid status code " + args[i] + " in " + directive)
+		}
+		ttl, err := ParseDuration(args[i+1])
+		if err != nil || ttl <= 0 {
+			return errors.New("Invalid ttl " + args[i+1] + " in " + directive)
+		}
+		ttls[code] = ttl
+	}
+	return nil
+}
+
+/**
+ * Parses the storage of the storage and zone directives, like mmap /tmp/caddy-cache
+ */
+func parseStorage(args []string) (Storage, error) {
+	if len(args) == 0 {
+		return nil, errors.New("Invalid storage directive, specify: memory, mmap, tiered, kv, redis or s3")
+	}
+	switch args[0] {
+	case "mmap":
+		if runtime.GOOS == "windows" {
+			return nil, errors.New("MMap storage is not available in Windows")
+		}
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("Invalid mmap configs, specify: mmap <path> [max-open-files]")
+		}
+		storage := NewMMapStorage(args[1])
+		if len(args) == 3 {
+			max, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil || max < 0 {
+				return nil, errors.New("Invalid max open files of mmap storage " + args[2])
+			}
+			storage.MaxOpenFiles = max
+		}
+		return storage, nil
+	case "memory":
+		return NewMemoryStorage(), nil
+	case "tiered":
+		if runtime.GOOS == "windows" {
+			return nil, errors.New("Tiered storage is not available in Windows")
+		}
+		if len(args) != 3 {
+			return nil, errors.New("Invalid tiered configs, specify: tiered <memory-budget> <path>")
+		}
+		budget, err := ParseSize(args[1])
+		if err != nil || budget <= 0 {
+			return nil, errors.New("Invalid memory budget of tiered storage " + args[1])
+		}
+		return NewTieredStorage(budget, args[2]), nil
+	case "kv":
+		if len(args) != 2 {
+			return nil, errors.New("Invalid kv configs, specify: kv <file>")
+		}
+		return NewKVStorage(args[1]), nil
+	case "redis":
+		if len(args) != 2 && len(args) != 3 {
+			return nil, errors.New("Invalid redis configs, specify: redis <address> [password]")
+		}
+		password := ""
+		if len(args) == 3 {
+			password = args[2]
+		}
+		return NewRESPStorage(args[1], password), nil
+	case "s3":
+		if len(args) < 3 || len(args) > 5 {
+			return nil, errors.New("Invalid s3 configs, specify: s3 <endpoint> <bucket> [local-path] [local-budget]")
+		}
+		localPath := path.Join(os.TempDir(), "caddy-cache-s3")
+		if len(args) > 3 {
+			localPath = args[3]
+		}
+		storage := NewS3Storage(args[1], args[2], localPath)
+		if len(args) > 4 {
+			budget, err := ParseSize(args[4])
+			if err != nil || budget <= 0 {
+				return nil, errors.New("Invalid local budget of s3 storage " + args[4])
+			}
+			storage.LocalBudget = budget
+		}
+		return storage, nil
+	default:
+		return nil, errors.New("Unknown storage engine " + args[0])
+	}
+}
+
+/**
+ * Parses durations like 30 (seconds), 10m, 1h30m or 7d
+ */
+func ParseDuration(value string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+/**
+ * Parses sizes like 1024, 512k, 64MB or 2g into bytes
+ */
+func ParseSize(value string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1 << 10}, {"m", 1 << 20}, {"g", 1 << 30},
+		{"b", 1},
+	}
+
+	lower := strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(lower, unit.suffix) {
+			lower = strings.TrimSuffix(lower, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(lower, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * multiplier, nil
+}
+
+// Names of the conditions that can be used in match
+// Many conditions in the same match must all be true
+var matchConditions = map[string]bool{
+	"path":           true,
+	"path_regex":     true,
+	"header":         true,
+	"method":         true,
+	"status":         true,
+	"query":          true,
+	"request_header": true,
+	"cookie":         true,
+	"content_type":   true,
+	"ip":             true,
+	"not":            true,
+	"ttl":            true,
+}
+
+func parseMatchRules(args []string) (CacheRule, error) {
+	rules := []CacheRule{}
+	var ttlRule *TTLCacheRule
+	for len(args) > 0 {
+		if args[0] == "ttl" {
+			rule, rest, err := parseTTL(args)
+			if err != nil {
+				return nil, err
+			}
+			ttlRule = rule
+			args = rest
+			continue
+		}
+
+		rule, rest, err := parseMatchRule(args)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+		args = rest
+	}
+
+	var rule CacheRule
+	switch len(rules) {
+	case 0:
+		return nil, errors.New("Specify at least one condition in match of cache config.")
+	case 1:
+		rule = rules[0]
+	default:
+		rule = &AllCacheRule{Rules: rules}
+	}
+
+	if ttlRule != nil {
+		ttlRule.Rule = rule
+		return ttlRule, nil
+	}
+	return rule, nil
+}
+
+// Returns the condition of the rule that needs the response, empty if there is none
+func responseCondition(rule CacheRule) string {
+	switch rule := rule.(type) {
+	case *HeaderCacheRule:
+		return "header"
+	case *StatusCacheRule:
+		return "status"
+	case *ContentTypeCacheRule:
+		return "content_type"
+	case *TTLCacheRule:
+		return "ttl"
+	case *NotCacheRule:
+		return responseCondition(rule.Rule)
+	case *AllCacheRule:
+		for _, rule := range rule.Rules {
+			if condition := responseCondition(rule); condition != "" {
+				return condition
+			}
+		}
+	}
+	return ""
+}
+
+/**
+ * Parses the conditions of bypass, which are the same of match
+ * except the ones that check the response
+ */
+func parseBypassRules(args []string) (CacheRule, error) {
+	rule, err := parseMatchRules(args)
+	if err != nil {
+		return nil, err
+	}
+	if condition := responseCondition(rule); condition != "" {
+		return nil, errors.New("Condition " + condition + " can't be used in bypass because it checks the response.")
+	}
+	return rule, nil
+}
+
+/**
+ * Parses ttl <duration> [override] at the beginning of args
+ */
+func parseTTL(args []string) (*TTLCacheRule, []string, error) {
+	if len(args) < 2 {
+		return nil, nil, errors.New("Missing duration in ttl of match in cache config.")
+	}
+	ttl, err := ParseDuration(args[1])
+	if err != nil || ttl <= 0 {
+		return nil, nil, errors.New("Invalid ttl " + args[1] + " in match of cache config.")
+	}
+
+	rule := &TTLCacheRule{TTL: ttl}
+	rest := args[2:]
+	if len(rest) > 0 && rest[0] == "override" {
+		rule.Override = true
+		rest = rest[1:]
+	}
+	return rule, rest, nil
+}
+
+// Arguments that always belong to the condition, like the name and first value of header
+var conditionArgs = map[string]int{
+	"path":           1,
+	"path_regex":     1,
+	"header":         2,
+	"query":          1,
+	"request_header": 1,
+	"cookie":         1,
+}
+
+/**
+ * Parses the condition at the beginning of args
+ * Its arguments are the ones that always belong to it and the following values until the next condition,
+ * so names and values equal to a condition are not a new one, like match query status 1
+ * Returns the rule and the remaining args
+ */
+func parseMatchRule(args []string) (CacheRule, []string, error) {
+	condition := args[0]
+	params := args[1:]
+	for i := conditionArgs[condition]; i < len(params); i++ {
+		if matchConditions[params[i]] {
+			params = params[:i]
+			break
+		}
+	}
+	rest := args[1+len(params):]
+
+	switch condition {
+	case "header":
+		if len(params) < 2 {
+			return nil, nil, errors.New("Invalid number of arguments in header condition of match in cache config.")
+		}
+		return &HeaderCacheRule{
+			Header: params[0],
+			Value:  params[1:],
+		}, rest, nil
+	case "path":
+		if len(params) != 1 {
+			return nil, nil, errors.New("Invalid number of arguments in path condition of match in cache config.")
+		}
+		return &PathCacheRule{
+			Path: params[0],
+		}, rest, nil
+	case "path_regex":
+		if len(params) != 1 {
+			return nil, nil, errors.New("Invalid number of arguments in path_regex condition of match in cache config.")
+		}
+		regex, err := regexp.Compile(params[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid regex %s in path_regex condition of match: %s", params[0], err)
+		}
+		return &PathRegexCacheRule{Regex: regex}, rest, nil
+	case "method":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in method condition of match in cache config.")
+		}
+		return &MethodCacheRule{Methods: params}, rest, nil
+	case "status":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in status condition of match in cache config.")
+		}
+		codes := []int{}
+		for _, param := range params {
+			code, err := strconv.Atoi(param)
+			if err != nil || code < 100 || code > 599 {
+				return nil, nil, errors.New("Invalid status code " + param + " in status condition of match")
+			}
+			codes = append(codes, code)
+		}
+		return &StatusCacheRule{Codes: codes}, rest, nil
+	case "query":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in query condition of match in cache config.")
+		}
+		return &QueryCacheRule{Param: params[0], Value: params[1:]}, rest, nil
+	case "request_header":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in request_header condition of match in cache config.")
+		}
+		return &RequestHeaderCacheRule{Header: params[0], Value: params[1:]}, rest, nil
+	case "cookie":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in cookie condition of match in cache config.")
+		}
+		if _, err := path.Match(params[0], ""); err != nil {
+			return nil, nil, errors.New("Invalid cookie pattern " + params[0])
+		}
+		return &CookieCacheRule{Name: params[0], Value: params[1:]}, rest, nil
+	case "content_type":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in content_type condition of match in cache config.")
+		}
+		return &ContentTypeCacheRule{Types: params}, rest, nil
+	case "ip":
+		if len(params) == 0 {
+			return nil, nil, errors.New("Invalid number of arguments in ip condition of match in cache config.")
+		}
+		networks := []*net.IPNet{}
+		for _, param := range params {
+			network, err := ParseNetwork(param)
+			if err != nil {
+				return nil, nil, errors.New("Invalid ip range " + param + " in ip condition of match")
+			}
+			networks = append(networks, network)
+		}
+		return &IPCacheRule{Networks: networks}, rest, nil
+	case "not":
+		if len(args) < 2 || !matchConditions[args[1]] {
+			return nil, nil, errors.New("not must be followed by a condition in match of cache config.")
+		}
+		rule, rest, err := parseMatchRule(args[1:])
+		if err != nil {
+			return nil, nil, err
+		}
+		return &NotCacheRule{Rule: rule}, rest, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown condition %s on match parameter of cache directive", condition)
+	}
+}
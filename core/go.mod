@@ -0,0 +1,14 @@
+module github.com/nicolasazrak/caddy-cache/core
+
+go 1.20
+
+require (
+	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
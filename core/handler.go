@@ -0,0 +1,562 @@
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Age of the hits that get Warning: 113 when their freshness is heuristic
+const HEURISTIC_WARNING_AGE = time.Duration(24) * time.Hour
+
+type CacheHandler struct {
+	Config *Config
+	Cache  *Cache
+	Next   Upstream
+	Warmer *Warmer
+
+	// Called with the key and status of every request, like hit or miss, before the response is sent
+	OnDecision func(w http.ResponseWriter, r *http.Request, key string, status string)
+
+	// Only the first handler wrapped by Middleware warms the cache
+	warmOnce *sync.Once
+
+	// Set up by Setup and released by Close
+	zoneAcquired bool
+}
+
+/**
+ * Creates the handler of the config, Next must be set before it serves requests
+ * and Start must be called to set up its storage.
+ */
+func NewCacheHandler(config *Config) (*CacheHandler, error) {
+	if config.Logger == nil {
+		logger, err := NewLogger(config.LogLevel, config.LogFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Logger = logger
+	}
+
+	handler := &CacheHandler{Config: config, warmOnce: &sync.Once{}}
+	if config.Zone != nil {
+		if err := config.Zone.configure(config); err != nil {
+			return nil, err
+		}
+		handler.Cache = config.Zone.Cache
+	} else {
+		handler.Cache = NewCache(config.Storage)
+		handler.Cache.MaxVariants = config.MaxVariants
+		handler.Cache.LockTimeout = config.LockTimeout
+		handler.Cache.StaleTTL = config.StaleTTL
+	}
+	if len(config.WarmSources) > 0 {
+		handler.Warmer = NewWarmer(handler, config.WarmHost)
+	}
+	return handler, nil
+}
+
+/**
+ * Sets up the storage of the cache, or of its zone if it was not set up by other site.
+ * The zone is used from here, so a config that fails to parse doesn't keep it open.
+ */
+func (handler *CacheHandler) Setup() error {
+	if handler.Config.Zone != nil {
+		if !handler.zoneAcquired {
+			handler.Config.Zone.acquire()
+			handler.zoneAcquired = true
+		}
+		return handler.Config.Zone.Setup()
+	}
+	return handler.Cache.Setup()
+}
+
+// Sets up the storage and starts warming the cache in background
+func (handler *CacheHandler) Start() error {
+	if err := handler.Setup(); err != nil {
+		return err
+	}
+	handler.Config.Logger.Info("cache initialized", nil)
+	if handler.Warmer != nil {
+		go handler.Warmer.Warm()
+	}
+	return nil
+}
+
+// Closes the storage of the cache, or releases its zone, and the log file, the handler is not used after it
+func (handler *CacheHandler) Close() error {
+	var err error
+	if handler.Config.Zone == nil {
+		err = handler.Cache.Close()
+	} else if handler.zoneAcquired {
+		handler.zoneAcquired = false
+		err = handler.Config.Zone.release()
+	}
+	if logErr := handler.Config.Logger.Close(); err == nil {
+		err = logErr
+	}
+	return err
+}
+
+// Sends the stored response with its body, which was already opened
+func respond(response *Response, body io.Reader, w http.ResponseWriter, r *http.Request) {
+	for k, values := range response.HeaderMap {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	if body != nil && response.Encoding == GZIP_ENCODING {
+		respondCompressed(response, body, w, r)
+	} else {
+		w.WriteHeader(response.Code)
+		if body != nil {
+			io.Copy(w, body)
+		}
+	}
+	writeTrailers(response.Trailer, w)
+}
+
+/**
+ * Sends the trailers after the body. The ones declared in the Trailer header
+ * are set by their name, the others with http.TrailerPrefix.
+ * Declared names without trailer values were already sent as headers, they are removed
+ * so they are not sent again as trailers.
+ */
+func writeTrailers(trailer http.Header, w http.ResponseWriter) {
+	declared := map[string]bool{}
+	for _, names := range w.Header()["Trailer"] {
+		for _, name := range strings.Split(names, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			declared[name] = true
+			if _, ok := trailer[name]; !ok {
+				w.Header().Del(name)
+			}
+		}
+	}
+
+	for name, values := range trailer {
+		if !declared[name] {
+			name = http.TrailerPrefix + name
+		}
+		w.Header()[name] = values
+	}
+}
+
+// Creates the content of the response, accounted to the site if the cache is a zone
+func (handler *CacheHandler) newContent(r *http.Request, key string) (StorageContent, error) {
+	if handler.Config.Zone == nil {
+		return handler.Cache.NewContent(key)
+	}
+	site := handler.Config.Site
+	if site == "" {
+		site = r.Host
+	}
+	return handler.Config.Zone.NewContent(site, key)
+}
+
+/**
+ * Builds the cache key
+ */
+func getKey(r *http.Request) string {
+	key := r.Method + " " + r.Host + r.URL.Path
+
+	q := r.URL.Query().Encode()
+	if len(q) > 0 {
+		key += "?" + q
+	}
+
+	return key
+}
+
+/**
+ * Returns a function that given the Vary of a previous response returns the variant of the request
+ * The variant is a hash of the request headers listed in Vary.
+ * Headers with a normalizer are hashed by their normalized value.
+ */
+func requestVariant(r *http.Request, normalizers map[string]VaryNormalizer) VariantFunc {
+	return func(vary string) string {
+		if vary == "" {
+			return ""
+		}
+
+		hash := sha256.New()
+		for _, header := range strings.Split(vary, ",") {
+			values := r.Header[header]
+			if normalized, isNormalized := normalizeVaryHeader(header, values, normalizers); isNormalized {
+				values = []string{normalized}
+			}
+
+			// Lengths are written so different headers can't produce the same hash
+			fmt.Fprintf(hash, "%d:%s%d", len(header), header, len(values))
+			for _, value := range values {
+				fmt.Fprintf(hash, ":%d:%s", len(value), value)
+			}
+		}
+		return hex.EncodeToString(hash.Sum(nil))
+	}
+}
+
+func (h *CacheHandler) AddStatusHeaderIfConfigured(w http.ResponseWriter, status string) {
+	if h.Config.StatusHeader != "" {
+		w.Header().Set(h.Config.StatusHeader, status)
+	}
+}
+
+/**
+* This prevents storing status header in cache.
+* Otherwise the status cache will be sent twice for cached results
+ */
+func (h *CacheHandler) RemoveStatusHeaderIfConfigured(headers http.Header) http.Header {
+	if h.Config.StatusHeader != "" {
+		delete(headers, h.Config.StatusHeader)
+	}
+	return headers
+}
+
+/**
+ * Returned by HandleCachedResponse when the stored body can't be read.
+ * The response can be fetched again unless part of it was already sent.
+ */
+type unreadableContentError struct {
+	err  error
+	sent bool
+}
+
+func (e *unreadableContentError) Error() string {
+	return "failed reading stored content: " + e.err.Error()
+}
+
+func (handler *CacheHandler) HandleCachedResponse(w http.ResponseWriter, r *http.Request, previous *HttpCacheEntry) (int, error) {
+	body, err := openBody(previous.Response)
+	if err != nil {
+		return 0, &unreadableContentError{err: err}
+	}
+	var reader io.ReadCloser
+	var decoded *gunzipBody
+	if body != nil {
+		reader = body
+		if previous.Response.Encoding == GZIP_ENCODING && !acceptsEncoding(r, GZIP_ENCODING) {
+			if decoded, err = decompressBody(body); err != nil {
+				body.Close()
+				return 0, &unreadableContentError{err: err}
+			}
+			reader = decoded
+		}
+		defer reader.Close()
+	}
+
+	// Values are stale when they were found after waiting LockTimeout for the request fetching them
+	if previous.Expiration.After(time.Now().UTC()) {
+		handler.AddStatusHeaderIfConfigured(w, "hit")
+	} else {
+		handler.AddStatusHeaderIfConfigured(w, "stale")
+		w.Header().Add("Warning", cacheobject.WarningResponseIsStale.HeaderString("", time.Now().UTC()))
+	}
+
+	if previous.Response.Unwritten {
+		// Return the same code and error so caddy writes the same error page
+		return previous.Response.Code, previous.Response.Error
+	}
+
+	// RFC 7234 section 4.2.2, hits older than a day with heuristic freshness should be warned
+	if previous.isHeuristic && handler.Config.HeuristicWarning && time.Since(previous.Stored) > HEURISTIC_WARNING_AGE {
+		w.Header().Add("Warning", cacheobject.WarningHeuristicExpiration.HeaderString("", time.Now().UTC()))
+	}
+
+	respond(previous.Response, reader, w, r)
+	if decoded != nil && decoded.err != nil {
+		return previous.Response.Code, &unreadableContentError{err: decoded.err, sent: true}
+	}
+	return previous.Response.Code, nil
+}
+
+func (handler *CacheHandler) HandleNonCachedResponse(w http.ResponseWriter, r *http.Request) (*HttpCacheEntry, error) {
+	key := getKey(r)
+	rec := NewStreamedRecorder(w)
+	rec.HiddenHeaders = targetedHeaders(handler.Config)
+
+	// Build the cache entry
+	entry := &HttpCacheEntry{
+		isPublic:   false, // Default values for private responses
+		Expiration: time.Now().UTC().Add(time.Duration(1) * time.Hour),
+		Stored:     time.Now().UTC(),
+		Request:    &Request{HeaderMap: r.Header},
+		Response:   nil,
+	}
+	encoding := ""
+
+	// Create a callback on response recorder
+	// So as soon as the first byte is sent, check the headers
+	// If the response is cacheable, a new entry will be created
+	// And the response will be saved. In case the mmap storage is
+	// being used, the response will be saved to a file
+	rec.SetFirstWriteListener(func(Code int, Header http.Header) error {
+		status, err := getCacheableStatus(r, Code, Header, handler.Config)
+		if err != nil {
+			// getCacheableStatus may return an error when it fails to parse
+			// Some header, but it is not be a problem here.
+			// Just ignore it and don't cache that response.
+			entry.reason = err.Error()
+			return nil
+		}
+
+		// If it's not cacheable do nothing
+		if !status.IsCacheable {
+			entry.reason = status.Reason
+			return nil
+		}
+
+		// Update the expiration value
+		entry.Expiration = status.Expiration
+		entry.isHeuristic = status.Heuristic
+		entry.isPublic = true
+
+		// Create the new entry, potentially creating a new file in disk
+		// If it fails, like when there are too many open files, the response is only sent to the client
+		writer, err := handler.newContent(r, key)
+		if err != nil {
+			if err != ErrZoneFull {
+				handler.Config.Logger.Error("failed creating content", LogFields{"key": key, "error": err})
+			}
+			entry.isPublic = false
+			entry.reason = err.Error()
+			return nil
+		}
+
+		// Compressible responses are stored compressed so hits don't compress them again
+		if handler.shouldCompress(Code, Header) {
+			writer = NewGzipContent(writer)
+			encoding = GZIP_ENCODING
+		}
+
+		// Update the body writer, next Writes will go to the created writer
+		rec.UpdateBodyWriter(writer)
+		return nil
+	})
+
+	// Send the status header and server the request from upstream
+	handler.AddStatusHeaderIfConfigured(w, "miss")
+	start := time.Now()
+	code, err := handler.Next.ServeHTTP(rec.Wrap(), r)
+	entry.fetchDuration = time.Since(start)
+	if rec.Hijacked() {
+		return handler.hijackedEntry(entry, rec, code), nil
+	}
+	if !rec.wroteHeader && code >= 400 {
+		return handler.unwrittenErrorEntry(r, entry, code, err), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, Body := rec.Result()
+	entry.Response = &Response{
+		HeaderMap: handler.RemoveStatusHeaderIfConfigured(result.Header),
+		Code:      result.StatusCode,
+		Trailer:   result.Trailer,
+	}
+
+	// This is an special case because if it is a head request it will never enter the WriteListener
+	if r.Method == "HEAD" {
+		status, err := getCacheableStatus(r, result.StatusCode, result.Header, handler.Config)
+		if err != nil {
+			return nil, err
+		}
+		if status.IsCacheable {
+			entry.Expiration = status.Expiration
+			entry.isHeuristic = status.Heuristic
+			entry.isPublic = true
+		} else {
+			entry.reason = status.Reason
+		}
+	}
+
+	// Targeted headers are only for this cache, they are not sent on hits
+	for _, header := range targetedHeaders(handler.Config) {
+		delete(entry.Response.HeaderMap, header)
+	}
+
+	// The cookie was sent to this client but it must not be sent on hits
+	if entry.isPublic && handler.Config.StripSetCookie {
+		delete(entry.Response.HeaderMap, "Set-Cookie")
+	}
+
+	// If the body was recorded, close the body and update the entry
+	if Body != nil {
+		entry.Response.Encoding = encoding
+		entry.Response.BodySize = rec.bodySize
+		// Storages like KVStorage keep the response with the body, so it is complete before closing it
+		if content, ok := unwrapContent(Body).(PersistentContent); ok && entry.isPublic {
+			content.SetEntry(requestVariant(r, handler.Config.VaryNormalizers)(entry.Vary()), entry)
+		}
+
+		if err := Body.Close(); err != nil {
+			// The client got the whole response, but it is not stored
+			handler.Config.Logger.Error("failed storing content", LogFields{"key": key, "error": err})
+			Body.Clear()
+			entry.isPublic = false
+			entry.reason = "failed storing content: " + err.Error()
+			entry.Response.Encoding = ""
+			entry.Response.BodySize = 0
+		} else {
+			entry.Response.Body = Body
+		}
+	}
+
+	return entry, nil
+}
+
+/**
+ * Builds the entry of a response whose connection was hijacked, like a websocket.
+ * They are never cached, the content written before the hijack is discarded.
+ */
+func (handler *CacheHandler) hijackedEntry(entry *HttpCacheEntry, rec *StreamedRecorder, code int) *HttpCacheEntry {
+	if rec.Body != nil {
+		rec.Body.Close()
+		rec.Body.Clear()
+	}
+
+	entry.isPublic = false
+	entry.reason = "hijacked"
+	entry.Response = &Response{Code: code, HeaderMap: http.Header{}}
+	return entry
+}
+
+/**
+ * Builds the entry of an error that upstream returned without writing it,
+ * like the 404 of a missing static file or the 502 of an unreachable backend.
+ * It is only cached if the status code is in cache_errors.
+ */
+func (handler *CacheHandler) unwrittenErrorEntry(r *http.Request, entry *HttpCacheEntry, code int, upstreamErr error) *HttpCacheEntry {
+	entry.Response = &Response{
+		Code:      code,
+		HeaderMap: http.Header{},
+		Unwritten: true,
+		Error:     upstreamErr,
+	}
+
+	if _, ok := handler.Config.ErrorTTLs[code]; !ok {
+		entry.reason = "status not in cache_errors"
+		return entry
+	}
+
+	status, err := getCacheableStatus(r, code, entry.Response.HeaderMap, handler.Config)
+	if err == nil && status.IsCacheable {
+		entry.Expiration = status.Expiration
+		entry.isPublic = true
+	} else {
+		entry.reason = status.Reason
+	}
+	return entry
+}
+
+func (handler CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	if handled, code, err := handler.serveWarmEndpoint(w, r); handled {
+		return code, err
+	}
+
+	if skipReason := handler.skipReason(r); skipReason != "" {
+		handler.AddStatusHeaderIfConfigured(w, "skip")
+		handler.logDecision(w, r, getKey(r), "skip", nil, skipReason)
+
+		// Nothing is recorded, but targeted headers are only for this cache
+		rec := NewStreamedRecorder(w)
+		rec.HiddenHeaders = targetedHeaders(handler.Config)
+		return handler.Next.ServeHTTP(rec.Wrap(), r)
+	}
+
+	if len(handler.Config.VaryNormalizers) > 0 {
+		normalizeRequest(r, handler.Config.VaryNormalizers)
+	}
+
+	key := getKey(r)
+	returnedStatusCode := http.StatusInternalServerError // If this is not updated means there was an error
+	var returnedErr error
+	variant := requestVariant(r, handler.Config.VaryNormalizers)
+	err := handler.Cache.GetOrSetContext(r.Context(), key, variant, func(previous *HttpCacheEntry) (*HttpCacheEntry, error) {
+		fetch := func() (*HttpCacheEntry, error) {
+			newEntry, err := handler.HandleNonCachedResponse(w, r)
+			if err != nil {
+				handler.logDecision(w, r, key, "miss", nil, err.Error())
+				return nil, err
+			}
+			handler.logDecision(w, r, key, "miss", newEntry, "")
+			if handler.Config.Index != nil {
+				handler.publishShared(r, key, newEntry)
+			}
+			returnedStatusCode = newEntry.Response.Code
+			returnedErr = newEntry.Response.Error
+			return newEntry, nil
+		}
+
+		// Other instances may have stored it
+		if previous == nil && handler.Config.Index != nil {
+			if shared := handler.lookupShared(r, key); shared != nil {
+				returnedStatusCode, returnedErr = handler.HandleCachedResponse(w, r, shared)
+				if unreadable, ok := returnedErr.(*unreadableContentError); ok {
+					handler.Config.Logger.Warning("failed reading shared content", LogFields{"key": key, "error": unreadable.err})
+					handler.removeShared(r, key, shared)
+					if unreadable.sent {
+						returnedErr = nil
+						return nil, nil
+					}
+					return fetch()
+				}
+				handler.logDecision(w, r, key, "hit", shared, "")
+				return shared, nil
+			}
+		}
+
+		if previous == nil || !previous.isPublic {
+			return fetch()
+		}
+
+		returnedStatusCode, returnedErr = handler.HandleCachedResponse(w, r, previous)
+		if unreadable, ok := returnedErr.(*unreadableContentError); ok {
+			// The broken value is dropped even if upstream fails, the new one replaces it
+			handler.Config.Logger.Warning("failed reading stored content", LogFields{"key": key, "error": unreadable.err})
+			handler.Cache.Evict(key, variant, previous)
+			if handler.Config.Index != nil {
+				handler.removeShared(r, key, previous)
+			}
+			if unreadable.sent {
+				// Only the next requests can fetch it again
+				returnedErr = nil
+				return nil, nil
+			}
+			return fetch()
+		}
+		if previous.Expiration.After(time.Now().UTC()) {
+			handler.logDecision(w, r, key, "hit", previous, "")
+		} else {
+			handler.logDecision(w, r, key, "stale", previous, "")
+		}
+		if handler.shouldRefresh(previous) {
+			go handler.refresh(refreshRequest(r), previous)
+		}
+		return nil, nil
+	})
+	if err == nil {
+		err = returnedErr
+	}
+	return returnedStatusCode, err
+}
+
+// Returns why the request must skip the cache, empty if it must not
+func (handler *CacheHandler) skipReason(r *http.Request) string {
+	switch {
+	case !shouldUseCache(r):
+		return "request not cacheable"
+	case shouldBypass(r, handler.Config):
+		return "bypass"
+	case handler.Config.Harden && handler.hasUnkeyedHeaders(r):
+		return "unkeyed header"
+	}
+	return ""
+}
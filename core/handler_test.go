@@ -0,0 +1,1463 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+type TestHandler struct {
+	maxConcurrencyLevel     int
+	currentConcurrencyLevel int
+	StatsLock               *sync.Mutex
+	Delay                   time.Duration
+	timesCalled             int
+	ResponseBody            []byte
+	ResponseCode            int
+	ResponseError           error
+	ResponseHeaders         http.Header
+}
+
+func (h *TestHandler) TimesCalled() int {
+	h.StatsLock.Lock()
+	defer h.StatsLock.Unlock()
+	return h.timesCalled
+}
+
+func (h *TestHandler) ConcurrencyLevel() int {
+	h.StatsLock.Lock()
+	defer h.StatsLock.Unlock()
+	return h.currentConcurrencyLevel
+}
+
+func (h *TestHandler) MaxConcurrencyLevel() int {
+	h.StatsLock.Lock()
+	defer h.StatsLock.Unlock()
+	return h.maxConcurrencyLevel
+}
+
+func (h *TestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	// Update concurrency stats
+	h.StatsLock.Lock()
+	h.timesCalled++
+	h.StatsLock.Unlock()
+
+	for k, values := range h.ResponseHeaders {
+		for _, v := range values {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(h.ResponseCode)
+
+	// Update concurrency stats
+	h.StatsLock.Lock()
+	h.currentConcurrencyLevel++
+	if h.currentConcurrencyLevel > h.maxConcurrencyLevel {
+		h.maxConcurrencyLevel = h.currentConcurrencyLevel
+	}
+	h.StatsLock.Unlock()
+	defer func() {
+		h.StatsLock.Lock()
+		h.currentConcurrencyLevel--
+		h.StatsLock.Unlock()
+	}()
+
+	time.Sleep(h.Delay)
+
+	if h.ResponseBody != nil && r.Method != "HEAD" {
+		w.Write(h.ResponseBody)
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return h.ResponseCode, h.ResponseError
+}
+
+func buildHandlerWithCache(cache *Cache) (*CacheHandler, *TestHandler) {
+	backend := TestHandler{
+		ResponseBody: []byte("Hello :)"),
+		StatsLock:    new(sync.Mutex),
+		Delay:        0,
+		ResponseCode: 200,
+	}
+
+	return &CacheHandler{
+		Config: &Config{
+			CacheRules:      []CacheRule{},
+			DefaultMaxAge:   time.Duration(10) * time.Second,
+			HeuristicFactor: DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: DEFAULT_HEURISTIC_MAX_AGE,
+		},
+		Cache: cache,
+		Next:  &backend,
+	}, &backend
+}
+
+func buildBasicHandler() (*CacheHandler, *TestHandler) {
+	cache := NewCache(NewMemoryStorage())
+	cache.Setup()
+	return buildHandlerWithCache(cache)
+}
+
+func buildRequest(path string, method string, headers http.Header) *http.Request {
+	reqUrl, err := url.Parse(path)
+	if err != nil {
+		panic(fmt.Sprintf("Invalid url %s in test", path))
+	}
+	return &http.Request{
+		Method: method,
+		URL:    reqUrl,
+		Header: headers,
+	}
+}
+
+func buildGetRequest(path string) *http.Request {
+	return buildRequest(path, "GET", http.Header{})
+}
+
+func makeNRequests(handler *CacheHandler, n int, req *http.Request) []*http.Response {
+	responses := []*http.Response{}
+	for i := 0; i < n; i++ {
+		recorder := httptest.NewRecorder()
+		_, err := handler.ServeHTTP(recorder, req)
+		if err != nil {
+			panic(err)
+		}
+		responses = append(responses, recorder.Result())
+	}
+	return responses
+}
+
+type ConcurrentResult struct {
+	result *http.Response
+	err    error
+}
+
+func makeNConcurrentRequests(handler *CacheHandler, n int, req *http.Request) ([]*http.Response, error) {
+	channel := make(chan ConcurrentResult)
+	for i := 0; i < n; i++ {
+		go func(channel chan ConcurrentResult) {
+			recorder := httptest.NewRecorder()
+			_, err := handler.ServeHTTP(recorder, req)
+			if err != nil {
+				channel <- ConcurrentResult{
+					err: err,
+				}
+			}
+			channel <- ConcurrentResult{
+				result: recorder.Result(),
+			}
+		}(channel)
+	}
+
+	responses := []*http.Response{}
+	for i := 0; i < n; i++ {
+		res := <-channel
+		if res.err != nil {
+			panic(res.err)
+		}
+		responses = append(responses, res.result)
+	}
+	return responses, nil
+}
+
+/* Actual Tests */
+
+// TODO avoid code duplication, use r.Run
+
+func TestCacheByCacheControlHeader(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.timesCalled, "Backend should have been called 1 but it was called", backend.timesCalled)
+}
+
+func TestCacheByExpiresHeader(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	backend.ResponseHeaders = http.Header{
+		"Expires": []string{"Thu, 01 Dec 2820 16:00:00 GMT"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.timesCalled, "Backend should have been called 1 but it was called", backend.timesCalled)
+}
+
+func TestNoCacheByExpiredHeader(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	backend.ResponseHeaders = http.Header{
+		"Expires": []string{"Thu, 01 Dec 1994 16:00:00 GMT"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.timesCalled, "Backend should have been called 1 but it was called", backend.timesCalled)
+}
+
+func TestCacheByPath(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+
+	req := buildGetRequest("http://somehost.com/assets/1")
+
+	makeNRequests(handler, 2, req)
+	assert.Equal(t, 1, backend.timesCalled, "Backend should have been called 1 but it was called", backend.timesCalled)
+}
+
+func TestNotCacheablePath(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+
+	req := buildGetRequest("http://somehost.com/api/1")
+
+	makeNRequests(handler, 2, req)
+	assert.Equal(t, 2, backend.timesCalled, "Backend should have been called 2 but it was called", backend.timesCalled)
+}
+
+func TestNotCacheableMethod(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/assets/1", "POST", http.Header{}))
+	assert.Equal(t, 2, backend.timesCalled, "Backend should have been called 2 but it was called", backend.timesCalled)
+}
+
+func TestCacheableHead(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+	backend.ResponseBody = nil
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/assets/1", "HEAD", http.Header{}))
+	assert.Equal(t, 1, backend.timesCalled, "Backend should have been called 1 but it was called", backend.timesCalled)
+}
+
+func TestNonCacheableHead(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+	backend.ResponseBody = nil
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/", "HEAD", http.Header{}))
+	assert.Equal(t, 2, backend.timesCalled, "Backend should have been called 2 but it was called", backend.timesCalled)
+}
+
+func TestNotCacheableCacheControl(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"private"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/assets/1"))
+	assert.Equal(t, 2, backend.timesCalled, "Backend should have been called 2 but it was called", backend.timesCalled)
+}
+
+func TestAddAllHeaders(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	responseHeaders := http.Header{
+		"Content-Type": []string{"text/plain; charset=utf-8"},
+		"X-Custom-2":   []string{"bar", "baz"},
+		"X-Custom":     []string{"foo", "bar", "baz"},
+	}
+	backend.ResponseHeaders = responseHeaders
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/assets/1"))
+	assert.Equal(t, responseHeaders, responses[0].Header, "Cache didn't send same headers that backend originally sent")
+}
+
+func TestCacheByHeaders(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &HeaderCacheRule{
+		Header: "Content-Type",
+		Value:  []string{"image/png", "image/gif"},
+	})
+
+	// First requests with png images that should be cached
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"image/png"}}
+	makeNRequests(handler, 5, buildGetRequest("http://somehost.com/another_not_cached_path/png"))
+	assert.Equal(t, 1, backend.timesCalled, "Cache should have been called once, but it was called", backend.timesCalled)
+
+	// Second requests with gifs that should also be cached
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"image/gif"}}
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/another_not_cached_path/gif"))
+	assert.Equal(t, 2, backend.timesCalled, "Cache should have been called twice but is was called", backend.timesCalled)
+
+	// Third request with videos that should not be cached
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"video/mp4"}}
+	makeNRequests(handler, 10, buildGetRequest("http://somehost.com/another_not_cached_path/mp4"))
+	assert.Equal(t, 12, backend.timesCalled, "Cache should have been called 12 times but was called", backend.timesCalled)
+}
+
+func TestCacheByCombinedRules(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &AllCacheRule{Rules: []CacheRule{
+		&PathCacheRule{Path: "/api"},
+		&ContentTypeCacheRule{Types: []string{"application/json"}},
+		&NotCacheRule{Rule: &CookieCacheRule{Name: "session"}},
+	}})
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"application/json"}}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/api/users"))
+	assert.Equal(t, 1, backend.TimesCalled(), "Anonymous JSON responses should be cached")
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/api/profile", "GET", http.Header{
+		"Cookie": {"session=abc"},
+	}))
+	assert.Equal(t, 3, backend.TimesCalled(), "Responses with a session cookie should not be cached")
+
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"text/html"}}
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/api/docs"))
+	assert.Equal(t, 5, backend.TimesCalled(), "HTML responses should not be cached")
+}
+
+func TestRuleTTL(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &TTLCacheRule{
+		Rule: &PathCacheRule{Path: "/static"},
+		TTL:  24 * time.Hour,
+	})
+	handler.Config.StatusTTLs = map[int]time.Duration{404: 30 * time.Second}
+
+	status, err := getCacheableStatus(buildGetRequest("http://somehost.com/static/a.css"), 200, http.Header{}, handler.Config)
+	assert.NoError(t, err)
+	assert.True(t, status.IsCacheable)
+	assert.Equal(t, 24*time.Hour, status.TTL, "The TTL of the rule should have been used")
+	assert.Equal(t, handler.Config.CacheRules[0], status.Rule)
+
+	// The expiration of the origin has precedence over the TTL of the rule
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/static/a.css"), 200, http.Header{
+		"Cache-Control": []string{"max-age=60"},
+	}, handler.Config)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, status.TTL.Round(time.Second), "The expiration of the origin should have been used")
+
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/static/missing.css"), 404, http.Header{}, handler.Config)
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, status.TTL, "The TTL of the rule has precedence over the TTL of the status")
+
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/other"), 404, http.Header{}, handler.Config)
+	assert.NoError(t, err)
+	assert.False(t, status.IsCacheable)
+	assert.Equal(t, 30*time.Second, status.TTL, "The TTL of the status should have been used")
+}
+
+func TestRuleTTLOverride(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &TTLCacheRule{
+		Rule:     &PathCacheRule{Path: "/static"},
+		TTL:      time.Hour,
+		Override: true,
+	})
+
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-cache, max-age=0"}}
+
+	status, err := getCacheableStatus(buildGetRequest("http://somehost.com/static/a.css"), 200, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.True(t, status.IsCacheable)
+	assert.Equal(t, time.Hour, status.TTL)
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/static/a.css"))
+	assert.Equal(t, 1, backend.TimesCalled(), "The rule should have overridden Cache-Control")
+
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-store"}}
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/other"))
+	assert.Equal(t, 3, backend.TimesCalled(), "Responses not matching the rule should respect Cache-Control")
+
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"private, max-age=60"}}
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/static/user.css"), 200, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.False(t, status.IsCacheable, "Private responses must never be stored")
+}
+
+func TestVaryAll(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"*"},
+		"Cache-Control": []string{"max-age=3600"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/assets/1"))
+	assert.Equal(t, 2, backend.timesCalled, "Invalid number of times called")
+}
+
+func TestVaryAcceptEncoding(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"Accept-Encoding"},
+		"Cache-Control": []string{"max-age=3600"},
+	}
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+	}))
+	assert.Equal(t, 1, backend.timesCalled, "Invalid number of times called")
+
+	makeNRequests(handler, 3, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"deflate"},
+	}))
+	assert.Equal(t, 2, backend.timesCalled, "Invalid number of times called")
+
+}
+
+func TestVaryWithTwoHeaders(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"Accept-Encoding, User-Agent"},
+		"Cache-Control": []string{"max-age=3600"},
+	}
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+		"User-Agent":      {"Mobile"},
+		"X-Another":       {"x"},
+	}))
+	assert.Equal(t, 1, backend.timesCalled, "Invalid number of times called")
+
+	makeNRequests(handler, 2, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+		"User-Agent":      {"Mobile"},
+		"X-Another":       {"Y"},
+	}))
+	assert.Equal(t, 1, backend.timesCalled, "Invalid number of times called")
+
+	makeNRequests(handler, 3, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+		"User-Agent":      {"Desktop"},
+		"X-Another":       {"X"},
+	}))
+	assert.Equal(t, 2, backend.timesCalled, "Invalid number of times called")
+}
+
+func TestVaryNormalizedAcceptEncoding(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.VaryNormalizers = map[string]VaryNormalizer{
+		"Accept-Encoding": &AcceptEncodingNormalizer{Supported: []string{"gzip"}},
+	}
+
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"Accept-Encoding"},
+		"Cache-Control": []string{"max-age=3600"},
+	}
+
+	makeNRequests(handler, 1, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip, deflate, br"},
+	}))
+	makeNRequests(handler, 1, buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"gzip,deflate"},
+	}))
+	assert.Equal(t, 1, backend.TimesCalled(), "Requests accepting gzip should share the variant")
+
+	req := buildRequest("http://somehost.com/assets/1", "GET", http.Header{
+		"Accept-Encoding": {"deflate"},
+	})
+	makeNRequests(handler, 2, req)
+	assert.Equal(t, 2, backend.TimesCalled(), "Requests not accepting gzip should use another variant")
+	assert.Equal(t, []string{"identity"}, req.Header["Accept-Encoding"], "Request was not normalized before sending it upstream")
+}
+
+func TestVaryNormalizedUserAgent(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.VaryNormalizers = map[string]VaryNormalizer{
+		"User-Agent": &DeviceClassNormalizer{},
+	}
+
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"User-Agent"},
+		"Cache-Control": []string{"max-age=3600"},
+	}
+
+	agents := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/74.0",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_5) Safari/605.1.15",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:67.0) Firefox/67.0",
+	}
+	for _, agent := range agents {
+		req := buildRequest("http://somehost.com/assets/1", "GET", http.Header{"User-Agent": {agent}})
+		makeNRequests(handler, 1, req)
+		assert.Equal(t, []string{agent}, req.Header["User-Agent"], "User-Agent should be sent upstream as it is")
+	}
+	assert.Equal(t, 1, backend.TimesCalled(), "Desktop requests should share the variant")
+}
+
+func TestStatusCacheSkip(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.StatusHeader = "cache-status"
+
+	reqUrl, _ := url.Parse("http://somehost.com/assets/some.jpg")
+	responses := makeNRequests(handler, 1, &http.Request{Method: "POST", URL: reqUrl})
+
+	assert.Equal(t, []string{"skip"}, responses[0].Header["Cache-Status"])
+}
+
+func TestBypass(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.StatusHeader = "cache-status"
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	handler.Config.BypassRules = []CacheRule{&CookieCacheRule{Name: "wordpress_logged_in_*"}}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.TimesCalled())
+
+	responses := makeNRequests(handler, 2, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Cookie": {"wordpress_logged_in_abc=1"},
+	}))
+	assert.Equal(t, 3, backend.TimesCalled(), "Logged in users should not get the cached page")
+	assert.Equal(t, []string{"skip"}, responses[1].Header["Cache-Status"])
+}
+
+func TestNoCacheSetCookie(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&TTLCacheRule{Rule: &PathCacheRule{Path: "/"}, TTL: time.Hour, Override: true}}
+	backend.ResponseHeaders = http.Header{
+		"Cache-Control": []string{"public, max-age=3600"},
+		"Set-Cookie":    []string{"session=secret"},
+	}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Responses with Set-Cookie should not be stored")
+
+	handler.Config.StripSetCookie = true
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/other"))
+	assert.Equal(t, 3, backend.TimesCalled())
+	assert.Equal(t, []string{"session=secret"}, responses[0].Header["Set-Cookie"], "The cookie should be sent to the client that got it")
+	assert.Empty(t, responses[1].Header["Set-Cookie"], "The cookie should have been stripped before storing")
+}
+
+func TestNoCacheAuthorizedRequests(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&TTLCacheRule{Rule: &PathCacheRule{Path: "/"}, TTL: time.Hour, Override: true}}
+	req := buildRequest("http://somehost.com/", "GET", http.Header{"Authorization": []string{"Basic dXNlcjpwYXNz"}})
+
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=3600"}}
+	makeNRequests(handler, 2, req)
+	assert.Equal(t, 2, backend.TimesCalled(), "Rules should not store responses to authenticated requests")
+
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"public, max-age=3600"}}
+	makeNRequests(handler, 3, req)
+	assert.Equal(t, 3, backend.TimesCalled(), "Public responses to authenticated requests can be stored")
+}
+
+func TestHardenWebCacheDeception(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	handler.Config.Harden = true
+	backend.ResponseHeaders = http.Header{"Content-Type": []string{"text/html"}}
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/account/profile.php/nonexistent.css"))
+	assert.Equal(t, 2, backend.TimesCalled(), "The html page should not be cached as a css file")
+
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/index.html"))
+	assert.Equal(t, 3, backend.TimesCalled())
+}
+
+func TestHardenUnkeyedHeaders(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	handler.Config.StatusHeader = "Cache-Status"
+	handler.Config.Harden = true
+	handler.Config.UnkeyedHeaders = []string{"X-Forwarded-Host"}
+
+	poisoned := func() *http.Request {
+		return buildRequest("http://somehost.com/", "GET", http.Header{"X-Forwarded-Host": []string{"evil.com"}})
+	}
+
+	responses := makeNRequests(handler, 2, poisoned())
+	assert.Equal(t, 2, backend.TimesCalled())
+	assert.Equal(t, []string{"skip"}, responses[1].Header["Cache-Status"])
+
+	handler.Config.StripUnkeyedHeaders = true
+	req := poisoned()
+	responses = makeNRequests(handler, 2, req)
+	assert.Equal(t, 3, backend.TimesCalled())
+	assert.Equal(t, []string{"hit"}, responses[1].Header["Cache-Status"])
+	assert.Empty(t, req.Header.Get("X-Forwarded-Host"), "The header should not have been sent upstream")
+}
+
+func TestTargetedCacheControl(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	backend.ResponseHeaders = http.Header{
+		"Cache-Control":     []string{"max-age=60"},
+		"Cdn-Cache-Control": []string{"max-age=86400"},
+	}
+
+	status, err := getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.Equal(t, 24*time.Hour, status.TTL.Round(time.Second), "CDN-Cache-Control should have been used")
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.TimesCalled())
+	for _, response := range responses {
+		assert.Equal(t, "max-age=60", response.Header.Get("Cache-Control"))
+		assert.Empty(t, response.Header.Get("Cdn-Cache-Control"), "Targeted headers should not be sent to clients")
+	}
+
+	backend.ResponseHeaders = http.Header{
+		"Cache-Control":     []string{"public, max-age=3600"},
+		"Surrogate-Control": []string{`no-store, content="ESI/1.0"`},
+	}
+	responses = makeNRequests(handler, 2, buildGetRequest("http://somehost.com/surrogate"))
+	assert.Equal(t, 3, backend.TimesCalled(), "Surrogate-Control should have been used")
+	assert.Empty(t, responses[1].Header.Get("Surrogate-Control"))
+
+	handler.Config.TargetedHeaders = []string{"Caddy-Cache-Control"}
+	backend.ResponseHeaders = http.Header{
+		"Cdn-Cache-Control":   []string{"no-store"},
+		"Caddy-Cache-Control": []string{"max-age=30"},
+	}
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.True(t, status.IsCacheable, "The configured header has precedence")
+	assert.Equal(t, 30*time.Second, status.TTL.Round(time.Second))
+}
+
+func TestTargetedHeadersAreHiddenWhenSkipped(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.BypassRules = []CacheRule{&PathCacheRule{Path: "/admin"}}
+	backend.ResponseHeaders = http.Header{
+		"Cache-Control":     []string{"max-age=60"},
+		"Cdn-Cache-Control": []string{"max-age=86400"},
+		"Surrogate-Control": []string{"max-age=86400"},
+	}
+
+	requests := []*http.Request{
+		buildGetRequest("http://somehost.com/admin"),
+		buildRequest("http://somehost.com/", "POST", http.Header{}),
+		buildRequest("http://somehost.com/", "GET", http.Header{"Upgrade": []string{"websocket"}}),
+	}
+	for _, req := range requests {
+		response := makeNRequests(handler, 1, req)[0]
+		assert.Equal(t, "max-age=60", response.Header.Get("Cache-Control"))
+		assert.Empty(t, response.Header.Get("Cdn-Cache-Control"), "Targeted headers are not sent to clients when the cache is skipped")
+		assert.Empty(t, response.Header.Get("Surrogate-Control"))
+	}
+	assert.Equal(t, 3, backend.TimesCalled())
+}
+
+func TestHeuristicFreshness(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	date := time.Now().UTC()
+	headers := http.Header{
+		"Date":          []string{date.Format(http.TimeFormat)},
+		"Last-Modified": []string{date.Add(-100 * time.Hour).Format(http.TimeFormat)},
+	}
+
+	status, err := getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, headers, handler.Config)
+	assert.NoError(t, err)
+	assert.True(t, status.IsCacheable)
+	assert.True(t, status.Heuristic)
+	assert.Equal(t, 10*time.Hour, status.TTL.Round(time.Minute), "It should be 10% of the time since Last-Modified")
+
+	handler.Config.HeuristicFactor = 0.5
+	status, _ = getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, headers, handler.Config)
+	assert.Equal(t, 24*time.Hour, status.TTL, "It should be capped to the max age")
+
+	// Rules and explicit expirations have precedence
+	handler.Config.CacheRules = []CacheRule{&TTLCacheRule{Rule: &PathCacheRule{Path: "/"}, TTL: time.Minute}}
+	status, _ = getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, headers, handler.Config)
+	assert.Equal(t, time.Minute, status.TTL)
+	assert.False(t, status.Heuristic)
+
+	handler.Config.CacheRules = []CacheRule{}
+	handler.Config.HeuristicFactor = 0
+	status, _ = getCacheableStatus(buildGetRequest("http://somehost.com/"), 200, headers, handler.Config)
+	assert.False(t, status.IsCacheable, "The heuristic should be disabled")
+}
+
+func TestHeuristicWarning(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.HeuristicWarning = true
+
+	entry := &HttpCacheEntry{
+		isPublic:    true,
+		isHeuristic: true,
+		Stored:      time.Now().UTC().Add(-25 * time.Hour),
+		Expiration:  time.Now().UTC().Add(time.Hour),
+		Response:    &Response{Code: 200, HeaderMap: http.Header{}},
+	}
+	recorder := httptest.NewRecorder()
+	handler.HandleCachedResponse(recorder, buildGetRequest("http://somehost.com/"), entry)
+	assert.Contains(t, recorder.Header().Get("Warning"), `113 - "Heuristic Expiration"`)
+
+	entry.Stored = time.Now().UTC()
+	recorder = httptest.NewRecorder()
+	handler.HandleCachedResponse(recorder, buildGetRequest("http://somehost.com/"), entry)
+	assert.Empty(t, recorder.Header().Get("Warning"), "Hits younger than a day should not be warned")
+}
+
+func TestStatusCacheHit(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.StatusHeader = "Cache-Status"
+
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	responses := makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, []string{"miss"}, responses[0].Header["Cache-Status"])
+
+	responses = makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, []string{"hit"}, responses[0].Header["Cache-Status"])
+}
+
+func TestExpiration(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=1"},
+	}
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was not called")
+
+	time.Sleep(time.Duration(1010) * time.Millisecond)
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Backend should have been called twice")
+}
+
+// This is a good test to detect race conditions
+func TestFastExpiration(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.DefaultMaxAge = 1
+	handler.Config.CacheRules = append(handler.Config.CacheRules, &PathCacheRule{Path: "/assets"})
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/assets/1"))
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was not called")
+
+	time.Sleep(time.Duration(1) * time.Millisecond)
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/assets/1"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Backend should have been called twice")
+}
+
+func TestStatusCode(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.ResponseCode = 404
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	responses := makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 404, responses[0].StatusCode)
+
+	responses = makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 404, responses[0].StatusCode)
+}
+
+func TestCacheErrors(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.ErrorTTLs = map[int]time.Duration{502: 5 * time.Second, 404: 10 * time.Second}
+
+	backend.ResponseCode = 502
+	backend.Delay = time.Duration(10) * time.Millisecond
+	responses, _ := makeNConcurrentRequests(handler, 10, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.TimesCalled(), "The storm of errors should have reached upstream once")
+	for _, response := range responses {
+		assert.Equal(t, 502, response.StatusCode)
+	}
+
+	// Errors not in cache_errors are not cached
+	backend.ResponseCode = 503
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/unavailable"))
+	assert.Equal(t, 3, backend.TimesCalled())
+
+	// Errors are not kept longer than their ttl
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=3600"}}
+	status, err := getCacheableStatus(buildGetRequest("http://somehost.com/"), 404, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.True(t, status.IsCacheable)
+	assert.Equal(t, 10*time.Second, status.TTL)
+
+	// But Cache-Control no-store is still respected
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-store"}}
+	status, err = getCacheableStatus(buildGetRequest("http://somehost.com/"), 502, backend.ResponseHeaders, handler.Config)
+	assert.NoError(t, err)
+	assert.False(t, status.IsCacheable)
+}
+
+func TestCacheUnwrittenErrors(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.ErrorTTLs = map[int]time.Duration{404: 10 * time.Second}
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	timesCalled := 0
+	upstreamErr := fmt.Errorf("backend unreachable")
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		if r.URL.Path == "/down" {
+			return http.StatusBadGateway, upstreamErr
+		}
+		return http.StatusNotFound, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		code, err := handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("http://somehost.com/missing"))
+		assert.NoError(t, err)
+		assert.Equal(t, 404, code, "The code of upstream should be returned so caddy writes the error page")
+	}
+	assert.Equal(t, 1, timesCalled)
+
+	for i := 0; i < 2; i++ {
+		code, err := handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("http://somehost.com/down"))
+		assert.Equal(t, upstreamErr, err)
+		assert.Equal(t, 502, code)
+	}
+	assert.Equal(t, 3, timesCalled, "Errors not in cache_errors should not be cached")
+
+	handler.Config.ErrorTTLs[502] = 5 * time.Second
+	for i := 0; i < 2; i++ {
+		code, err := handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("http://somehost.com/down"))
+		assert.Equal(t, upstreamErr, err, "The error should be returned on hits too")
+		assert.Equal(t, 502, code)
+	}
+	assert.Equal(t, 4, timesCalled)
+}
+
+func TestCompressAtRest(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.Compress = true
+	handler.Config.CompressTypes = DEFAULT_COMPRESS_TYPES
+
+	content := bytes.Repeat([]byte("Some compressible text. "), 100)
+	backend.ResponseBody = content
+	backend.ResponseHeaders = http.Header{
+		"Content-Type":  []string{"text/plain; charset=utf-8"},
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	// The first response is sent as it comes from upstream
+	responses := makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	body, _ := ioutil.ReadAll(responses[0].Body)
+	assert.Equal(t, content, body)
+	assert.Equal(t, "", responses[0].Header.Get("Content-Encoding"))
+
+	// Clients that accept gzip receive the stored body
+	responses = makeNRequests(handler, 1, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"gzip, deflate"},
+	}))
+	assert.Equal(t, "gzip", responses[0].Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", responses[0].Header.Get("Vary"))
+	reader, err := gzip.NewReader(responses[0].Body)
+	assert.NoError(t, err, "Response is not gzipped")
+	body, _ = ioutil.ReadAll(reader)
+	assert.Equal(t, content, body)
+
+	// The others receive it decompressed
+	responses = makeNRequests(handler, 1, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"gzip;q=0, deflate"},
+	}))
+	assert.Equal(t, "", responses[0].Header.Get("Content-Encoding"))
+	body, _ = ioutil.ReadAll(responses[0].Body)
+	assert.Equal(t, content, body)
+
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend should have been called once")
+}
+
+func TestCompressedETagIsWeak(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.Compress = true
+	handler.Config.CompressTypes = DEFAULT_COMPRESS_TYPES
+	backend.ResponseBody = bytes.Repeat([]byte("Some compressible text. "), 100)
+	backend.ResponseHeaders = http.Header{
+		"Content-Type":  []string{"text/plain"},
+		"Cache-control": []string{"public; max-age=3600"},
+		"Etag":          []string{`"abc"`},
+	}
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	responses := makeNRequests(handler, 1, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+	}))
+	assert.Equal(t, `W/"abc"`, responses[0].Header.Get("ETag"), "The gzip form is not byte to byte the same")
+	responses = makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, `"abc"`, responses[0].Header.Get("ETag"), "The decompressed form keeps the strong ETag")
+}
+
+func buildCompressingHandler(content []byte) (*CacheHandler, *TestHandler) {
+	handler, backend := buildBasicHandler()
+	handler.Config.Compress = true
+	handler.Config.CompressTypes = DEFAULT_COMPRESS_TYPES
+	handler.Config.StatusHeader = "X-Cache-Status"
+	backend.ResponseBody = content
+	backend.ResponseHeaders = http.Header{
+		"Content-Type":  []string{"text/plain"},
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+	return handler, backend
+}
+
+// Replaces the stored body of the request with the result of broken
+func breakStoredBody(handler *CacheHandler, req *http.Request, broken func([]byte) []byte) {
+	handler.Cache.GetOrSet(getKey(req), requestVariant(req, nil), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		content, _ := handler.Cache.NewContent(getKey(req))
+		content.Write(broken(found.Response.Body.Bytes()))
+		content.Close()
+		found.Response.Body = content
+		return nil, nil
+	})
+}
+
+func TestBrokenCompressedBodyIsFetchedAgain(t *testing.T) {
+	content := bytes.Repeat([]byte("Some compressible text. "), 100)
+	handler, backend := buildCompressingHandler(content)
+
+	req := buildGetRequest("http://somehost.com/")
+	makeNRequests(handler, 1, req)
+	breakStoredBody(handler, req, func(stored []byte) []byte {
+		return append([]byte("not gzip"), stored...)
+	})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, content, w.Body.Bytes(), "Bodies that can't be decompressed are fetched again instead of sent")
+	assert.Equal(t, 2, backend.TimesCalled())
+}
+
+func TestTruncatedCompressedBodyIsEvictedWhileStreaming(t *testing.T) {
+	content := bytes.Repeat([]byte("Some compressible text. "), 100)
+	handler, backend := buildCompressingHandler(content)
+
+	req := buildGetRequest("http://somehost.com/")
+	makeNRequests(handler, 1, req)
+	breakStoredBody(handler, req, func(stored []byte) []byte {
+		return stored[:len(stored)/2]
+	})
+
+	w := httptest.NewRecorder()
+	_, err := handler.ServeHTTP(w, req)
+	assert.NoError(t, err)
+	assert.Equal(t, "hit", w.Header().Get("X-Cache-Status"), "The body is decompressed while it is sent")
+	assert.True(t, len(w.Body.Bytes()) < len(content))
+	assert.Equal(t, 1, backend.TimesCalled())
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"), "The broken body is evicted once it is found")
+	assert.Equal(t, content, w.Body.Bytes())
+	assert.Equal(t, 2, backend.TimesCalled())
+}
+
+func TestNoCompressionOfEncodedOrBinaryResponses(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.Compress = true
+	handler.Config.CompressTypes = DEFAULT_COMPRESS_TYPES
+
+	assert.False(t, handler.shouldCompress(200, http.Header{"Content-Type": {"image/png"}}))
+	assert.False(t, handler.shouldCompress(200, http.Header{"Content-Type": {"text/html"}, "Content-Encoding": {"br"}}))
+	assert.False(t, handler.shouldCompress(200, http.Header{"Content-Type": {"text/html"}, "Content-Length": {"20"}}))
+	assert.True(t, handler.shouldCompress(200, http.Header{"Content-Type": {"application/json"}}))
+}
+
+/**
+ *
+ * Locking tests
+ *
+ */
+func TestLockOnCacheableReq(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.Delay = time.Duration(10) * time.Millisecond
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	go makeNConcurrentRequests(handler, 10, buildGetRequest("http://somehost.com/"))
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 0, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 0, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+}
+
+func TestLockOnNonCacheableReq(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.Delay = time.Duration(10) * time.Millisecond
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"private"},
+	}
+
+	go makeNConcurrentRequests(handler, 10, buildGetRequest("http://somehost.com/"))
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 9, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 9, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 10, backend.TimesCalled(), "Backend was called different times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 0, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 9, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 10, backend.TimesCalled(), "Backend was called different times than expected")
+}
+
+func TestLockOnVaryHeaderRequests(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.Delay = time.Duration(10) * time.Millisecond
+	backend.ResponseHeaders = http.Header{
+		"Vary":          []string{"Accept-Encoding"},
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+
+	go makeNConcurrentRequests(handler, 10, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"gzip"},
+	}))
+	go makeNConcurrentRequests(handler, 10, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"deflate"},
+	}))
+	go makeNConcurrentRequests(handler, 10, buildRequest("http://somehost.com/", "GET", http.Header{
+		"Accept-Encoding": {"somestrangeEncoding"},
+	}))
+
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 2, backend.TimesCalled(), "Backend was called different times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 3, backend.TimesCalled(), "Backend was called different times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 0, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 3, backend.TimesCalled(), "Backend was called different times than expected")
+}
+
+func TestLockOnMixedContent(t *testing.T) {
+	handler, backend := buildBasicHandler()
+
+	backend.Delay = time.Duration(10) * time.Millisecond
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"private"},
+	}
+
+	go makeNConcurrentRequests(handler, 3, buildGetRequest("http://somehost.com/"))
+	time.Sleep(time.Duration(5) * time.Millisecond)
+	assert.Equal(t, 1, backend.ConcurrencyLevel(), "There are more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.MaxConcurrencyLevel(), "There were more conccurrent requests than expected")
+	assert.Equal(t, 1, backend.TimesCalled(), "Backend was called more times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 2, backend.ConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 2, backend.MaxConcurrencyLevel(), "The locking is incorrect")
+	assert.Equal(t, 3, backend.TimesCalled(), "Backend was called different times than expected")
+
+	time.Sleep(time.Duration(10) * time.Millisecond)
+	assert.Equal(t, 0, backend.ConcurrencyLevel(), "The locking is incorrect")
+
+	// After concurrent non cached requests ends
+	// The next one is cacheable
+	// So only one request should be made
+
+	backend.ResponseHeaders = http.Header{
+		"Cache-control": []string{"public; max-age=3600"},
+	}
+	makeNRequests(handler, 3, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 4, backend.TimesCalled(), "Backend was called different times than expected")
+}
+
+/* Mmap test */
+func TestMMapWritesToDisk(t *testing.T) {
+	cache := NewCache(NewMMapStorage("/tmp/caddy-cache-tests"))
+	cache.Setup()
+	handler, backend := buildHandlerWithCache(cache)
+
+	content := []byte("Some content")
+	backend.ResponseBody = content
+	backend.ResponseHeaders = http.Header{"Cache-control": []string{"public; max-age=1"}}
+
+	req := buildGetRequest("http://somehost.com/")
+	makeNRequests(handler, 1, req)
+
+	err := cache.GetOrSet(getKey(req), requestVariant(req, nil), func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+		assert.NotNil(t, entry, "Entry was not found")
+		assert.NotNil(t, entry.Response.Body, "Body was not saved")
+		fileName := entry.Response.Body.(*MMapContent).name
+		savedContent, err := ioutil.ReadFile(fileName)
+		assert.NoError(t, err, "Failed reading disk response")
+		assert.Equal(t, content, savedContent, "Content on disk is not the same")
+		return nil, nil
+	})
+	assert.NoError(t, err, "There was an error in GetOrLock")
+}
+
+func TestMMapClosesFiles(t *testing.T) {
+	storage := NewMMapStorage("/tmp/caddy-cache-tests")
+	cache := NewCache(storage)
+	cache.Setup()
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = http.Header{"Cache-control": []string{"public; max-age=1"}}
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 1, backend.TimesCalled())
+	body, _ := ioutil.ReadAll(responses[1].Body)
+	assert.Equal(t, "Hello :)", string(body), "The mapping must survive the file")
+	assert.Equal(t, int64(0), storage.OpenFiles(), "Files must be closed once they are mapped")
+
+	empty, err := storage.NewContent("empty")
+	assert.NoError(t, err)
+	assert.NoError(t, empty.Close(), "Empty contents can not be mapped but they are valid")
+	assert.Empty(t, empty.Bytes())
+	assert.NoError(t, empty.Clear())
+	assert.Equal(t, int64(0), storage.OpenFiles())
+}
+
+func TestMMapTooManyOpenFiles(t *testing.T) {
+	storage := NewMMapStorage("/tmp/caddy-cache-tests")
+	storage.MaxOpenFiles = 1
+	cache := NewCache(storage)
+	cache.Setup()
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = http.Header{"Cache-control": []string{"public; max-age=1"}}
+
+	writing, err := storage.NewContent("writing")
+	assert.NoError(t, err)
+	_, err = storage.NewContent("other")
+	assert.Equal(t, ErrTooManyOpenFiles, err)
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Responses are not stored without files")
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body), "Responses are served without storing them")
+	}
+
+	writing.Close()
+	writing.Clear()
+	makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 3, backend.TimesCalled(), "Responses are stored again once files are closed")
+}
+
+// A storage whose contents fail when they are closed, like when mmap fails
+type failingStorage struct {
+	cleared int
+}
+
+type failingContent struct {
+	*MemoryData
+	storage *failingStorage
+}
+
+func (s *failingStorage) Setup() error {
+	return nil
+}
+
+func (s *failingStorage) NewContent(key string) (StorageContent, error) {
+	return &failingContent{MemoryData: &MemoryData{content: new(bytes.Buffer)}, storage: s}, nil
+}
+
+func (c *failingContent) Close() error {
+	return fmt.Errorf("cannot allocate memory")
+}
+
+func (c *failingContent) Clear() error {
+	c.storage.cleared++
+	return nil
+}
+
+func TestFailedContentPassThrough(t *testing.T) {
+	storage := &failingStorage{}
+	cache := NewCache(storage)
+	cache.Setup()
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = http.Header{"Cache-control": []string{"public; max-age=1"}}
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Contents that failed must not be stored")
+	assert.Equal(t, 2, storage.cleared, "Contents that failed must be removed")
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body))
+	}
+}
+
+type closableStorage struct {
+	*MemoryStorage
+	closed int
+}
+
+func (s *closableStorage) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestCloseClosesStorage(t *testing.T) {
+	storage := &closableStorage{MemoryStorage: NewMemoryStorage()}
+	config := DefaultConfig()
+	config.Storage = storage
+	handler, err := NewCacheHandler(config)
+	assert.NoError(t, err)
+	assert.NoError(t, handler.Setup())
+
+	assert.NoError(t, handler.Close())
+	assert.Equal(t, 1, storage.closed, "The storage must be closed with the handler")
+}
+
+type hijackableRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	pushed   []string
+	readFrom bool
+}
+
+func (w *hijackableRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	client, server := net.Pipe()
+	client.Close()
+	return server, bufio.NewReadWriter(bufio.NewReader(server), bufio.NewWriter(server)), nil
+}
+
+func (w *hijackableRecorder) Push(target string, opts *http.PushOptions) error {
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func (w *hijackableRecorder) ReadFrom(src io.Reader) (int64, error) {
+	w.readFrom = true
+	return io.Copy(w.ResponseRecorder, src)
+}
+
+func TestHijackedResponsesAreNotCached(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	timesCalled := 0
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		conn.Close()
+		return 0, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		w := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+		_, err := handler.ServeHTTP(w, buildGetRequest("/socket"))
+		assert.NoError(t, err)
+		assert.True(t, w.hijacked)
+	}
+	assert.Equal(t, 2, timesCalled, "Hijacked responses must not be stored")
+}
+
+func TestUpgradesSkipTheLock(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	backend.Delay = time.Duration(50) * time.Millisecond
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+
+	upgrade := buildRequest("http://somehost.com/socket", "GET", http.Header{
+		"Connection": {"keep-alive, Upgrade"},
+		"Upgrade":    {"websocket"},
+	})
+	makeNConcurrentRequests(handler, 2, upgrade)
+	assert.Equal(t, 2, backend.MaxConcurrencyLevel(), "Upgrades must not wait for each other")
+	assert.Equal(t, 2, backend.TimesCalled())
+
+	assert.False(t, shouldUseCache(buildRequest("http://somehost.com/", "GET", http.Header{"Connection": {"upgrade"}})))
+	assert.True(t, shouldUseCache(buildRequest("http://somehost.com/", "GET", http.Header{"Connection": {"keep-alive"}})))
+}
+
+func TestStreamedRecorderWithoutHijacker(t *testing.T) {
+	rec := NewStreamedRecorder(httptest.NewRecorder())
+
+	_, _, err := rec.Hijack()
+	assert.Error(t, err)
+	assert.False(t, rec.Hijacked())
+	assert.Equal(t, http.ErrNotSupported, rec.Push("/style.css", nil))
+	assert.NotNil(t, rec.CloseNotify())
+}
+
+func TestStreamedRecorderOnlyExposesWhatDownstreamSupports(t *testing.T) {
+	w := NewStreamedRecorder(httptest.NewRecorder()).Wrap()
+	_, ok := w.(http.Hijacker)
+	assert.False(t, ok, "Downstream is not a Hijacker")
+	_, ok = w.(http.CloseNotifier)
+	assert.False(t, ok, "Downstream is not a CloseNotifier")
+	_, ok = w.(http.Pusher)
+	assert.False(t, ok, "Downstream is not a Pusher")
+	_, ok = w.(io.ReaderFrom)
+	assert.False(t, ok, "Downstream is not a ReaderFrom")
+	_, ok = w.(http.Flusher)
+	assert.True(t, ok)
+
+	w = NewStreamedRecorder(&hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}).Wrap()
+	_, ok = w.(http.Hijacker)
+	assert.True(t, ok)
+	_, ok = w.(http.CloseNotifier)
+	assert.False(t, ok)
+	_, ok = w.(http.Pusher)
+	assert.True(t, ok)
+	_, ok = w.(io.ReaderFrom)
+	assert.True(t, ok)
+
+	// Upstream gets the wrapped recorder, on the cached and the skipped requests
+	handler, _ := buildBasicHandler()
+	supported := []bool{}
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		_, hijacker := w.(http.Hijacker)
+		_, notifier := w.(http.CloseNotifier)
+		_, pusher := w.(http.Pusher)
+		_, readerFrom := w.(io.ReaderFrom)
+		supported = append(supported, hijacker || notifier || pusher || readerFrom)
+		return 200, nil
+	})
+	handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("http://somehost.com/"))
+	handler.ServeHTTP(httptest.NewRecorder(), buildRequest("http://somehost.com/", "POST", http.Header{}))
+	assert.Equal(t, []bool{false, false}, supported)
+}
+
+func TestStreamedRecorderForwardsPush(t *testing.T) {
+	w := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec := NewStreamedRecorder(w)
+
+	assert.NoError(t, rec.Push("/style.css", nil))
+	assert.Equal(t, []string{"/style.css"}, w.pushed)
+}
+
+func TestStreamedRecorderReadFrom(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 2000)
+
+	// Not recorded, the rest is sent with the ReadFrom of downstream
+	w := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+	rec := NewStreamedRecorder(w)
+	listenerCalls := 0
+	rec.SetFirstWriteListener(func(code int, header http.Header) error {
+		listenerCalls++
+		return nil
+	})
+	n, err := rec.ReadFrom(bytes.NewReader(content))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), n)
+	assert.Equal(t, 1, listenerCalls)
+	assert.True(t, w.readFrom)
+	assert.Equal(t, content, w.Body.Bytes())
+
+	// Recorded, everything goes through Write
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	timesCalled := 0
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		w.Header().Set("Cache-Control", "max-age=60")
+		return 200, copyWithReadFrom(w, bytes.NewReader(content))
+	})
+
+	for i := 0; i < 2; i++ {
+		w := &hijackableRecorder{ResponseRecorder: httptest.NewRecorder()}
+		_, err := handler.ServeHTTP(w, buildGetRequest("/file"))
+		assert.NoError(t, err)
+		assert.Equal(t, content, w.Body.Bytes())
+	}
+	assert.Equal(t, 1, timesCalled)
+}
+
+func copyWithReadFrom(w http.ResponseWriter, src io.Reader) error {
+	_, err := w.(io.ReaderFrom).ReadFrom(src)
+	return err
+}
+
+func TestCacheTrailers(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	timesCalled := 0
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte("Hello :)"))
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", "ok")
+		return 200, nil
+	})
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		_, err := handler.ServeHTTP(w, buildGetRequest("/rpc"))
+		assert.NoError(t, err)
+
+		result := w.Result()
+		assert.Equal(t, "Hello :)", w.Body.String())
+		assert.Equal(t, "Grpc-Status", result.Header.Get("Trailer"))
+		assert.Equal(t, "0", result.Trailer.Get("Grpc-Status"))
+		assert.Equal(t, "ok", result.Trailer.Get("Grpc-Message"))
+		assert.Empty(t, result.Header.Get("Grpc-Status"), "Trailers must not be sent as headers")
+	}
+	assert.Equal(t, 1, timesCalled)
+}
+
+func TestDeclaredTrailersSentAsHeadersAreNotRepeated(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+
+	timesCalled := 0
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message, Checksum")
+		w.Header().Set("Grpc-Status", "0")
+		w.Header().Set("Grpc-Message", "started")
+		w.Write([]byte("Hello :)"))
+		w.Header().Add("Grpc-Message", "done")
+		w.Header().Set("Checksum", "abc")
+		return 200, nil
+	})
+
+	_, err := handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("/rpc"))
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	_, err = handler.ServeHTTP(w, buildGetRequest("/rpc"))
+	assert.NoError(t, err)
+
+	result := w.Result()
+	assert.Equal(t, "0", result.Header.Get("Grpc-Status"))
+	assert.Equal(t, []string{"started"}, result.Header["Grpc-Message"])
+	assert.Empty(t, result.Trailer.Get("Grpc-Status"), "Values set before the headers were sent are not trailers")
+	assert.Equal(t, []string{"done"}, result.Trailer["Grpc-Message"], "Only the values added after the headers were sent are trailers")
+	assert.Equal(t, "abc", result.Trailer.Get("Checksum"))
+	assert.Equal(t, 1, timesCalled)
+}
@@ -0,0 +1,138 @@
+package core
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Headers that upstream may reflect in the response but are not part of the key
+var DEFAULT_UNKEYED_HEADERS = []string{
+	"X-Forwarded-Host",
+	"X-Forwarded-Server",
+	"X-Forwarded-Scheme",
+	"X-Host",
+	"X-Original-Url",
+	"X-Rewrite-Url",
+	"X-Http-Method-Override",
+}
+
+/**
+ * Looks for unkeyed headers in the request. If StripUnkeyedHeaders is set they are
+ * removed so upstream never sees them, otherwise it returns true and the request
+ * must skip the cache.
+ */
+func (h *CacheHandler) hasUnkeyedHeaders(r *http.Request) bool {
+	found := false
+	for _, header := range h.Config.UnkeyedHeaders {
+		if _, ok := r.Header[header]; !ok {
+			continue
+		}
+
+		h.Config.Logger.Warning("possible cache poisoning", LogFields{
+			"host":   r.Host,
+			"path":   r.URL.Path,
+			"header": header,
+			"value":  r.Header.Get(header),
+		})
+		if h.Config.StripUnkeyedHeaders {
+			r.Header.Del(header)
+		} else {
+			found = true
+		}
+	}
+	return found
+}
+
+// Media types that name the same format, they are compared by the first type of their family
+var mediaTypeAliases = map[string]string{
+	"application/javascript":       "text/javascript",
+	"application/x-javascript":     "text/javascript",
+	"application/ecmascript":       "text/javascript",
+	"text/ecmascript":              "text/javascript",
+	"application/xml":              "text/xml",
+	"text/json":                    "application/json",
+	"image/vnd.microsoft.icon":     "image/x-icon",
+	"image/x-ms-bmp":               "image/bmp",
+	"application/font-woff":        "font/woff",
+	"application/x-font-woff":      "font/woff",
+	"application/font-woff2":       "font/woff2",
+	"application/x-font-ttf":       "font/ttf",
+	"application/x-font-otf":       "font/otf",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/x-wav":                  "audio/wav",
+	"audio/wave":                   "audio/wav",
+	"application/x-gzip":           "application/gzip",
+	"application/x-zip-compressed": "application/zip",
+}
+
+// Types of common static files, used when the mime.types of the system doesn't have them
+var extensionTypes = map[string]string{
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".otf":   "font/otf",
+}
+
+// Returns the media type of the Content-Type without parameters, the same for all its aliases
+func mediaTypeFamily(contentType string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if family, ok := mediaTypeAliases[mediaType]; ok {
+		return family
+	}
+	return mediaType
+}
+
+/**
+ * Returns true if the path has an extension whose type is not the Content-Type of the response.
+ * Like /account/profile.php/nonexistent.css returning the html of the profile.
+ * Types are compared by family, so a .js sent as application/javascript is what it says.
+ * Unknown extensions are not checked.
+ */
+func isDeceptivePath(req *http.Request, respHeaders http.Header, logger *Logger) bool {
+	extension := path.Ext(req.URL.Path)
+	if extension == "" {
+		return false
+	}
+
+	expected := mime.TypeByExtension(extension)
+	if expected == "" {
+		expected = extensionTypes[strings.ToLower(extension)]
+	}
+	if expected == "" {
+		return false
+	}
+
+	contentType := respHeaders.Get("Content-Type")
+	if mediaTypeFamily(expected) == mediaTypeFamily(contentType) {
+		return false
+	}
+
+	logger.Warning("possible web cache deception", LogFields{
+		"host":         req.Host,
+		"path":         req.URL.Path,
+		"content_type": contentType,
+	})
+	return true
+}
+
+// Returns true if the rule checks the path of the request
+func usesPath(rule CacheRule) bool {
+	switch rule := rule.(type) {
+	case *PathCacheRule, *PathRegexCacheRule:
+		return true
+	case *NotCacheRule:
+		return usesPath(rule.Rule)
+	case *TTLCacheRule:
+		return usesPath(rule.Rule)
+	case *AllCacheRule:
+		for _, rule := range rule.Rules {
+			if usesPath(rule) {
+				return true
+			}
+		}
+	}
+	return false
+}
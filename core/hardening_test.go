@@ -0,0 +1,45 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestDeceptivePath(t *testing.T) {
+	tests := []struct {
+		path        string
+		contentType string
+		expected    bool
+	}{
+		{"/account/profile.php/nonexistent.css", "text/html; charset=utf-8", true},
+		{"/static/style.css", "text/css", false},
+		{"/static/logo.png", "image/png", false},
+		{"/static/logo.png", "text/html", true},
+		{"/account/profile", "text/html", false},
+		{"/download.unknownext", "text/html", false},
+		{"/static/app.js", "application/javascript", false},
+		{"/static/app.js", "text/javascript; charset=utf-8", false},
+		{"/static/app.js", "application/x-javascript", false},
+		{"/static/app.js", "text/html", true},
+		{"/feed.xml", "application/xml", false},
+		{"/feed.xml", "text/xml", false},
+		{"/favicon.ico", "image/vnd.microsoft.icon", false},
+		{"/favicon.ico", "image/x-icon", false},
+		{"/fonts/a.woff2", "font/woff2", false},
+		{"/fonts/a.woff2", "application/font-woff2", false},
+		{"/fonts/a.woff", "application/font-woff", false},
+		{"/fonts/a.woff2", "text/html", true},
+	}
+
+	for _, test := range tests {
+		req := buildGetRequest("http://somehost.com" + test.path)
+		assert.Equal(t, test.expected, isDeceptivePath(req, http.Header{"Content-Type": {test.contentType}}, nil), test.path)
+	}
+}
+
+func TestUsesPath(t *testing.T) {
+	assert.True(t, usesPath(&PathCacheRule{Path: "/"}))
+	assert.True(t, usesPath(&TTLCacheRule{Rule: &AllCacheRule{Rules: []CacheRule{&StatusCacheRule{}, &PathRegexCacheRule{}}}}))
+	assert.False(t, usesPath(&HeaderCacheRule{Header: "Content-Type"}))
+}
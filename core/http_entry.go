@@ -0,0 +1,182 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Request struct {
+	HeaderMap http.Header // Headers are the only useful information
+}
+
+type Response struct {
+	Code      int // the HTTP response code from WriteHeader
+	Body      StorageContent
+	HeaderMap http.Header // the HTTP response headers
+	Encoding  string      // the encoding applied to Body when it was stored, empty if it was stored as received
+	Trailer   http.Header // the trailers sent after the body, nil if there were none
+	BodySize  int64       // bytes of the body as it was received, counted when it was stored
+
+	// Upstream returned Code and Error without writing the response, so caddy writes the error page
+	Unwritten bool
+	Error     error
+}
+
+/**
+ * ReadableContent is implemented by contents read from a file or a server, like KVContent.
+ * Reading them can fail, then the response is fetched again instead of sending it without body.
+ */
+type ReadableContent interface {
+	Open() (io.ReadCloser, error)
+}
+
+/**
+ * wrappedContent is embedded by the contents that wrap the one of a storage, like GzipContent.
+ * It forwards Open, so errors reading the wrapped content are not hidden,
+ * and Hit, so it can still be moved between storages like TieredStorage.
+ */
+type wrappedContent struct {
+	StorageContent
+}
+
+func (c wrappedContent) Open() (io.ReadCloser, error) {
+	return openBody(&Response{Body: c.StorageContent})
+}
+
+func (c wrappedContent) Hit(hits int) {
+	if content, ok := c.StorageContent.(HitAwareContent); ok {
+		content.Hit(hits)
+	}
+}
+
+// Opens the body of the response, it is nil if the response has no body
+func openBody(response *Response) (io.ReadCloser, error) {
+	if response.Body == nil {
+		return nil, nil
+	}
+	if content, ok := response.Body.(ReadableContent); ok {
+		return content.Open()
+	}
+	return ioutil.NopCloser(bytes.NewReader(response.Body.Bytes())), nil
+}
+
+type HttpCacheEntry struct {
+	isPublic   bool
+	Expiration time.Time
+	Stored     time.Time
+
+	// The expiration was calculated from Last-Modified
+	isHeuristic bool
+
+	// How long took to fetch it from upstream
+	fetchDuration time.Duration
+
+	// Why it was not stored, empty if it was
+	reason string
+
+	// Number of hits and if it is being refreshed, they must be accessed atomically
+	hits       int32
+	refreshing int32
+
+	Request  *Request
+	Response *Response
+}
+
+/**
+ * The response of an entry without its body, saved by the storages that keep
+ * the entries for other instances or after a restart.
+ */
+type entryMetadata struct {
+	Code       int
+	Header     http.Header
+	Trailer    http.Header `json:",omitempty"`
+	Encoding   string      `json:",omitempty"`
+	BodySize   int64       `json:",omitempty"`
+	Expiration time.Time
+	Stored     time.Time
+	Heuristic  bool `json:",omitempty"`
+}
+
+func newEntryMetadata(entry *HttpCacheEntry) entryMetadata {
+	return entryMetadata{
+		Code:       entry.Response.Code,
+		Header:     entry.Response.HeaderMap,
+		Trailer:    entry.Response.Trailer,
+		Encoding:   entry.Response.Encoding,
+		BodySize:   entry.Response.BodySize,
+		Expiration: entry.Expiration,
+		Stored:     entry.Stored,
+		Heuristic:  entry.isHeuristic,
+	}
+}
+
+// Builds the public entry of the metadata with the body, which can be nil
+func (metadata *entryMetadata) entry(body StorageContent) *HttpCacheEntry {
+	return &HttpCacheEntry{
+		isPublic:    true,
+		Expiration:  metadata.Expiration,
+		Stored:      metadata.Stored,
+		isHeuristic: metadata.Heuristic,
+		Request:     &Request{HeaderMap: http.Header{}},
+		Response: &Response{
+			Code:      metadata.Code,
+			HeaderMap: metadata.Header,
+			Trailer:   metadata.Trailer,
+			Encoding:  metadata.Encoding,
+			BodySize:  metadata.BodySize,
+			Body:      body,
+		},
+	}
+}
+
+func (entry *HttpCacheEntry) Clear() error {
+	// TODO why Response can be nil?
+	if entry.Response != nil && entry.Response.Body != nil {
+		return entry.Response.Body.Clear()
+	}
+	return nil
+}
+
+/**
+ * Returns the headers listed in the Vary of the response
+ * canonicalized and sorted, so the same list is always represented the same way
+ */
+func (entry *HttpCacheEntry) Vary() string {
+	if entry.Response == nil {
+		return ""
+	}
+
+	headers := []string{}
+	seen := map[string]bool{}
+	for _, vary := range entry.Response.HeaderMap["Vary"] {
+		for _, header := range strings.Split(vary, ",") {
+			header = http.CanonicalHeaderKey(strings.TrimSpace(header))
+			if header != "" && !seen[header] {
+				seen[header] = true
+				headers = append(headers, header)
+			}
+		}
+	}
+
+	sort.Strings(headers)
+	return strings.Join(headers, ",")
+}
+
+// Returns the content stored in a storage, without the wrappers like GzipContent
+func unwrapContent(content StorageContent) StorageContent {
+	for {
+		switch wrapper := content.(type) {
+		case *GzipContent:
+			content = wrapper.StorageContent
+		case *zoneContent:
+			content = wrapper.StorageContent
+		default:
+			return content
+		}
+	}
+}
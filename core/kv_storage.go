@@ -0,0 +1,583 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+/*
+ *
+ * KV Storage
+ *
+ */
+
+// The log is compacted when the cleared records use more than this and half of it
+const DEFAULT_KV_COMPACT_SIZE = int64(64 * 1024 * 1024)
+
+const kvMagic = uint32(0x63636b76) // "cckv"
+
+// magic, crc, metadata length, body length and stored time
+const kvHeaderSize = 4 + 4 + 4 + 8 + 8
+
+var errKVCorrupted = errors.New("corrupted record in kv storage")
+
+/**
+ * PersistentContent is implemented by contents stored with the response they belong to,
+ * like KVContent. SetEntry is called before Close with the entry that has the content as body.
+ */
+type PersistentContent interface {
+	SetEntry(variant string, entry *HttpCacheEntry)
+}
+
+/**
+ * A RestorableStorage keeps the entries of the cache between restarts, like KVStorage.
+ * After Setup, Restore calls push with the key, the variant and the entry of each response stored.
+ */
+type RestorableStorage interface {
+	Restore(push func(key string, variant string, entry *HttpCacheEntry)) error
+}
+
+/**
+ * KVStorage stores all the contents in a single append only file, so it only
+ * keeps one file descriptor open no matter how many responses are stored.
+ * Each record has the response, the time it was stored and the body, with a checksum
+ * so a torn or corrupted record is never served. The responses are restored
+ * from the file when it is set up, and cleared records are reclaimed
+ * by compacting the file into a new one that replaces it atomically.
+ */
+type KVStorage struct {
+	path string
+
+	// Compacts when cleared records use more than CompactSize and half of the file
+	CompactSize int64
+
+	log *kvLog
+
+	// Contents of a closed storage are not cleared, the storage that replaced it may use them
+	closed bool
+}
+
+/**
+ * kvLog is the open file of a path. The storages of the same path in this process share it,
+ * like when caddy reloads the config while the previous one still serves requests,
+ * and other processes can't open it while it is locked.
+ */
+type kvLog struct {
+	path string
+	refs int
+
+	// The lock protects the file and the offsets of the records
+	lock    *sync.RWMutex
+	file    *os.File
+	size    int64
+	dead    int64
+	records map[*kvRecord]struct{}
+
+	// Only one compaction at a time, compacting is set while one runs in background
+	compactLock *sync.Mutex
+	compacting  bool
+}
+
+var kvLogsLock = new(sync.Mutex)
+var kvLogs = map[string]*kvLog{}
+
+type kvRecord struct {
+	offset         int64 // Where the header starts
+	metadataLength int64
+	length         int64 // Of the body
+	crc            uint32
+	metadata       *kvMetadata
+}
+
+func (r *kvRecord) size() int64 {
+	return kvHeaderSize + r.metadataLength + r.length
+}
+
+// The response of a record, records of contents without entry only have the key
+type kvMetadata struct {
+	Key     string
+	Variant string `json:",omitempty"`
+	entryMetadata
+}
+
+// KVContent buffers what is written and appends it as one record on Close
+type KVContent struct {
+	storage *KVStorage
+	key     string
+	buffer  *bytes.Buffer
+	record  *kvRecord
+
+	// The entry the content belongs to, it is stored with the body
+	variant string
+	entry   *HttpCacheEntry
+}
+
+func NewKVStorage(path string) *KVStorage {
+	return &KVStorage{
+		path:        path,
+		CompactSize: DEFAULT_KV_COMPACT_SIZE,
+	}
+}
+
+func (s *KVStorage) compactPath() string {
+	return s.path + ".compact"
+}
+
+/**
+ * Opens the file, or shares it with the storages of the same path in this process.
+ * When it is opened its records are checked, a torn record left by a crash is truncated
+ * with everything after it, and a compaction interrupted by a crash leaves its file, it is removed.
+ */
+func (s *KVStorage) Setup() error {
+	if s.log != nil {
+		return nil
+	}
+
+	kvLogsLock.Lock()
+	defer kvLogsLock.Unlock()
+
+	log, ok := kvLogs[s.path]
+	if !ok {
+		var err error
+		if log, err = openKVLog(s.path, s.compactPath()); err != nil {
+			return err
+		}
+		kvLogs[s.path] = log
+	}
+	log.refs++
+	s.log = log
+	return nil
+}
+
+func openKVLog(filename string, compactPath string) (*kvLog, error) {
+	if err := os.MkdirAll(path.Dir(filename), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, errors.New("kv storage " + filename + " is used by other process: " + err.Error())
+	}
+	// Only the process holding the lock compacts the file
+	if err := os.Remove(compactPath); err != nil && !os.IsNotExist(err) {
+		file.Close()
+		return nil, err
+	}
+
+	log := &kvLog{
+		path:        filename,
+		lock:        new(sync.RWMutex),
+		file:        file,
+		records:     map[*kvRecord]struct{}{},
+		compactLock: new(sync.Mutex),
+	}
+	if err := log.scan(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+/**
+ * Closes the file once no storage of this process uses it.
+ * The records are kept in the file for the next time it is opened.
+ */
+func (s *KVStorage) Close() error {
+	if s.log == nil {
+		return nil
+	}
+
+	kvLogsLock.Lock()
+	defer kvLogsLock.Unlock()
+
+	log := s.log
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	s.closed = true
+	log.refs--
+	if log.refs > 0 {
+		return nil
+	}
+	delete(kvLogs, log.path)
+	err := log.file.Close()
+	log.file = nil
+	return err
+}
+
+func (s *KVStorage) NewContent(key string) (StorageContent, error) {
+	return &KVContent{storage: s, key: key, buffer: new(bytes.Buffer)}, nil
+}
+
+// Calls push with the entry of each record, the records without entry were never used and are removed
+func (s *KVStorage) Restore(push func(key string, variant string, entry *HttpCacheEntry)) error {
+	if s.log == nil {
+		return errors.New("kv storage is not set up")
+	}
+
+	s.log.lock.RLock()
+	records := make([]*kvRecord, 0, len(s.log.records))
+	for record := range s.log.records {
+		records = append(records, record)
+	}
+	s.log.lock.RUnlock()
+
+	for _, record := range records {
+		if record.metadata.Code == 0 {
+			s.log.remove(record, s.CompactSize)
+			continue
+		}
+		content := &KVContent{storage: s, key: record.metadata.Key, record: record}
+		push(record.metadata.Key, record.metadata.Variant, record.metadata.entry(content))
+	}
+	return nil
+}
+
+// Returns the bytes of the file and the bytes of the cleared records in it
+func (s *KVStorage) Size() (int64, int64) {
+	s.log.lock.RLock()
+	defer s.log.lock.RUnlock()
+	return s.log.size, s.log.dead
+}
+
+// Compacts the file now, no matter how many bytes it would reclaim
+func (s *KVStorage) Compact() error {
+	return s.log.compact()
+}
+
+func encodeKVRecord(metadata []byte, body []byte, stored time.Time) ([]byte, uint32) {
+	buffer := make([]byte, kvHeaderSize+len(metadata)+len(body))
+	binary.BigEndian.PutUint32(buffer[0:], kvMagic)
+	binary.BigEndian.PutUint32(buffer[8:], uint32(len(metadata)))
+	binary.BigEndian.PutUint64(buffer[12:], uint64(len(body)))
+	binary.BigEndian.PutUint64(buffer[20:], uint64(stored.UnixNano()))
+	copy(buffer[kvHeaderSize:], metadata)
+	copy(buffer[kvHeaderSize+len(metadata):], body)
+
+	// The checksum covers everything after it
+	crc := crc32.ChecksumIEEE(buffer[8:])
+	binary.BigEndian.PutUint32(buffer[4:], crc)
+	return buffer, crc
+}
+
+/**
+ * Reads the records from the start of the file. The first one that is incomplete
+ * or doesn't match its checksum was torn by a crash, the file is truncated there.
+ */
+func (l *kvLog) scan() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, kvHeaderSize)
+	offset := int64(0)
+	for offset < info.Size() {
+		if _, err := l.file.ReadAt(header, offset); err != nil {
+			break
+		}
+		record := &kvRecord{
+			offset:         offset,
+			metadataLength: int64(binary.BigEndian.Uint32(header[8:])),
+			length:         int64(binary.BigEndian.Uint64(header[12:])),
+			crc:            binary.BigEndian.Uint32(header[4:]),
+		}
+		if binary.BigEndian.Uint32(header[0:]) != kvMagic || record.length < 0 || offset+record.size() > info.Size() {
+			break
+		}
+		buffer, err := l.unsafeRead(record)
+		if err != nil {
+			break
+		}
+
+		metadata := &kvMetadata{}
+		if err := json.Unmarshal(buffer[kvHeaderSize:kvHeaderSize+record.metadataLength], metadata); err != nil {
+			// The record is complete but it can't be used
+			l.dead += record.size()
+		} else {
+			record.metadata = metadata
+			l.records[record] = struct{}{}
+		}
+		offset += record.size()
+	}
+
+	if offset < info.Size() {
+		if err := l.file.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	l.size = offset
+	return nil
+}
+
+func (l *kvLog) append(metadata *kvMetadata, body []byte) (*kvRecord, error) {
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	buffer, crc := encodeKVRecord(encoded, body, time.Now().UTC())
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file == nil {
+		return nil, errors.New("kv storage is closed")
+	}
+	// One write by record, so a crash can only tear the last one
+	if _, err := l.file.WriteAt(buffer, l.size); err != nil {
+		return nil, err
+	}
+
+	record := &kvRecord{
+		offset:         l.size,
+		metadataLength: int64(len(encoded)),
+		length:         int64(len(body)),
+		crc:            crc,
+		metadata:       metadata,
+	}
+	l.size += record.size()
+	l.records[record] = struct{}{}
+	return record, nil
+}
+
+// Reads the whole record and checks it, it must be called holding the lock
+func (l *kvLog) unsafeRead(record *kvRecord) ([]byte, error) {
+	if l.file == nil {
+		return nil, errors.New("kv storage is closed")
+	}
+	buffer := make([]byte, record.size())
+	if _, err := l.file.ReadAt(buffer, record.offset); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(buffer[0:]) != kvMagic ||
+		binary.BigEndian.Uint32(buffer[4:]) != record.crc ||
+		crc32.ChecksumIEEE(buffer[8:]) != record.crc {
+		return nil, errKVCorrupted
+	}
+	return buffer, nil
+}
+
+func (l *kvLog) read(record *kvRecord) ([]byte, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+
+	buffer, err := l.unsafeRead(record)
+	if err != nil {
+		return nil, err
+	}
+	return buffer[kvHeaderSize+record.metadataLength:], nil
+}
+
+// Removes the record and compacts the file in background once enough of it is cleared
+func (l *kvLog) remove(record *kvRecord, compactSize int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if _, ok := l.records[record]; !ok {
+		return nil
+	}
+	delete(l.records, record)
+	l.dead += record.size()
+
+	if l.file != nil && !l.compacting && l.dead > compactSize && l.dead*2 > l.size {
+		l.compacting = true
+		go func() {
+			l.compact()
+			l.lock.Lock()
+			l.compacting = false
+			l.lock.Unlock()
+		}()
+	}
+	return nil
+}
+
+/**
+ * Copies the records that were not cleared to a new file and renames it over the current one.
+ * The records are copied one by one holding the read lock, so contents are still stored and
+ * served meanwhile, only the ones appended during the copy are copied holding the write lock.
+ * Records that can't be read are left out. The new file is synced before the rename,
+ * so after a crash the file is the old or the new one.
+ */
+func (l *kvLog) compact() error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	l.lock.RLock()
+	source, end := l.file, l.size
+	records := make([]*kvRecord, 0, len(l.records))
+	for record := range l.records {
+		records = append(records, record)
+	}
+	l.lock.RUnlock()
+	if source == nil {
+		return nil
+	}
+
+	compactPath := l.path + ".compact"
+	compacted, err := os.OpenFile(compactPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		compacted.Close()
+		os.Remove(compactPath)
+		return err
+	}
+	// The new file replaces the locked one, so it is locked before it is renamed
+	if err := lockFile(compacted); err != nil {
+		return fail(err)
+	}
+
+	offsets := make(map[*kvRecord]int64, len(records))
+	size := int64(0)
+	// Records that can't be read are not copied, they are dropped holding the write lock
+	copyRecord := func(record *kvRecord) error {
+		buffer, err := l.unsafeRead(record)
+		if err != nil {
+			return nil
+		}
+		if _, err := compacted.WriteAt(buffer, size); err != nil {
+			return err
+		}
+		offsets[record] = size
+		size += record.size()
+		return nil
+	}
+
+	for _, record := range records {
+		l.lock.RLock()
+		if l.file != source {
+			l.lock.RUnlock()
+			return fail(errors.New("kv storage was closed while compacting"))
+		}
+		var err error
+		if _, ok := l.records[record]; ok {
+			err = copyRecord(record)
+		}
+		l.lock.RUnlock()
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.file != source {
+		return fail(errors.New("kv storage was closed while compacting"))
+	}
+	dead := int64(0)
+	for record := range offsets {
+		if _, ok := l.records[record]; !ok {
+			dead += record.size()
+		}
+	}
+	// The records appended during the copy
+	for record := range l.records {
+		if _, ok := offsets[record]; !ok && record.offset >= end {
+			if err := copyRecord(record); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	for record := range l.records {
+		if _, ok := offsets[record]; !ok {
+			delete(l.records, record)
+		}
+	}
+
+	if err := compacted.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(compactPath, l.path); err != nil {
+		return fail(err)
+	}
+
+	l.file.Close()
+	l.file = compacted
+	l.size = size
+	l.dead = dead
+	for record, offset := range offsets {
+		record.offset = offset
+	}
+	return nil
+}
+
+func (c *KVContent) Write(p []byte) (int, error) {
+	return c.buffer.Write(p)
+}
+
+// Called before Close, so the response is stored with the body and restored after a restart
+func (c *KVContent) SetEntry(variant string, entry *HttpCacheEntry) {
+	c.variant = variant
+	c.entry = entry
+}
+
+func (c *KVContent) Close() error {
+	if c.storage.log == nil {
+		return errors.New("kv storage is not set up")
+	}
+
+	metadata := &kvMetadata{Key: c.key, Variant: c.variant}
+	if c.entry != nil && c.entry.Response != nil {
+		metadata.entryMetadata = newEntryMetadata(c.entry)
+	}
+	record, err := c.storage.log.append(metadata, c.buffer.Bytes())
+	if err != nil {
+		return err
+	}
+	c.record = record
+	c.buffer = nil
+	c.entry = nil
+	return nil
+}
+
+// Reads the body from the file, it is nil if it could not be read
+func (c *KVContent) Bytes() []byte {
+	body, err := c.read()
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// Reads the body from the file, it fails if the record is corrupted
+func (c *KVContent) Open() (io.ReadCloser, error) {
+	body, err := c.read()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(body)), nil
+}
+
+func (c *KVContent) read() ([]byte, error) {
+	if c.record == nil {
+		return nil, errors.New("kv content was not stored")
+	}
+	return c.storage.log.read(c.record)
+}
+
+func (c *KVContent) Clear() error {
+	if c.record == nil || c.storage.isClosed() {
+		return nil
+	}
+	return c.storage.log.remove(c.record, c.storage.CompactSize)
+}
+
+func (s *KVStorage) isClosed() bool {
+	s.log.lock.RLock()
+	defer s.log.lock.RUnlock()
+	return s.closed
+}
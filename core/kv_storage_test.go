@@ -0,0 +1,289 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+func buildKVStorage(t *testing.T) *KVStorage {
+	dir, err := ioutil.TempDir("", "caddy-cache-kv")
+	assert.NoError(t, err)
+	storage := NewKVStorage(path.Join(dir, "cache.db"))
+	assert.NoError(t, storage.Setup())
+	return storage
+}
+
+func writeKVContent(t *testing.T, storage *KVStorage, key string, content string) StorageContent {
+	stored, err := storage.NewContent(key)
+	assert.NoError(t, err, "Failed creating new content")
+	stored.Write([]byte(content))
+	assert.NoError(t, stored.Close())
+	return stored
+}
+
+// Waits until the compaction started in background finishes
+func waitKVCompaction(storage *KVStorage) {
+	for {
+		storage.log.lock.RLock()
+		compacting := storage.log.compacting
+		storage.log.lock.RUnlock()
+		if !compacting {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+/* Actual tests */
+
+func TestKVStoresInOneFile(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+
+	a := writeKVContent(t, storage, "GET /a", "Hello")
+	b := writeKVContent(t, storage, "GET /b", "World")
+	empty := writeKVContent(t, storage, "GET /empty", "")
+	assert.Equal(t, []byte("Hello"), a.Bytes())
+	assert.Equal(t, []byte("World"), b.Bytes())
+	assert.Empty(t, empty.Bytes())
+
+	files, err := ioutil.ReadDir(path.Dir(storage.path))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1, "All the contents are in the same file")
+
+	size, dead := storage.Size()
+	info, err := os.Stat(storage.path)
+	assert.NoError(t, err)
+	assert.Equal(t, info.Size(), size)
+	assert.Equal(t, int64(0), dead)
+}
+
+func TestKVCompaction(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+	storage.CompactSize = 0
+
+	a := writeKVContent(t, storage, "GET /a", "Hello")
+	b := writeKVContent(t, storage, "GET /b", "World")
+	c := writeKVContent(t, storage, "GET /c", "!")
+
+	assert.NoError(t, a.Clear())
+	_, dead := storage.Size()
+	assert.NotZero(t, dead, "Less than half of the file is cleared")
+	assert.NoError(t, a.Clear(), "Clearing twice does nothing")
+
+	assert.NoError(t, c.Clear())
+	waitKVCompaction(storage)
+	size, dead := storage.Size()
+	assert.Equal(t, int64(0), dead, "The file must be compacted")
+	assert.Equal(t, b.(*KVContent).record.size(), size)
+	assert.Equal(t, []byte("World"), b.Bytes(), "Records are moved by the compaction")
+
+	info, err := os.Stat(storage.path)
+	assert.NoError(t, err)
+	assert.Equal(t, size, info.Size())
+	_, err = os.Stat(storage.compactPath())
+	assert.True(t, os.IsNotExist(err), "The compacted file replaces the old one")
+
+	d := writeKVContent(t, storage, "GET /d", "Again")
+	assert.Equal(t, []byte("Again"), d.Bytes())
+	assert.Equal(t, []byte("World"), b.Bytes())
+}
+
+func TestKVCorruptedRecord(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+
+	content := writeKVContent(t, storage, "GET /a", "Hello")
+	other := writeKVContent(t, storage, "GET /b", "World")
+	_, err := storage.log.file.WriteAt([]byte("J"), kvHeaderSize+int64(len("GET /a")))
+	assert.NoError(t, err)
+	assert.Nil(t, content.Bytes(), "Corrupted records must not be served")
+	_, err = content.(*KVContent).Open()
+	assert.Error(t, err)
+
+	assert.NoError(t, storage.Compact(), "Corrupted records are left out of the compacted file")
+	size, dead := storage.Size()
+	assert.Equal(t, other.(*KVContent).record.size(), size)
+	assert.Equal(t, int64(0), dead)
+	assert.Equal(t, []byte("World"), other.Bytes())
+	assert.NoError(t, content.Clear())
+}
+
+func TestKVCompactionWhileStoring(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+	defer storage.Close()
+
+	var contents []StorageContent
+	for i := 0; i < 100; i++ {
+		contents = append(contents, writeKVContent(t, storage, "GET /"+strconv.Itoa(i), strconv.Itoa(i)))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- storage.Compact()
+	}()
+	for i := 100; i < 200; i++ {
+		contents = append(contents, writeKVContent(t, storage, "GET /"+strconv.Itoa(i), strconv.Itoa(i)))
+		assert.NoError(t, contents[i-100].Clear())
+	}
+	assert.NoError(t, <-done)
+	assert.NoError(t, storage.Compact())
+
+	size, dead := storage.Size()
+	assert.Equal(t, int64(0), dead)
+	info, _ := os.Stat(storage.path)
+	assert.Equal(t, info.Size(), size)
+	for i := 100; i < 200; i++ {
+		assert.Equal(t, []byte(strconv.Itoa(i)), contents[i].Bytes(), "Records stored during the compaction are kept")
+	}
+}
+
+func buildKVHandler(t *testing.T, storage *KVStorage) (*CacheHandler, *TestHandler) {
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	handler.Config.StatusHeader = "X-Cache-Status"
+	backend.ResponseHeaders = map[string][]string{"Cache-Control": {"max-age=60"}}
+	return handler, backend
+}
+
+func TestKVRestoresAfterRestart(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+	handler, _ := buildKVHandler(t, storage)
+	req := buildRequest("/file", "GET", http.Header{"Accept-Language": {"es"}})
+	handler.Config.VaryNormalizers = map[string]VaryNormalizer{}
+	makeNRequests(handler, 1, req)
+	writeKVContent(t, storage, "GET /unused", "Never used by an entry")
+	assert.NoError(t, storage.Close())
+
+	// A crash tears the record being written
+	file, err := os.OpenFile(storage.path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.NoError(t, err)
+	file.Write([]byte("torn record"))
+	file.Close()
+	assert.NoError(t, ioutil.WriteFile(storage.compactPath(), []byte("partial"), 0600))
+
+	restarted := NewKVStorage(storage.path)
+	defer restarted.Close()
+	handler, backend := buildKVHandler(t, restarted)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, 0, backend.TimesCalled(), "The response must be restored")
+	assert.Equal(t, "hit", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "Hello :)", w.Body.String())
+	assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+
+	size, dead := restarted.Size()
+	info, _ := os.Stat(storage.path)
+	assert.Equal(t, info.Size(), size, "The torn record must be truncated")
+	assert.NotZero(t, dead, "The record without entry must be removed")
+	_, err = os.Stat(storage.compactPath())
+	assert.True(t, os.IsNotExist(err), "The file of an interrupted compaction is removed")
+}
+
+func TestKVExpiredEntriesAreNotRestored(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+	handler, _ := buildKVHandler(t, storage)
+	handler.Cache.StaleTTL = 0
+	makeNRequests(handler, 1, buildGetRequest("/file"))
+	assert.NoError(t, storage.Close())
+
+	restarted := NewKVStorage(storage.path)
+	defer restarted.Close()
+	cache := NewCache(restarted)
+	cache.StaleTTL = -time.Minute
+	assert.NoError(t, cache.Setup())
+	size, dead := restarted.Size()
+	assert.Equal(t, size, dead, "Expired entries must be cleared")
+}
+
+func TestKVFileIsLocked(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+
+	file, err := os.OpenFile(storage.path, os.O_RDWR, 0600)
+	assert.NoError(t, err)
+	defer file.Close()
+	assert.Error(t, lockFile(file), "Other processes can't use the file")
+
+	assert.NoError(t, storage.Close())
+	assert.NoError(t, lockFile(file), "The lock is released when the storage is closed")
+}
+
+func TestKVReloadSharesFile(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+	old, _ := buildKVHandler(t, storage)
+	req := buildGetRequest("/file")
+	makeNRequests(old, 1, req)
+
+	// The new config is set up while the old one still serves requests
+	reloaded := NewKVStorage(storage.path)
+	handler, backend := buildKVHandler(t, reloaded)
+	makeNRequests(old, 1, req)
+	assert.NoError(t, storage.Close())
+
+	responses := makeNRequests(handler, 2, req)
+	assert.Equal(t, 0, backend.TimesCalled(), "The responses of the old config are used")
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body))
+	}
+	assert.NoError(t, reloaded.Close())
+}
+
+func TestKVStorageHandler(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = map[string][]string{"Cache-Control": {"max-age=60"}}
+
+	responses := makeNRequests(handler, 3, buildGetRequest("/file"))
+	assert.Equal(t, 1, backend.TimesCalled())
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body))
+	}
+}
+
+func TestKVCorruptedRecordIsFetchedAgain(t *testing.T) {
+	storage := buildKVStorage(t)
+	defer os.RemoveAll(path.Dir(storage.path))
+
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	handler.Config.StatusHeader = "X-Cache-Status"
+	backend.ResponseHeaders = map[string][]string{"Cache-Control": {"max-age=60"}}
+
+	req := buildGetRequest("/file")
+	makeNRequests(handler, 1, req)
+	size, _ := storage.Size()
+	_, err := storage.log.file.WriteAt([]byte("J"), size-1)
+	assert.NoError(t, err)
+
+	for i, status := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, status, w.Header().Get("X-Cache-Status"), i)
+		assert.Equal(t, "Hello :)", w.Body.String(), "Corrupted records are fetched again instead of sent empty")
+		assert.Empty(t, w.Header()["Warning"], i)
+	}
+	assert.Equal(t, 2, backend.TimesCalled())
+}
@@ -0,0 +1,206 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LogLevel int
+
+// The zero value is LOG_WARNING so only problems are logged if it is not configured
+const (
+	LOG_DEBUG LogLevel = iota - 2
+	LOG_INFO
+	LOG_WARNING
+	LOG_ERROR
+)
+
+var logLevelNames = map[LogLevel]string{
+	LOG_DEBUG:   "debug",
+	LOG_INFO:    "info",
+	LOG_WARNING: "warning",
+	LOG_ERROR:   "error",
+}
+
+func ParseLogLevel(name string) (LogLevel, bool) {
+	for level, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, true
+		}
+	}
+	return LOG_WARNING, false
+}
+
+type LogFields map[string]interface{}
+
+/**
+ * Logger writes every message as a JSON object by line with its time, level and fields.
+ * Without a file they are written to the log of caddy, or sent to the sink if it has one.
+ * A nil Logger logs warnings and errors to the log of caddy.
+ */
+type Logger struct {
+	Level LogLevel
+
+	output io.WriteCloser
+	sink   LogSink
+	lock   *sync.Mutex
+}
+
+// A LogSink receives the messages instead of writing them, like to send them to other logger
+type LogSink func(level LogLevel, msg string, fields LogFields)
+
+var defaultLogger = &Logger{Level: LOG_WARNING, lock: new(sync.Mutex)}
+
+func NewLogger(level LogLevel, filename string) (*Logger, error) {
+	logger := &Logger{Level: level, lock: new(sync.Mutex)}
+	if filename == "" {
+		return logger, nil
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	logger.output = file
+	return logger, nil
+}
+
+func NewSinkLogger(level LogLevel, sink LogSink) *Logger {
+	return &Logger{Level: level, sink: sink, lock: new(sync.Mutex)}
+}
+
+func (l *Logger) Close() error {
+	if l == nil || l.output == nil {
+		return nil
+	}
+	return l.output.Close()
+}
+
+func (l *Logger) Debug(msg string, fields LogFields) {
+	l.log(LOG_DEBUG, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields LogFields) {
+	l.log(LOG_INFO, msg, fields)
+}
+
+func (l *Logger) Warning(msg string, fields LogFields) {
+	l.log(LOG_WARNING, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields LogFields) {
+	l.log(LOG_ERROR, msg, fields)
+}
+
+func (l *Logger) Enabled(level LogLevel) bool {
+	if l == nil {
+		l = defaultLogger
+	}
+	return level >= l.Level
+}
+
+func (l *Logger) log(level LogLevel, msg string, fields LogFields) {
+	if l == nil {
+		l = defaultLogger
+	}
+	if !l.Enabled(level) {
+		return
+	}
+	if l.sink != nil {
+		l.sink(level, msg, fields)
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+4)
+	for name, value := range fields {
+		switch value := value.(type) {
+		case error:
+			entry[name] = value.Error()
+		case time.Duration:
+			entry[name] = value.String()
+		default:
+			entry[name] = value
+		}
+	}
+	entry["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["logger"] = "cache"
+	entry["level"] = logLevelNames[level]
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line = []byte(fmt.Sprintf(`{"logger":"cache","level":"error","msg":"failed encoding log entry: %s"}`, err))
+	}
+
+	if l.output == nil {
+		log.Println(string(line))
+		return
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.output.Write(append(line, '\n'))
+}
+
+/**
+ * Logs what the cache did with a request and calls OnDecision.
+ * The entry is nil if the request did not use the cache.
+ */
+func (h *CacheHandler) logDecision(w http.ResponseWriter, r *http.Request, key string, status string, entry *HttpCacheEntry, reason string) {
+	if h.OnDecision != nil {
+		h.OnDecision(w, r, key, status)
+	}
+
+	logger := h.Config.Logger
+	if !logger.Enabled(LOG_INFO) {
+		return
+	}
+
+	fields := LogFields{"key": key, "status": status}
+	if entry != nil && entry.Response != nil {
+		if entry.isPublic {
+			fields["ttl"] = entry.Expiration.Sub(time.Now().UTC())
+		}
+		if entry.Response.Body != nil {
+			fields["storage"] = contentStorageName(entry.Response.Body)
+			fields["bytes"] = entry.Response.BodySize
+		}
+		if reason == "" {
+			reason = entry.reason
+		}
+	}
+	if reason != "" {
+		fields["reason"] = reason
+	}
+	logger.Info("cache decision", fields)
+}
+
+// Returns where the content is stored, tiered contents may be in memory or disk
+func contentStorageName(content StorageContent) string {
+	switch content := content.(type) {
+	case *GzipContent:
+		return contentStorageName(content.StorageContent)
+	case *zoneContent:
+		return contentStorageName(content.StorageContent)
+	case *MemoryData:
+		return "memory"
+	case *RESPContent:
+		return "redis"
+	case *S3Content:
+		return "s3"
+	case *TieredContent:
+		if content.InMemory() {
+			return "memory"
+		}
+		return "disk"
+	default:
+		return "disk"
+	}
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func readLogEntries(t *testing.T, filename string) []map[string]interface{} {
+	file, err := os.Open(filename)
+	assert.NoError(t, err)
+	defer file.Close()
+
+	entries := []map[string]interface{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry), scanner.Text())
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func buildLogFile(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "caddy-cache-log")
+	assert.NoError(t, err)
+	return path.Join(dir, "cache.log")
+}
+
+func TestParseLogLevel(t *testing.T) {
+	level, ok := ParseLogLevel("Info")
+	assert.True(t, ok)
+	assert.Equal(t, LOG_INFO, level)
+
+	_, ok = ParseLogLevel("verbose")
+	assert.False(t, ok)
+
+	var zero LogLevel
+	assert.Equal(t, LOG_WARNING, zero, "Only problems must be logged by default")
+}
+
+func TestLoggerLevels(t *testing.T) {
+	filename := buildLogFile(t)
+	defer os.RemoveAll(path.Dir(filename))
+
+	logger, err := NewLogger(LOG_INFO, filename)
+	assert.NoError(t, err)
+	logger.Debug("discarded", nil)
+	logger.Info("stored", LogFields{"key": "GET /a", "bytes": 10})
+	logger.Error("failed", LogFields{"error": os.ErrNotExist})
+	assert.NoError(t, logger.Close())
+
+	entries := readLogEntries(t, filename)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "info", entries[0]["level"])
+	assert.Equal(t, "stored", entries[0]["msg"])
+	assert.Equal(t, "GET /a", entries[0]["key"])
+	assert.Equal(t, float64(10), entries[0]["bytes"])
+	assert.Equal(t, "error", entries[1]["level"])
+	assert.Equal(t, os.ErrNotExist.Error(), entries[1]["error"])
+}
+
+func TestLogDecisions(t *testing.T) {
+	filename := buildLogFile(t)
+	defer os.RemoveAll(path.Dir(filename))
+
+	handler, _ := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/assets"}}
+	handler.Config.BypassRules = []CacheRule{&PathCacheRule{Path: "/admin"}}
+	logger, err := NewLogger(LOG_INFO, filename)
+	assert.NoError(t, err)
+	handler.Config.Logger = logger
+
+	decisions := map[string]string{}
+	handler.OnDecision = func(w http.ResponseWriter, r *http.Request, key string, status string) {
+		decisions = map[string]string{"cache_status": status, "cache_key": key}
+	}
+	serve := func(path string) map[string]string {
+		_, err := handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest(path))
+		assert.NoError(t, err)
+		return decisions
+	}
+
+	assert.Equal(t, map[string]string{"cache_status": "miss", "cache_key": "GET /assets/a.css"}, serve("/assets/a.css"))
+	assert.Equal(t, map[string]string{"cache_status": "hit", "cache_key": "GET /assets/a.css"}, serve("/assets/a.css"))
+	assert.Equal(t, "miss", serve("/private")["cache_status"])
+	assert.Equal(t, "skip", serve("/admin")["cache_status"])
+	assert.NoError(t, logger.Close())
+
+	entries := readLogEntries(t, filename)
+	assert.Len(t, entries, 4)
+
+	assert.Equal(t, "miss", entries[0]["status"])
+	assert.Equal(t, "GET /assets/a.css", entries[0]["key"])
+	assert.Equal(t, "memory", entries[0]["storage"])
+	assert.Equal(t, float64(len("Hello :)")), entries[0]["bytes"])
+	assert.NotEmpty(t, entries[0]["ttl"])
+	assert.Nil(t, entries[0]["reason"])
+
+	assert.Equal(t, "hit", entries[1]["status"])
+	assert.Equal(t, "memory", entries[1]["storage"])
+
+	assert.Equal(t, "miss", entries[2]["status"])
+	assert.Equal(t, "no expiration and no matching rule", entries[2]["reason"])
+	assert.Nil(t, entries[2]["ttl"])
+
+	assert.Equal(t, "skip", entries[3]["status"])
+	assert.Equal(t, "bypass", entries[3]["reason"])
+}
+
+func TestNilLogger(t *testing.T) {
+	var logger *Logger
+	assert.True(t, logger.Enabled(LOG_ERROR))
+	assert.False(t, logger.Enabled(LOG_INFO))
+	assert.NoError(t, logger.Close())
+	logger.Info("discarded", nil)
+}
+
+func TestSinkLogger(t *testing.T) {
+	received := []string{}
+	logger := NewSinkLogger(LOG_WARNING, func(level LogLevel, msg string, fields LogFields) {
+		assert.Equal(t, LogFields{"key": "GET /a"}, fields)
+		received = append(received, logLevelNames[level]+" "+msg)
+	})
+
+	logger.Info("discarded", LogFields{"key": "GET /a"})
+	logger.Warning("sent", LogFields{"key": "GET /a"})
+	assert.Equal(t, []string{"warning sent"}, received)
+}
@@ -0,0 +1,307 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+/**
+ * Upstream is where the responses are fetched from.
+ * It follows the convention of caddy, if it returns a status >= 400
+ * without writing the response the caller has to write the error.
+ */
+type Upstream interface {
+	ServeHTTP(http.ResponseWriter, *http.Request) (int, error)
+}
+
+type UpstreamFunc func(http.ResponseWriter, *http.Request) (int, error)
+
+func (f UpstreamFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	return f(w, r)
+}
+
+// An http.Handler as Upstream, it always writes the response
+type httpUpstream struct {
+	next  http.Handler
+	cache *Cache
+}
+
+// Marks the requests sent upstream by a handler of the cache
+type upstreamCtxKey struct {
+	cache *Cache
+}
+
+func (u httpUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
+	u.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), upstreamCtxKey{u.cache}, true)))
+	return 0, nil
+}
+
+// An Option changes the config of New
+type Option func(*Config) error
+
+/**
+ * Creates a handler with the default config changed by the options and its storage set up.
+ * Its Next must be set before it serves requests or warms the cache.
+ */
+func New(opts ...Option) (*CacheHandler, error) {
+	config := DefaultConfig()
+	for _, opt := range opts {
+		if err := opt(config); err != nil {
+			return nil, err
+		}
+	}
+
+	handler, err := NewCacheHandler(config)
+	if err != nil {
+		return nil, err
+	}
+	if err := handler.Setup(); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+/**
+ * Middleware is a net/http middleware that caches the responses of the handler it wraps,
+ * so it can be used like router.Use(handler.Middleware). Each wrapped handler gets its own
+ * CacheHandler sharing the config and the cache, like the sites of a zone, so a url must be
+ * served by only one of them. The cache is warmed through the first handler it wraps.
+ */
+func (handler *CacheHandler) Middleware(next http.Handler) http.Handler {
+	wrapped := *handler
+	wrapped.Next = httpUpstream{next: next, cache: handler.Cache}
+	wrapped.Warmer = nil
+	if len(handler.Config.WarmSources) > 0 {
+		handler.warmOnce.Do(func() {
+			wrapped.Warmer = NewWarmer(&wrapped, handler.Config.WarmHost)
+			go wrapped.Warmer.Warm()
+		})
+	}
+
+	cached := wrapped.HTTPHandler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Wrapped by other handler of the cache, it would wait for the lock that one holds
+		if r.Context().Value(upstreamCtxKey{handler.Cache}) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cached.ServeHTTP(w, r)
+	})
+}
+
+/**
+ * Returns the handler as an http.Handler, it writes the errors of the cache
+ * that upstream did not write.
+ */
+func (handler *CacheHandler) HTTPHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code, err := handler.ServeHTTP(w, r)
+		if err != nil && code >= 400 {
+			http.Error(w, http.StatusText(code), code)
+		}
+	})
+}
+
+func WithStorage(storage Storage) Option {
+	return func(config *Config) error {
+		config.Storage = storage
+		config.shareThrough(storage)
+		return nil
+	}
+}
+
+// Responses matching any of the rules are stored even without explicit expiration
+func WithRules(rules ...CacheRule) Option {
+	return func(config *Config) error {
+		config.CacheRules = append(config.CacheRules, rules...)
+		return nil
+	}
+}
+
+// Requests matching any of the rules skip the cache
+func WithBypass(rules ...CacheRule) Option {
+	return func(config *Config) error {
+		config.BypassRules = append(config.BypassRules, rules...)
+		return nil
+	}
+}
+
+func WithDefaultMaxAge(maxAge time.Duration) Option {
+	return func(config *Config) error {
+		config.DefaultMaxAge = maxAge
+		return nil
+	}
+}
+
+// Adds a header with the status of the cache, like hit or miss, to the responses
+func WithStatusHeader(name string) Option {
+	return func(config *Config) error {
+		config.StatusHeader = name
+		return nil
+	}
+}
+
+// Stores gzipped the responses with one of the types, DEFAULT_COMPRESS_TYPES if there are none
+func WithCompression(types ...string) Option {
+	return func(config *Config) error {
+		config.Compress = true
+		config.CompressTypes = types
+		if len(types) == 0 {
+			config.CompressTypes = DEFAULT_COMPRESS_TYPES
+		}
+		return nil
+	}
+}
+
+func WithVaryNormalizer(header string, normalizer VaryNormalizer) Option {
+	return func(config *Config) error {
+		if config.VaryNormalizers == nil {
+			config.VaryNormalizers = map[string]VaryNormalizer{}
+		}
+		config.VaryNormalizers[http.CanonicalHeaderKey(header)] = normalizer
+		return nil
+	}
+}
+
+func WithMaxVariants(max int) Option {
+	return func(config *Config) error {
+		config.MaxVariants = max
+		return nil
+	}
+}
+
+// TTL of responses with the status and without an explicit expiration
+func WithStatusTTL(code int, ttl time.Duration) Option {
+	return func(config *Config) error {
+		if config.StatusTTLs == nil {
+			config.StatusTTLs = map[int]time.Duration{}
+		}
+		config.StatusTTLs[code] = ttl
+		return nil
+	}
+}
+
+// Caches the error responses with the status codes, DEFAULT_ERROR_TTLS if there are none
+func WithCachedErrors(ttls map[int]time.Duration) Option {
+	return func(config *Config) error {
+		if len(ttls) == 0 {
+			ttls = DEFAULT_ERROR_TTLS
+		}
+		if config.ErrorTTLs == nil {
+			config.ErrorTTLs = map[int]time.Duration{}
+		}
+		for code, ttl := range ttls {
+			config.ErrorTTLs[code] = ttl
+		}
+		return nil
+	}
+}
+
+func WithStripSetCookie() Option {
+	return func(config *Config) error {
+		config.StripSetCookie = true
+		return nil
+	}
+}
+
+// A factor of 0 disables heuristic freshness
+func WithHeuristicFreshness(factor float64, maxAge time.Duration, warning bool) Option {
+	return func(config *Config) error {
+		config.HeuristicFactor = factor
+		config.HeuristicMaxAge = maxAge
+		config.HeuristicWarning = warning
+		return nil
+	}
+}
+
+// Headers like Caddy-Cache-Control checked before CDN-Cache-Control and Surrogate-Control
+func WithTargetedHeaders(names ...string) Option {
+	return func(config *Config) error {
+		for _, name := range names {
+			config.TargetedHeaders = append(config.TargetedHeaders, http.CanonicalHeaderKey(name))
+		}
+		return nil
+	}
+}
+
+// Enables the defenses against cache deception and poisoning, DEFAULT_UNKEYED_HEADERS if there are no headers
+func WithHardening(strip bool, unkeyedHeaders ...string) Option {
+	return func(config *Config) error {
+		config.Harden = true
+		config.StripUnkeyedHeaders = strip
+		config.UnkeyedHeaders = DEFAULT_UNKEYED_HEADERS
+		if len(unkeyedHeaders) > 0 {
+			config.UnkeyedHeaders = []string{}
+			for _, header := range unkeyedHeaders {
+				config.UnkeyedHeaders = append(config.UnkeyedHeaders, http.CanonicalHeaderKey(header))
+			}
+		}
+		return nil
+	}
+}
+
+// Refreshes entries with minHits in the last factor of their lifetime, or by XFetch if beta is not 0
+func WithRefreshAhead(factor float64, beta float64, minHits int) Option {
+	return func(config *Config) error {
+		config.RefreshFactor = factor
+		config.RefreshBeta = beta
+		config.RefreshMinHits = minHits
+		return nil
+	}
+}
+
+// A staleTTL of 0 makes requests go upstream after the timeout, otherwise they use stale values
+func WithLockTimeout(timeout time.Duration, staleTTL time.Duration) Option {
+	return func(config *Config) error {
+		config.LockTimeout = timeout
+		config.StaleTTL = staleTTL
+		return nil
+	}
+}
+
+// Warms the cache at start with the sources, relative urls are requested to host
+func WithWarming(host string, concurrency int, sources ...WarmSource) Option {
+	return func(config *Config) error {
+		config.WarmHost = host
+		config.WarmConcurrency = concurrency
+		config.WarmSources = append(config.WarmSources, sources...)
+		return nil
+	}
+}
+
+// Warms the cache again when the path is requested with POST from one of the ranges, DEFAULT_WARM_ALLOWED if there are none
+func WithWarmEndpoint(path string, ranges ...string) Option {
+	return func(config *Config) error {
+		if len(ranges) == 0 {
+			ranges = DEFAULT_WARM_ALLOWED
+		}
+		config.WarmEndpoint = path
+		config.WarmAllowed = &IPCacheRule{}
+		for _, value := range ranges {
+			network, err := ParseNetwork(value)
+			if err != nil {
+				return err
+			}
+			config.WarmAllowed.Networks = append(config.WarmAllowed.Networks, network)
+		}
+		return nil
+	}
+}
+
+// Uses the zone shared with other handlers instead of the storage, accounting the bytes stored to site
+func WithZone(zone *Zone, site string) Option {
+	return func(config *Config) error {
+		config.Zone = zone
+		config.Site = site
+		config.shareThrough(zone.Storage)
+		return nil
+	}
+}
+
+func WithLogger(logger *Logger) Option {
+	return func(config *Config) error {
+		config.Logger = logger
+		return nil
+	}
+}
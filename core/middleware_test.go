@@ -0,0 +1,173 @@
+package core
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMiddleware(t *testing.T) {
+	cache, err := New(
+		WithRules(&PathCacheRule{Path: "/assets"}),
+		WithStatusHeader("Cache-Status"),
+		WithDefaultMaxAge(time.Minute),
+	)
+	assert.NoError(t, err)
+
+	timesCalled := 0
+	handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timesCalled++
+		w.Write([]byte("Hello :)"))
+	}))
+
+	for i, status := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, buildGetRequest("/assets/a.css"))
+		assert.Equal(t, http.StatusOK, w.Code, i)
+		assert.Equal(t, "Hello :)", w.Body.String(), i)
+		assert.Equal(t, status, w.Header().Get("Cache-Status"), i)
+	}
+	assert.Equal(t, 1, timesCalled)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, buildGetRequest("/other"))
+	assert.Equal(t, "miss", w.Header().Get("Cache-Status"))
+	assert.Equal(t, 2, timesCalled, "Responses without rules nor expiration must not be stored")
+}
+
+func TestMiddlewareWrapsManyHandlers(t *testing.T) {
+	cache, err := New(WithRules(&PathCacheRule{Path: "/"}), WithDefaultMaxAge(time.Minute))
+	assert.NoError(t, err)
+
+	// Like the routes of a router using the middleware
+	called := map[string]int{}
+	route := func(name string) http.Handler {
+		return cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called[name]++
+			w.Write([]byte(name))
+		}))
+	}
+	routes := map[string]http.Handler{"/a": route("a"), "/b": route("b")}
+
+	for i := 0; i < 2; i++ {
+		for path, handler := range routes {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, buildGetRequest(path))
+			assert.Equal(t, path[1:], w.Body.String())
+		}
+	}
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, called, "Each handler is cached")
+
+	// And chained wrappers
+	chained := cache.Middleware(cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called["chained"]++
+		w.Write([]byte("chained"))
+	})))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		chained.ServeHTTP(w, buildGetRequest("/chained"))
+		assert.Equal(t, "chained", w.Body.String())
+	}
+	assert.Equal(t, 1, called["chained"])
+}
+
+func TestMiddlewareWarmsThroughTheFirstHandler(t *testing.T) {
+	list := writeURLList(t, "/a\n")
+	defer os.Remove(list)
+	cache, err := New(WithRules(&PathCacheRule{Path: "/"}), WithWarming("somehost.com", 1, WarmSource{Location: list}))
+	assert.NoError(t, err)
+
+	var first, second int32
+	cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&first, 1)
+	}))
+	cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&second, 1)
+	}))
+
+	for i := 0; i < 100 && atomic.LoadInt32(&first) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&first))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&second), "The urls are only warmed once")
+}
+
+func TestMiddlewareWritesErrors(t *testing.T) {
+	cache, err := New()
+	assert.NoError(t, err)
+
+	started := make(chan bool)
+	handler := cache.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("Hello :)"))
+	}))
+	go handler.ServeHTTP(httptest.NewRecorder(), buildGetRequest("/slow"))
+	<-started
+
+	// The request waiting for the first one is canceled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, buildGetRequest("/slow").WithContext(ctx))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+}
+
+func TestMiddlewareOptions(t *testing.T) {
+	_, err := New(WithWarmEndpoint("/_cache/warm", "10.0.0.0/33"))
+	assert.Error(t, err, "Invalid ranges must fail")
+
+	handler, err := New(
+		WithStorage(NewMemoryStorage()),
+		WithCompression(),
+		WithCachedErrors(nil),
+		WithHardening(true),
+		WithLockTimeout(time.Second, time.Minute),
+		WithVaryNormalizer("accept-encoding", &AcceptEncodingNormalizer{Supported: DEFAULT_SUPPORTED_ENCODINGS}),
+	)
+	assert.NoError(t, err)
+
+	config := handler.Config
+	assert.Equal(t, DEFAULT_COMPRESS_TYPES, config.CompressTypes)
+	assert.Equal(t, DEFAULT_ERROR_TTLS, config.ErrorTTLs)
+	assert.True(t, config.StripUnkeyedHeaders)
+	assert.Equal(t, DEFAULT_UNKEYED_HEADERS, config.UnkeyedHeaders)
+	assert.Equal(t, time.Second, handler.Cache.LockTimeout)
+	assert.Equal(t, time.Minute, handler.Cache.StaleTTL)
+	assert.Contains(t, config.VaryNormalizers, "Accept-Encoding")
+	assert.Equal(t, DEFAULT_HEURISTIC_FACTOR, config.HeuristicFactor, "Defaults are kept")
+}
+
+func TestMiddlewareSharesThroughRESPStorage(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+
+	timesCalled := int32(0)
+	backend := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&timesCalled, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello :)"))
+	})
+
+	instances := []http.Handler{}
+	for i := 0; i < 2; i++ {
+		cache, err := New(WithStorage(NewRESPStorage(server.Address(), "")), WithStatusHeader("Cache-Status"))
+		assert.NoError(t, err)
+		assert.Equal(t, cache.Config.Storage, cache.Config.Index, "The storage is the shared index")
+		defer cache.Close()
+		instances = append(instances, cache.Middleware(backend))
+	}
+
+	for i, status := range []string{"miss", "hit"} {
+		w := httptest.NewRecorder()
+		instances[i].ServeHTTP(w, buildGetRequest("/file"))
+		assert.Equal(t, "Hello :)", w.Body.String(), i)
+		assert.Equal(t, status, w.Header().Get("Cache-Status"), i)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&timesCalled), "The second instance uses the response stored by the first one")
+}
@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Hits an entry needs before it is refreshed in background
+const DEFAULT_REFRESH_MIN_HITS = 2
+
+// XFetch refreshes earlier with bigger betas, 1 is the optimal value of the paper
+const DEFAULT_XFETCH_BETA = 1.0
+
+/**
+ * Counts the hit and decides if the entry should be refreshed in background.
+ * Only one refresh is started by entry.
+ */
+func (h *CacheHandler) shouldRefresh(entry *HttpCacheEntry) bool {
+	hits := atomic.AddInt32(&entry.hits, 1)
+	if h.Config.RefreshFactor <= 0 && h.Config.RefreshBeta <= 0 {
+		return false
+	}
+	if int(hits) < h.Config.RefreshMinHits {
+		return false
+	}
+
+	remaining := entry.Expiration.Sub(time.Now().UTC())
+	if remaining <= 0 {
+		return false
+	}
+
+	refresh := false
+	if h.Config.RefreshFactor > 0 {
+		lifetime := entry.Expiration.Sub(entry.Stored)
+		refresh = remaining <= time.Duration(float64(lifetime)*h.Config.RefreshFactor)
+	}
+	if h.Config.RefreshBeta > 0 && !refresh {
+		refresh = xfetch(entry.fetchDuration, h.Config.RefreshBeta, remaining)
+	}
+
+	return refresh && atomic.CompareAndSwapInt32(&entry.refreshing, 0, 1)
+}
+
+/**
+ * Probabilistic early expiration, from "Optimal Probabilistic Cache Stampede Prevention".
+ * It returns true more often the closer the expiration is and the slower the fetch is.
+ */
+func xfetch(fetchDuration time.Duration, beta float64, remaining time.Duration) bool {
+	early := -float64(fetchDuration) * beta * math.Log(1-rand.Float64())
+	return time.Duration(early) >= remaining
+}
+
+/**
+ * Copies the request to refresh it in background. It is copied before ServeHTTP returns,
+ * after that the request may be changed or reused. The client may be gone while refreshing,
+ * so the context of its request is not used.
+ */
+func refreshRequest(r *http.Request) *http.Request {
+	req := r.WithContext(context.Background())
+	req.Header = cloneHeader(r.Header)
+	return req
+}
+
+/**
+ * Fetches the request, copied by refreshRequest, again from upstream without a client
+ * waiting for it and pushes the new entry, that replaces the previous one.
+ * If the new response can't be stored the previous entry is kept and refreshed again later.
+ */
+func (h *CacheHandler) refresh(req *http.Request, previous *HttpCacheEntry) {
+	entry, err := h.HandleNonCachedResponse(&warmResponseWriter{header: http.Header{}}, req)
+	if err != nil || !entry.isPublic {
+		atomic.StoreInt32(&previous.refreshing, 0)
+		return
+	}
+
+	h.Cache.Push(getKey(req), requestVariant(req, h.Config.VaryNormalizers), entry)
+	if h.Config.Index != nil {
+		h.publishShared(req, getKey(req), entry)
+	}
+}
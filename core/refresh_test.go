@@ -0,0 +1,105 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func buildRefreshEntry(lifetime time.Duration, remaining time.Duration) *HttpCacheEntry {
+	now := time.Now().UTC()
+	return &HttpCacheEntry{
+		isPublic:      true,
+		Stored:        now.Add(remaining - lifetime),
+		Expiration:    now.Add(remaining),
+		fetchDuration: time.Duration(100) * time.Millisecond,
+		Response:      &Response{Code: 200, HeaderMap: http.Header{}},
+	}
+}
+
+func TestShouldRefresh(t *testing.T) {
+	handler, _ := buildBasicHandler()
+	handler.Config.RefreshFactor = 0.1
+	handler.Config.RefreshMinHits = 2
+
+	entry := buildRefreshEntry(time.Minute, time.Second)
+	assert.False(t, handler.shouldRefresh(entry), "It doesn't have enough hits")
+	assert.True(t, handler.shouldRefresh(entry))
+	assert.False(t, handler.shouldRefresh(entry), "It is already being refreshed")
+
+	entry = buildRefreshEntry(time.Minute, 30*time.Second)
+	handler.shouldRefresh(entry)
+	assert.False(t, handler.shouldRefresh(entry), "It is not in the last 10% of its lifetime")
+
+	handler.Config.RefreshFactor = 0
+	entry = buildRefreshEntry(time.Minute, time.Second)
+	handler.shouldRefresh(entry)
+	assert.False(t, handler.shouldRefresh(entry), "Refresh ahead is disabled")
+}
+
+func TestXFetch(t *testing.T) {
+	refreshed := 0
+	for i := 0; i < 1000; i++ {
+		if xfetch(time.Second, DEFAULT_XFETCH_BETA, time.Millisecond) {
+			refreshed++
+		}
+	}
+	assert.True(t, refreshed > 900, "Entries about to expire should be refreshed almost always")
+
+	for i := 0; i < 1000; i++ {
+		assert.False(t, xfetch(time.Millisecond, DEFAULT_XFETCH_BETA, time.Hour), "Entries far from expiring should not be refreshed")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.RefreshFactor = 0.9
+	handler.Config.RefreshMinHits = 1
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=1"}}
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	time.Sleep(time.Duration(150) * time.Millisecond)
+
+	responses := makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 200, responses[0].StatusCode, "The client should be served the current entry")
+
+	for i := 0; i < 100 && backend.TimesCalled() < 2; i++ {
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	assert.Equal(t, 2, backend.TimesCalled(), "The entry should have been refreshed in background")
+
+	// The refreshed entry is served without going upstream
+	time.Sleep(time.Duration(20) * time.Millisecond)
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/"))
+	assert.Equal(t, 2, backend.TimesCalled())
+}
+
+func TestRefreshWithUncacheableResponse(t *testing.T) {
+	handler, backend := buildBasicHandler()
+	handler.Config.RefreshFactor = 0.9
+	handler.Config.RefreshMinHits = 1
+	handler.Config.StatusHeader = "X-Cache-Status"
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=2"}}
+
+	req := buildGetRequest("http://somehost.com/")
+	makeNRequests(handler, 1, req)
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-store"}}
+
+	for calls := 2; calls <= 3; calls++ {
+		makeNRequests(handler, 1, req)
+		// The request is changed after it was served, the refresh uses its own copy
+		req.Header.Set("X-Changed", "1")
+		for i := 0; i < 100 && backend.TimesCalled() < calls; i++ {
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+		assert.Equal(t, calls, backend.TimesCalled(), "The entry should be refreshed again after a failed refresh")
+		time.Sleep(time.Duration(20) * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "hit", w.Header().Get("X-Cache-Status"), "Private responses must not replace the stored one")
+}
@@ -0,0 +1,250 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_RESP_TIMEOUT = time.Duration(2) * time.Second
+const DEFAULT_RESP_POOL_SIZE = 16
+
+// An error reply of the server, like a wrong command or a failed AUTH
+type respError string
+
+func (e respError) Error() string {
+	return "resp: " + string(e)
+}
+
+type respConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+/**
+ * respClient sends commands to a server speaking the RESP protocol of Redis.
+ * Connections are kept in a pool and the broken ones are discarded,
+ * like the ones whose reply was not read entirely.
+ * Replies are strings, []byte for bulk strings, int64, []interface{} or nil.
+ */
+type respClient struct {
+	address  string
+	password string
+	timeout  time.Duration
+	pool     chan *respConn
+
+	// Set when it is closed, it must be accessed atomically
+	closed int32
+}
+
+func newRESPClient(address string, password string) *respClient {
+	return &respClient{
+		address:  address,
+		password: password,
+		timeout:  DEFAULT_RESP_TIMEOUT,
+		pool:     make(chan *respConn, DEFAULT_RESP_POOL_SIZE),
+	}
+}
+
+func (c *respClient) dial() (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &respConn{conn: conn, reader: bufio.NewReader(conn)}
+	if c.password != "" {
+		if _, err := c.send(rc, "AUTH", c.password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+var errRESPClosed = errors.New("resp: client is closed")
+
+func (c *respClient) get() (*respConn, error) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return nil, errRESPClosed
+	}
+	select {
+	case rc := <-c.pool:
+		return rc, nil
+	default:
+		return c.dial()
+	}
+}
+
+func (c *respClient) put(rc *respConn) {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		rc.conn.Close()
+		return
+	}
+	select {
+	case c.pool <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// Closes the connections of the pool, the ones being used are closed when they are put back
+func (c *respClient) close() {
+	atomic.StoreInt32(&c.closed, 1)
+	for {
+		select {
+		case rc := <-c.pool:
+			rc.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Sends the command and returns its reply, error replies are returned as errors
+func (c *respClient) do(args ...string) (interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := c.send(rc, args...)
+	if _, ok := err.(respError); err != nil && !ok {
+		// The connection may have half a reply, it can't be used again
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return reply, err
+}
+
+var errRESPAborted = errors.New("resp: transaction aborted")
+
+/**
+ * Sends the commands in a MULTI/EXEC transaction, so they are applied together,
+ * and returns their replies.
+ */
+func (c *respClient) transaction(commands ...[]string) ([]interface{}, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := c.sendTransaction(rc, commands)
+	if _, ok := err.(respError); err != nil && !ok {
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return replies, err
+}
+
+func (c *respClient) sendTransaction(rc *respConn, commands [][]string) ([]interface{}, error) {
+	if _, err := c.send(rc, "MULTI"); err != nil {
+		return nil, err
+	}
+	for _, command := range commands {
+		if _, err := c.send(rc, command...); err != nil {
+			if _, ok := err.(respError); ok {
+				// The command was not queued, the others are discarded so the connection can be used again
+				if _, err := c.send(rc, "DISCARD"); err != nil {
+					return nil, err
+				}
+			}
+			return nil, err
+		}
+	}
+
+	reply, err := c.send(rc, "EXEC")
+	if err != nil {
+		return nil, err
+	}
+	replies, ok := reply.([]interface{})
+	if !ok {
+		return nil, errRESPAborted
+	}
+	return replies, nil
+}
+
+func (c *respClient) send(rc *respConn, args ...string) (interface{}, error) {
+	rc.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	command := make([]byte, 0, 64)
+	command = append(command, '*')
+	command = strconv.AppendInt(command, int64(len(args)), 10)
+	command = append(command, '\r', '\n')
+	for _, arg := range args {
+		command = append(command, '$')
+		command = strconv.AppendInt(command, int64(len(arg)), 10)
+		command = append(command, '\r', '\n')
+		command = append(command, arg...)
+		command = append(command, '\r', '\n')
+	}
+	if _, err := rc.conn.Write(command); err != nil {
+		return nil, err
+	}
+	return readRESP(rc.reader)
+}
+
+func readRESPLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("resp: invalid line")
+	}
+	return line[:len(line)-2], nil
+}
+
+// Reads a value of the RESP protocol, used by the client and the servers in tests
+func readRESP(reader *bufio.Reader) (interface{}, error) {
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return data[:length], nil
+	case '*':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		values := make([]interface{}, length)
+		for i := range values {
+			if values[i], err = readRESP(reader); err != nil {
+				// The rest of the array is not read, so it is not an error reply the connection can be used after
+				return nil, fmt.Errorf("resp: element %d of the array failed, %v", i, err)
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("resp: unknown type %q", line[0])
+	}
+}
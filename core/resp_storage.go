@@ -0,0 +1,361 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *
+ * RESP Storage
+ *
+ */
+
+// Bodies are stored in chunks of this size, so big bodies don't need a big value
+const DEFAULT_RESP_CHUNK_SIZE = 512 * 1024
+
+// TTL of the chunks until the response is published, it avoids keeping chunks of responses never stored
+const DEFAULT_RESP_PENDING_TTL = time.Duration(10) * time.Minute
+
+const DEFAULT_RESP_PREFIX = "caddy-cache:"
+
+/**
+ * RESPStorage stores the bodies in a server speaking the protocol of Redis,
+ * and it is a SharedIndex of the responses stored, so many instances share one cache.
+ * Bodies are stored in chunks and they expire with the responses.
+ */
+type RESPStorage struct {
+	client *respClient
+
+	// All the keys start with it, so many caches can use the same server
+	Prefix    string
+	ChunkSize int
+}
+
+type RESPContent struct {
+	storage *RESPStorage
+	id      string
+	chunks  int
+
+	// The chunk being written, it is sent when it is full or the content is closed
+	buffer *bytes.Buffer
+	err    error
+
+	// Published contents are shared with other instances, they are only removed by their TTL
+	// It must be accessed atomically
+	published int32
+}
+
+// The response stored in the index, the body is in the chunks of BodyID
+type respMetadata struct {
+	entryMetadata
+
+	BodyID     string `json:",omitempty"`
+	BodyChunks int    `json:",omitempty"`
+}
+
+func NewRESPStorage(address string, password string) *RESPStorage {
+	return &RESPStorage{
+		client:    newRESPClient(address, password),
+		Prefix:    DEFAULT_RESP_PREFIX,
+		ChunkSize: DEFAULT_RESP_CHUNK_SIZE,
+	}
+}
+
+// Checks the server can be reached
+func (s *RESPStorage) Setup() error {
+	_, err := s.client.do("PING")
+	return err
+}
+
+// Closes the connections to the server
+func (s *RESPStorage) Close() error {
+	s.client.close()
+	return nil
+}
+
+func (s *RESPStorage) NewContent(key string) (StorageContent, error) {
+	return &RESPContent{storage: s, id: randSeq(20), buffer: new(bytes.Buffer)}, nil
+}
+
+func (s *RESPStorage) chunkKey(id string, chunk int) string {
+	return s.Prefix + "body:" + id + ":" + strconv.Itoa(chunk)
+}
+
+func (s *RESPStorage) variesKey(key string) string {
+	return s.Prefix + "varies:" + key
+}
+
+func (s *RESPStorage) metadataKey(key string, vary string, variant string) string {
+	return s.Prefix + "meta:" + key + "\n" + indexKey(vary, variant)
+}
+
+func milliseconds(ttl time.Duration) string {
+	return strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+}
+
+/**
+ * Publishes the entry, whose body must be stored in this storage, so other instances find it.
+ * The entry and its body expire after ttl.
+ */
+func (s *RESPStorage) Publish(key string, variant VariantFunc, entry *HttpCacheEntry, ttl time.Duration) error {
+	response := entry.Response
+	if response == nil || response.Unwritten {
+		return nil
+	}
+	if ttl < time.Millisecond {
+		return nil
+	}
+
+	metadata := respMetadata{entryMetadata: newEntryMetadata(entry)}
+
+	var content *RESPContent
+	if response.Body != nil {
+		var ok bool
+		if content, ok = unwrapContent(response.Body).(*RESPContent); !ok {
+			return errors.New("the body is not stored in the resp storage")
+		}
+		metadata.BodyID = content.id
+		metadata.BodyChunks = content.chunks
+	}
+
+	encoded, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	// The chunks expire with the entry instead of the pending ttl
+	commands := [][]string{}
+	if content != nil {
+		atomic.StoreInt32(&content.published, 1)
+		for i := 0; i < content.chunks; i++ {
+			commands = append(commands, []string{"PEXPIRE", s.chunkKey(content.id, i), milliseconds(ttl)})
+		}
+	}
+
+	// Other instances find the entry with all its chunks and variants or nothing
+	vary := entry.Vary()
+	commands = append(commands,
+		[]string{"SET", s.metadataKey(key, vary, variant(vary)), string(encoded), "PX", milliseconds(ttl)},
+		[]string{"SADD", s.variesKey(key), vary},
+		[]string{"PEXPIRE", s.variesKey(key), milliseconds(ttl)},
+	)
+	_, err = s.client.transaction(commands...)
+	return err
+}
+
+/**
+ * Returns the most recent entry published for the variant of the request, nil if there is none.
+ * Its body is read from the server each time it is used.
+ */
+func (s *RESPStorage) Lookup(key string, variant VariantFunc) (*HttpCacheEntry, error) {
+	reply, err := s.client.do("SMEMBERS", s.variesKey(key))
+	if err != nil {
+		return nil, err
+	}
+	varies, _ := reply.([]interface{})
+
+	var found *respMetadata
+	for _, vary := range varies {
+		vary, ok := vary.([]byte)
+		if !ok {
+			continue
+		}
+		reply, err := s.client.do("GET", s.metadataKey(key, string(vary), variant(string(vary))))
+		if err != nil {
+			return nil, err
+		}
+		encoded, ok := reply.([]byte)
+		if !ok {
+			continue
+		}
+
+		metadata := &respMetadata{}
+		if err := json.Unmarshal(encoded, metadata); err != nil {
+			return nil, err
+		}
+		if found == nil || metadata.Stored.After(found.Stored) {
+			found = metadata
+		}
+	}
+
+	if found == nil {
+		return nil, nil
+	}
+
+	if found.BodyID == "" {
+		return found.entry(nil), nil
+	}
+	return found.entry(&RESPContent{
+		storage:   s,
+		id:        found.BodyID,
+		chunks:    found.BodyChunks,
+		published: 1,
+	}), nil
+}
+
+/**
+ * Removes the entry from the index if it is still the published one,
+ * like when its body can't be read anymore, so other instances don't find it.
+ */
+func (s *RESPStorage) Remove(key string, variant VariantFunc, entry *HttpCacheEntry) error {
+	vary := entry.Vary()
+	metadataKey := s.metadataKey(key, vary, variant(vary))
+	reply, err := s.client.do("GET", metadataKey)
+	if err != nil {
+		return err
+	}
+	encoded, ok := reply.([]byte)
+	if !ok {
+		return nil
+	}
+	metadata := &respMetadata{}
+	if err := json.Unmarshal(encoded, metadata); err != nil {
+		return err
+	}
+
+	// A newer entry may have replaced it
+	bodyID := ""
+	if content, ok := unwrapContent(entry.Response.Body).(*RESPContent); ok {
+		bodyID = content.id
+	}
+	if metadata.BodyID != bodyID || !metadata.Stored.Equal(entry.Stored) {
+		return nil
+	}
+	_, err = s.client.do("DEL", metadataKey)
+	return err
+}
+
+func (c *RESPContent) flush() error {
+	_, err := c.storage.client.do("SET", c.storage.chunkKey(c.id, c.chunks), c.buffer.String(), "PX", milliseconds(DEFAULT_RESP_PENDING_TTL))
+	if err != nil {
+		return err
+	}
+	c.chunks++
+	c.buffer.Reset()
+	return nil
+}
+
+func (c *RESPContent) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		n := c.storage.ChunkSize - c.buffer.Len()
+		if n > len(p) {
+			n = len(p)
+		}
+		c.buffer.Write(p[:n])
+		p = p[n:]
+		written += n
+
+		if c.buffer.Len() >= c.storage.ChunkSize {
+			if c.err = c.flush(); c.err != nil {
+				return written, c.err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (c *RESPContent) Close() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.buffer == nil || c.buffer.Len() == 0 {
+		c.buffer = nil
+		return nil
+	}
+	c.err = c.flush()
+	c.buffer = nil
+	return c.err
+}
+
+// Reads the chunks from the server, it is nil if any of them is missing
+func (c *RESPContent) Bytes() []byte {
+	reader, err := c.Open()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+/**
+ * Streams the chunks from the server, one command each, so big bodies are not read
+ * in one reply under a single timeout. It fails if any chunk is missing, they
+ * are checked before it is returned so nothing is sent of bodies that expired.
+ */
+func (c *RESPContent) Open() (io.ReadCloser, error) {
+	if c.chunks == 0 {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	keys := []string{"EXISTS"}
+	for i := 0; i < c.chunks; i++ {
+		keys = append(keys, c.storage.chunkKey(c.id, i))
+	}
+	reply, err := c.storage.client.do(keys...)
+	if err != nil {
+		return nil, err
+	}
+	if existing, _ := reply.(int64); existing != int64(c.chunks) {
+		return nil, errRESPMissingChunk
+	}
+	return ioutil.NopCloser(&respChunkReader{content: c}), nil
+}
+
+var errRESPMissingChunk = errors.New("resp: missing chunk of the body")
+
+// Reads the chunks of a content one by one
+type respChunkReader struct {
+	content *RESPContent
+	next    int
+	chunk   []byte
+}
+
+func (r *respChunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.next == r.content.chunks {
+			return 0, io.EOF
+		}
+		reply, err := r.content.storage.client.do("GET", r.content.storage.chunkKey(r.content.id, r.next))
+		if err != nil {
+			return 0, err
+		}
+		chunk, ok := reply.([]byte)
+		if !ok {
+			return 0, errRESPMissingChunk
+		}
+		r.chunk = chunk
+		r.next++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+// Removes the chunks of contents not published, the published ones are removed by their TTL
+func (c *RESPContent) Clear() error {
+	if atomic.LoadInt32(&c.published) == 1 || c.chunks == 0 {
+		return nil
+	}
+	keys := []string{"DEL"}
+	for i := 0; i < c.chunks; i++ {
+		keys = append(keys, c.storage.chunkKey(c.id, i))
+	}
+	_, err := c.storage.client.do(keys...)
+	return err
+}
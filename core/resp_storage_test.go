@@ -0,0 +1,473 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+/**
+ * respServer is an in-process stand-in of Redis with the commands used by RESPStorage.
+ */
+type respServer struct {
+	listener net.Listener
+	password string
+	lock     *sync.Mutex
+	values   map[string][]byte
+	sets     map[string]map[string]bool
+	expires  map[string]time.Time
+	commands map[string]int
+	conns    []net.Conn
+}
+
+func startRESPServer(t *testing.T, password string) *respServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	server := &respServer{
+		listener: listener,
+		password: password,
+		lock:     new(sync.Mutex),
+		values:   map[string][]byte{},
+		sets:     map[string]map[string]bool{},
+		expires:  map[string]time.Time{},
+		commands: map[string]int{},
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.lock.Lock()
+			server.conns = append(server.conns, conn)
+			server.lock.Unlock()
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *respServer) Address() string {
+	return s.listener.Addr().String()
+}
+
+func (s *respServer) Close() {
+	s.listener.Close()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *respServer) Count(command string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.commands[command]
+}
+
+func (s *respServer) TTL(key string) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if expiration, ok := s.expires[key]; ok {
+		return time.Until(expiration)
+	}
+	return 0
+}
+
+func (s *respServer) Keys(prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	keys := []string{}
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// Removes the values of the keys with the prefix, like if they were evicted
+func (s *respServer) Evict(prefix string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for key := range s.values {
+		if strings.HasPrefix(key, prefix) {
+			delete(s.values, key)
+		}
+	}
+}
+
+// Removes the expired keys, it must be called holding the lock
+func (s *respServer) expire() {
+	for key, expiration := range s.expires {
+		if !expiration.After(time.Now()) {
+			delete(s.values, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+	}
+}
+
+func (s *respServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authenticated := s.password == ""
+
+	// The commands of the transaction being queued, nil outside MULTI
+	var queued [][]string
+
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range request.([]interface{}) {
+			args = append(args, string(arg.([]byte)))
+		}
+
+		command := strings.ToUpper(args[0])
+		var reply string
+		switch {
+		case command == "AUTH":
+			authenticated = len(args) == 2 && args[1] == s.password
+			reply = "+OK\r\n"
+			if !authenticated {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case command == "EXEC":
+			reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+			for _, args := range queued {
+				reply += s.execute(strings.ToUpper(args[0]), args[1:])
+			}
+			queued = nil
+		case queued != nil && command != "DISCARD":
+			queued = append(queued, args)
+			reply = "+QUEUED\r\n"
+		default:
+			reply = s.execute(command, args[1:])
+			if command == "MULTI" {
+				queued = [][]string{}
+			} else if command == "DISCARD" {
+				queued = nil
+			}
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func bulkString(value []byte) string {
+	if value == nil {
+		return "$-1\r\n"
+	}
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + string(value) + "\r\n"
+}
+
+func (s *respServer) execute(command string, args []string) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	s.commands[command]++
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "MULTI", "DISCARD":
+		return "+OK\r\n"
+	case "SET":
+		s.values[args[0]] = []byte(args[1])
+		delete(s.expires, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			s.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "GET":
+		return bulkString(s.values[args[0]])
+	case "MGET":
+		reply := "*" + strconv.Itoa(len(args)) + "\r\n"
+		for _, key := range args {
+			reply += bulkString(s.values[key])
+		}
+		return reply
+	case "EXISTS":
+		existing := 0
+		for _, key := range args {
+			if _, ok := s.values[key]; ok {
+				existing++
+			}
+		}
+		return ":" + strconv.Itoa(existing) + "\r\n"
+	case "DEL":
+		deleted := 0
+		for _, key := range args {
+			if _, ok := s.values[key]; ok {
+				deleted++
+			}
+			delete(s.values, key)
+			delete(s.sets, key)
+			delete(s.expires, key)
+		}
+		return ":" + strconv.Itoa(deleted) + "\r\n"
+	case "SADD":
+		if s.sets[args[0]] == nil {
+			s.sets[args[0]] = map[string]bool{}
+		}
+		for _, member := range args[1:] {
+			s.sets[args[0]][member] = true
+		}
+		return ":1\r\n"
+	case "SMEMBERS":
+		reply := "*" + strconv.Itoa(len(s.sets[args[0]])) + "\r\n"
+		for member := range s.sets[args[0]] {
+			reply += bulkString([]byte(member))
+		}
+		return reply
+	case "PEXPIRE":
+		_, isValue := s.values[args[0]]
+		_, isSet := s.sets[args[0]]
+		if !isValue && !isSet {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(args[1])
+		s.expires[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", command)
+	}
+}
+
+func buildRESPHandler(t *testing.T, server *respServer) (*CacheHandler, *TestHandler) {
+	storage := NewRESPStorage(server.Address(), "")
+	storage.ChunkSize = 4
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+
+	handler, backend := buildHandlerWithCache(cache)
+	handler.Config.Index = storage
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+	return handler, backend
+}
+
+/* Actual tests */
+
+func TestRESPContentChunks(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+	storage := NewRESPStorage(server.Address(), "")
+	storage.ChunkSize = 4
+	assert.NoError(t, storage.Setup())
+
+	content, err := storage.NewContent("GET /file")
+	assert.NoError(t, err)
+	content.Write([]byte("Hello"))
+	content.Write([]byte(" World"))
+	assert.NoError(t, content.Close())
+
+	assert.Equal(t, []byte("Hello World"), content.Bytes())
+	assert.Len(t, server.Keys(storage.Prefix+"body:"), 3, "The body must be split in chunks")
+	assert.Equal(t, 3, server.Count("GET"), "Chunks are streamed one by one")
+
+	assert.NoError(t, content.Clear())
+	assert.Empty(t, server.Keys(storage.Prefix+"body:"), "Contents not published are removed")
+
+	empty, _ := storage.NewContent("GET /empty")
+	assert.NoError(t, empty.Close())
+	assert.Equal(t, []byte{}, empty.Bytes())
+}
+
+func TestRESPSharedBetweenInstances(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+
+	first, firstBackend := buildRESPHandler(t, server)
+	second, secondBackend := buildRESPHandler(t, server)
+
+	req := buildGetRequest("http://somehost.com/file")
+	makeNRequests(first, 1, req)
+	responses := makeNRequests(second, 2, req)
+
+	assert.Equal(t, 1, firstBackend.TimesCalled())
+	assert.Equal(t, 0, secondBackend.TimesCalled(), "The response stored by the first instance must be used")
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body))
+		assert.Equal(t, "max-age=60", response.Header.Get("Cache-Control"))
+	}
+	assert.Equal(t, 2, server.Count("SMEMBERS"), "The second request must be found in the local cache")
+
+	// The chunks expire with the entry
+	for _, key := range server.Keys("caddy-cache:") {
+		ttl := server.TTL(key)
+		assert.True(t, ttl > 50*time.Second && ttl <= 60*time.Second, "Invalid ttl %s of %s", ttl, key)
+	}
+}
+
+func TestRESPSharedVariants(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+
+	first, firstBackend := buildRESPHandler(t, server)
+	second, secondBackend := buildRESPHandler(t, server)
+	firstBackend.ResponseHeaders.Set("Vary", "Accept-Language")
+	secondBackend.ResponseHeaders.Set("Vary", "Accept-Language")
+
+	english := buildRequest("http://somehost.com/file", "GET", http.Header{"Accept-Language": []string{"en"}})
+	spanish := buildRequest("http://somehost.com/file", "GET", http.Header{"Accept-Language": []string{"es"}})
+
+	makeNRequests(first, 1, english)
+	makeNRequests(second, 1, spanish)
+	assert.Equal(t, 1, secondBackend.TimesCalled(), "Other variants are not shared")
+	makeNRequests(second, 1, english)
+	assert.Equal(t, 1, secondBackend.TimesCalled(), "The same variant is shared")
+	makeNRequests(first, 1, spanish)
+	assert.Equal(t, 1, firstBackend.TimesCalled())
+}
+
+func TestRESPMissingChunksAreFetchedAgain(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+
+	first, firstBackend := buildRESPHandler(t, server)
+	second, secondBackend := buildRESPHandler(t, server)
+	first.Config.StatusHeader = "X-Cache-Status"
+	second.Config.StatusHeader = "X-Cache-Status"
+
+	req := buildGetRequest("http://somehost.com/file")
+	makeNRequests(first, 1, req)
+	server.Evict("caddy-cache:body:")
+
+	// The responses fetched again are not stored, so the index is left as the failed hits leave it
+	firstBackend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-store"}}
+	secondBackend.ResponseHeaders = http.Header{"Cache-Control": []string{"no-store"}}
+	for _, handler := range []*CacheHandler{second, first} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"))
+		assert.Equal(t, "Hello :)", w.Body.String(), "Missing bodies are fetched again instead of sent empty")
+		assert.Empty(t, server.Keys("caddy-cache:meta:"), "Entries without body are removed from the index")
+		server.Evict("caddy-cache:body:")
+	}
+	assert.Equal(t, 1, secondBackend.TimesCalled())
+	assert.Equal(t, 2, firstBackend.TimesCalled())
+}
+
+func TestRESPRemoveKeepsNewerEntries(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+	handler, _ := buildRESPHandler(t, server)
+	storage := handler.Config.Index.(*RESPStorage)
+
+	req := buildGetRequest("http://somehost.com/file")
+	key, variant := getKey(req), requestVariant(req, nil)
+	makeNRequests(handler, 1, req)
+	old, err := storage.Lookup(key, variant)
+	assert.NoError(t, err)
+
+	newer := *old
+	newer.Stored = old.Stored.Add(time.Second)
+	assert.NoError(t, storage.Publish(key, variant, &newer, time.Minute))
+	assert.NoError(t, storage.Remove(key, variant, old))
+	assert.Len(t, server.Keys("caddy-cache:meta:"), 1, "The entry published after it must be kept")
+
+	assert.NoError(t, storage.Remove(key, variant, &newer))
+	assert.Empty(t, server.Keys("caddy-cache:meta:"))
+}
+
+func TestRESPPublishIsATransaction(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+	handler, _ := buildRESPHandler(t, server)
+
+	makeNRequests(handler, 1, buildGetRequest("http://somehost.com/file"))
+	assert.Equal(t, 1, server.Count("MULTI"), "The chunks and the entry are published together")
+	assert.Equal(t, 3, server.Count("PEXPIRE"), "The two chunks and the variants expire with the entry")
+}
+
+func TestRESPNestedErrorsDiscardTheConnection(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+	client := newRESPClient(server.Address(), "")
+	defer client.close()
+
+	_, err := client.transaction([]string{"UNKNOWN"}, []string{"SET", "key", "value"})
+	assert.Error(t, err)
+	reply, err := client.do("GET", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), reply, "The rest of the reply must not be read by the next command")
+
+	_, err = client.do("UNKNOWN")
+	assert.IsType(t, respError(""), err)
+	reply, err = client.do("GET", "key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), reply)
+}
+
+func TestRESPServerDown(t *testing.T) {
+	server := startRESPServer(t, "")
+	handler, backend := buildRESPHandler(t, server)
+	server.Close()
+
+	responses := makeNRequests(handler, 2, buildGetRequest("http://somehost.com/file"))
+	assert.Equal(t, 2, backend.TimesCalled(), "Responses are not stored without the server")
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body), "Responses are sent without storing them")
+	}
+}
+
+func TestRESPPassword(t *testing.T) {
+	server := startRESPServer(t, "secret")
+	defer server.Close()
+
+	assert.Error(t, NewRESPStorage(server.Address(), "").Setup())
+	assert.Error(t, NewRESPStorage(server.Address(), "wrong").Setup())
+	assert.NoError(t, NewRESPStorage(server.Address(), "secret").Setup())
+}
+
+func TestRESPDirective(t *testing.T) {
+	config := DefaultConfig()
+	assert.NoError(t, ApplyDirective(config, "storage", []string{"redis", "localhost:6379"}))
+	assert.IsType(t, &RESPStorage{}, config.Storage)
+	assert.Equal(t, config.Storage, config.Index, "The storage is the shared index")
+
+	assert.NoError(t, ApplyDirective(config, "storage", []string{"memory"}))
+	assert.Nil(t, config.Index)
+	assert.Error(t, ApplyDirective(config, "storage", []string{"redis"}))
+}
+
+func TestRESPHitWithWarmRecorder(t *testing.T) {
+	server := startRESPServer(t, "")
+	defer server.Close()
+	first, _ := buildRESPHandler(t, server)
+	second, _ := buildRESPHandler(t, server)
+	first.Config.StatusHeader = "X-Cache-Status"
+	second.Config.StatusHeader = "X-Cache-Status"
+
+	req := buildGetRequest("http://somehost.com/file")
+	w := httptest.NewRecorder()
+	first.ServeHTTP(w, req)
+	assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"))
+
+	w = httptest.NewRecorder()
+	second.ServeHTTP(w, req)
+	assert.Equal(t, "hit", w.Header().Get("X-Cache-Status"))
+}
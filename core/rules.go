@@ -0,0 +1,409 @@
+package core
+
+import (
+	"github.com/pquerna/cachecontrol/cacheobject"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type CacheRule interface {
+	matches(*http.Request, int, *http.Header) bool
+}
+
+type PathCacheRule struct {
+	Path string
+}
+
+type HeaderCacheRule struct {
+	Header string
+	Value  []string
+}
+
+type PathRegexCacheRule struct {
+	Regex *regexp.Regexp
+}
+
+type MethodCacheRule struct {
+	Methods []string
+}
+
+type StatusCacheRule struct {
+	Codes []int
+}
+
+type QueryCacheRule struct {
+	Param string
+	Value []string // If it is empty the param only needs to be present
+}
+
+type RequestHeaderCacheRule struct {
+	Header string
+	Value  []string // If it is empty the header only needs to be present
+}
+
+type CookieCacheRule struct {
+	Name  string   // It can be a pattern like wordpress_logged_in_*
+	Value []string // If it is empty the cookie only needs to be present
+}
+
+// IPCacheRule matches when the client address is in any of the networks
+type IPCacheRule struct {
+	Networks []*net.IPNet
+}
+
+type ContentTypeCacheRule struct {
+	Types []string // They can use wildcards like image/*
+}
+
+type NotCacheRule struct {
+	Rule CacheRule
+}
+
+// AllCacheRule matches when all its rules match, it is used for many conditions in the same match
+type AllCacheRule struct {
+	Rules []CacheRule
+}
+
+// TTLCacheRule gives its own TTL to the responses that match Rule
+// If Override is true the TTL is used even if the response has its own expiration
+// and even if its Cache-Control does not allow storing it
+type TTLCacheRule struct {
+	Rule     CacheRule
+	TTL      time.Duration
+	Override bool
+}
+
+// CacheableStatus is the result of checking if a response can be stored
+type CacheableStatus struct {
+	IsCacheable bool
+	Expiration  time.Time
+	TTL         time.Duration
+	Rule        CacheRule // The rule that matched the response, nil if none did
+	Heuristic   bool      // The TTL was calculated from Last-Modified
+	Reason      string    // Why it is not cacheable, empty if it is
+}
+
+/* This rules decide if the request must be cached and are added to handler config if are present in Caddyfile */
+
+func (rule *PathCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	return strings.HasPrefix(req.URL.Path, rule.Path)
+}
+
+func (rule *HeaderCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	headerValue := respHeaders.Get(rule.Header)
+	for _, expectedValue := range rule.Value {
+		if expectedValue == headerValue {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *PathRegexCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	return rule.Regex.MatchString(req.URL.Path)
+}
+
+func (rule *MethodCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	for _, method := range rule.Methods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *StatusCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	for _, code := range rule.Codes {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *QueryCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	values, ok := req.URL.Query()[rule.Param]
+	return ok && anyValueMatches(values, rule.Value)
+}
+
+func (rule *RequestHeaderCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	values, ok := req.Header[http.CanonicalHeaderKey(rule.Header)]
+	return ok && anyValueMatches(values, rule.Value)
+}
+
+func (rule *CookieCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	for _, cookie := range req.Cookies() {
+		if matched, _ := path.Match(rule.Name, cookie.Name); matched && anyValueMatches([]string{cookie.Value}, rule.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *IPCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range rule.Networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *ContentTypeCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	contentType := respHeaders.Get("Content-Type")
+	for _, pattern := range rule.Types {
+		if mediaTypeMatches(pattern, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *NotCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	return !rule.Rule.matches(req, statusCode, respHeaders)
+}
+
+func (rule *TTLCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	return rule.Rule.matches(req, statusCode, respHeaders)
+}
+
+func (rule *AllCacheRule) matches(req *http.Request, statusCode int, respHeaders *http.Header) bool {
+	for _, subRule := range rule.Rules {
+		if !subRule.matches(req, statusCode, respHeaders) {
+			return false
+		}
+	}
+	return true
+}
+
+/**
+ * Returns true if expected is empty or any of the values is one of the expected
+ */
+func anyValueMatches(values []string, expected []string) bool {
+	if len(expected) == 0 {
+		return true
+	}
+	for _, value := range values {
+		for _, expectedValue := range expected {
+			if value == expectedValue {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func shouldUseCache(req *http.Request) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		// Only cache Get and head request
+		return false
+	}
+
+	// Range responses still not supported
+	if req.Header.Get("accept-ranges") != "" {
+		return false
+	}
+
+	// Upgrades like websockets keep the connection, they would hold the lock of the key while it is open
+	if isUpgrade(req) {
+		return false
+	}
+
+	return true
+}
+
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") != "" {
+		return true
+	}
+	for _, value := range req.Header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/**
+ * Returns true if any of the bypass rules matches the request
+ * Bypassed requests are sent upstream without using the cache
+ */
+func shouldBypass(req *http.Request, config *Config) bool {
+	for _, rule := range config.BypassRules {
+		if rule.matches(req, 0, &http.Header{}) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Freshness of responses with Last-Modified but without explicit expiration
+ * It is a fraction of the time between Date and Last-Modified (RFC 7234 section 4.2.2)
+ */
+func heuristicFreshness(object *cacheobject.Object, config *Config) time.Duration {
+	date := object.RespDateHeader
+	if date.IsZero() {
+		date = object.NowUTC
+	}
+
+	ttl := time.Duration(float64(date.Sub(object.RespLastModifiedHeader)) * config.HeuristicFactor)
+	if config.HeuristicMaxAge > 0 && ttl > config.HeuristicMaxAge {
+		ttl = config.HeuristicMaxAge
+	}
+	return ttl
+}
+
+// Cache-Control headers targeted to this cache, in order of precedence after the configured ones
+var DEFAULT_TARGETED_HEADERS = []string{"Cdn-Cache-Control", "Surrogate-Control"}
+
+// Returns the targeted Cache-Control headers, the configured ones first
+func targetedHeaders(config *Config) []string {
+	return append(append([]string{}, config.TargetedHeaders...), DEFAULT_TARGETED_HEADERS...)
+}
+
+/**
+ * Returns the headers used to know the freshness of the response.
+ * If the response has a Cache-Control targeted to this cache, it is used
+ * instead of Cache-Control and Expires, which are meant for browsers.
+ */
+func freshnessHeaders(respHeaders http.Header, config *Config) http.Header {
+	for _, header := range targetedHeaders(config) {
+		if value, ok := respHeaders[header]; ok {
+			headers := cloneHeader(respHeaders)
+			headers["Cache-Control"] = value
+			delete(headers, "Expires")
+			return headers
+		}
+	}
+	return respHeaders
+}
+
+// Reasons not to cache that come from the response and can be ignored by rules with Override
+// private is not one of them, that response is meant for one user and a shared cache must not store it
+var responseReasons = map[cacheobject.Reason]bool{
+	cacheobject.ReasonResponseNoStore:             true,
+	cacheobject.ReasonResponseUncachableByDefault: true,
+}
+
+func getCacheableStatus(req *http.Request, statusCode int, respHeaders http.Header, config *Config) (CacheableStatus, error) {
+	now := time.Now().UTC()
+	status := CacheableStatus{IsCacheable: false, Expiration: now}
+
+	reasonsNotToCache, expiration, warnings, object, err := cacheobject.UsingRequestResponseWithObject(req, statusCode, freshnessHeaders(respHeaders, config), false)
+
+	if err != nil {
+		return status, err
+	}
+
+	varyHeaders, ok := respHeaders["Vary"]
+	if ok && varyHeaders[0] == "*" {
+		status.Reason = "Vary: *"
+		return status, nil
+	}
+
+	checkedPath, deceptivePath := false, false
+	for _, rule := range config.CacheRules {
+		if !rule.matches(req, statusCode, &respHeaders) {
+			continue
+		}
+
+		// When hardened, rules checking the path only apply if the response agrees with its extension
+		if config.Harden && usesPath(rule) {
+			if !checkedPath {
+				deceptivePath = isDeceptivePath(req, respHeaders, config.Logger)
+				checkedPath = true
+			}
+			if deceptivePath {
+				continue
+			}
+		}
+
+		status.Rule = rule
+		break
+	}
+
+	// A stored Set-Cookie would be sent to everyone, so no rule can store it unless it is stripped
+	if len(respHeaders["Set-Cookie"]) > 0 && !config.StripSetCookie {
+		status.Reason = "Set-Cookie"
+		return status, nil
+	}
+
+	ttlRule, hasTTLRule := status.Rule.(*TTLCacheRule)
+	overrides := hasTTLRule && ttlRule.Override
+
+	// Errors configured in cache_errors are cached even if they are not cacheable by default
+	errorTTL, isCachedError := config.ErrorTTLs[statusCode]
+
+	// Reasons of the request are never ignored, like an Authorization header
+	// without public, s-maxage or must-revalidate in the response (RFC 7234 section 3.2)
+	for _, reason := range reasonsNotToCache {
+		if isCachedError && reason == cacheobject.ReasonResponseUncachableByDefault {
+			continue
+		}
+		if !overrides || !responseReasons[reason] {
+			status.Reason = reason.String()
+			return status, nil
+		}
+	}
+
+	// The expiration of cacheobject may come from its own heuristic
+	// In that case it is calculated again with the configured one
+	heuristicTTL := time.Duration(0)
+	for _, warning := range warnings {
+		if warning == cacheobject.WarningHeuristicExpiration {
+			heuristicTTL = heuristicFreshness(object, config)
+			expiration = time.Time{}
+		}
+	}
+
+	// Sometimes the returned date is 31 Dec 1969
+	// So an expiration is given if it is after now
+	hasExplicitExpiration := expiration.After(now)
+
+	statusTTL, hasStatusTTL := config.StatusTTLs[statusCode]
+
+	switch {
+	case overrides:
+		status.TTL = ttlRule.TTL
+	case isCachedError:
+		// Errors are kept at most for their ttl, even if upstream allows more
+		status.TTL = errorTTL
+		if hasExplicitExpiration && expiration.Sub(now) < errorTTL {
+			status.TTL = expiration.Sub(now)
+		}
+	case hasExplicitExpiration:
+		status.TTL = expiration.Sub(now)
+	case hasTTLRule:
+		status.TTL = ttlRule.TTL
+	case heuristicTTL > 0:
+		status.TTL = heuristicTTL
+		status.Heuristic = true
+	case hasStatusTTL:
+		status.TTL = statusTTL
+	default:
+		// If expiration is not specified use default MaxAge
+		status.TTL = config.DefaultMaxAge
+	}
+
+	status.IsCacheable = status.Rule != nil || hasExplicitExpiration || isCachedError || heuristicTTL > 0
+	if !status.IsCacheable {
+		status.Reason = "no expiration and no matching rule"
+	}
+	status.Expiration = now.Add(status.TTL)
+	return status, nil
+}
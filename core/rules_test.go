@@ -0,0 +1,116 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func mustParseNetwork(value string) *net.IPNet {
+	network, err := ParseNetwork(value)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func TestMatchRules(t *testing.T) {
+	req := buildRequest("http://somehost.com/api/users.json?lang=en&debug", "GET", http.Header{
+		"Cookie":  {"wordpress_logged_in_abc=1; theme=dark"},
+		"X-Debug": {"1"},
+	})
+	req.RemoteAddr = "10.1.2.3:51234"
+	respHeaders := http.Header{"Content-Type": {"application/json; charset=utf-8"}}
+
+	tests := []struct {
+		rule     CacheRule
+		expected bool
+	}{
+		{&PathRegexCacheRule{Regex: regexp.MustCompile(`\.json$`)}, true},
+		{&PathRegexCacheRule{Regex: regexp.MustCompile(`\.css$`)}, false},
+		{&MethodCacheRule{Methods: []string{"get"}}, true},
+		{&MethodCacheRule{Methods: []string{"HEAD"}}, false},
+		{&StatusCacheRule{Codes: []int{200, 301}}, true},
+		{&StatusCacheRule{Codes: []int{404}}, false},
+		{&QueryCacheRule{Param: "lang"}, true},
+		{&QueryCacheRule{Param: "lang", Value: []string{"es", "en"}}, true},
+		{&QueryCacheRule{Param: "lang", Value: []string{"es"}}, false},
+		{&QueryCacheRule{Param: "debug"}, true},
+		{&QueryCacheRule{Param: "nocache"}, false},
+		{&RequestHeaderCacheRule{Header: "x-debug"}, true},
+		{&RequestHeaderCacheRule{Header: "X-Debug", Value: []string{"0"}}, false},
+		{&CookieCacheRule{Name: "wordpress_logged_in_*"}, true},
+		{&CookieCacheRule{Name: "theme", Value: []string{"light"}}, false},
+		{&CookieCacheRule{Name: "session"}, false},
+		{&IPCacheRule{Networks: []*net.IPNet{mustParseNetwork("192.168.0.0/16"), mustParseNetwork("10.0.0.0/8")}}, true},
+		{&IPCacheRule{Networks: []*net.IPNet{mustParseNetwork("10.1.2.4")}}, false},
+		{&ContentTypeCacheRule{Types: []string{"image/*", "application/json"}}, true},
+		{&ContentTypeCacheRule{Types: []string{"image/*"}}, false},
+		{&NotCacheRule{Rule: &CookieCacheRule{Name: "session"}}, true},
+		{&AllCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/api"}, &StatusCacheRule{Codes: []int{200}}}}, true},
+		{&AllCacheRule{Rules: []CacheRule{&PathCacheRule{Path: "/api"}, &NotCacheRule{Rule: &QueryCacheRule{Param: "debug"}}}}, false},
+	}
+
+	for i, test := range tests {
+		assert.Equal(t, test.expected, test.rule.matches(req, 200, &respHeaders), "Rule %d %#v", i, test.rule)
+	}
+}
+
+func TestParseMatchRulesWithConditionNames(t *testing.T) {
+	tests := []struct {
+		args     string
+		expected CacheRule
+	}{
+		{"header X-Mode path", &HeaderCacheRule{Header: "X-Mode", Value: []string{"path"}}},
+		{"header status ttl", &HeaderCacheRule{Header: "status", Value: []string{"ttl"}}},
+		{"query status 1", &QueryCacheRule{Param: "status", Value: []string{"1"}}},
+		{"cookie method x", &CookieCacheRule{Name: "method", Value: []string{"x"}}},
+		{"request_header ip", &RequestHeaderCacheRule{Header: "ip", Value: []string{}}},
+		{"path ttl", &PathCacheRule{Path: "ttl"}},
+		{"not query path", &NotCacheRule{Rule: &QueryCacheRule{Param: "path", Value: []string{}}}},
+		{"query mode a b path /x", &AllCacheRule{Rules: []CacheRule{
+			&QueryCacheRule{Param: "mode", Value: []string{"a", "b"}},
+			&PathCacheRule{Path: "/x"},
+		}}},
+		{"header X-Mode path status 200", &AllCacheRule{Rules: []CacheRule{
+			&HeaderCacheRule{Header: "X-Mode", Value: []string{"path"}},
+			&StatusCacheRule{Codes: []int{200}},
+		}}},
+	}
+
+	for _, test := range tests {
+		rule, err := parseMatchRules(strings.Split(test.args, " "))
+		assert.NoError(t, err, test.args)
+		assert.Equal(t, test.expected, rule, test.args)
+	}
+
+	_, err := parseMatchRules([]string{"header", "X-Mode"})
+	assert.Error(t, err, "header needs a value")
+
+	rule, err := parseBypassRules([]string{"query", "status", "1"})
+	assert.NoError(t, err, "Names of response conditions can be checked in bypass")
+	assert.Equal(t, &QueryCacheRule{Param: "status", Value: []string{"1"}}, rule)
+	_, err = parseBypassRules([]string{"path", "/x", "not", "status", "200"})
+	assert.Error(t, err)
+}
+
+func TestBypassRules(t *testing.T) {
+	config := &Config{BypassRules: []CacheRule{
+		&CookieCacheRule{Name: "wordpress_logged_in_*"},
+		&QueryCacheRule{Param: "nocache"},
+		&IPCacheRule{Networks: []*net.IPNet{mustParseNetwork("::1")}},
+	}}
+
+	assert.False(t, shouldBypass(buildGetRequest("http://somehost.com/"), config))
+	assert.True(t, shouldBypass(buildGetRequest("http://somehost.com/?nocache=1"), config))
+	assert.True(t, shouldBypass(buildRequest("http://somehost.com/", "GET", http.Header{
+		"Cookie": {"wordpress_logged_in_abc=1"},
+	}), config))
+
+	req := buildGetRequest("http://somehost.com/")
+	req.RemoteAddr = "[::1]:51234"
+	assert.True(t, shouldBypass(req, config))
+}
@@ -0,0 +1,667 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *
+ * S3 Storage
+ *
+ */
+
+// Bytes of the local copies of the objects, the least recently used are removed when it is exceeded
+const DEFAULT_S3_LOCAL_BUDGET = int64(1024 * 1024 * 1024)
+
+const DEFAULT_S3_REGION = "us-east-1"
+
+// The sha256 of an empty payload, used to sign requests without body
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+/**
+ * S3Storage stores the bodies as objects of a bucket of an S3 compatible server, like MinIO.
+ * Objects are named by the hash of the cache key and the variant, so a response stored
+ * again replaces the object stored before it. They start with a line with the response
+ * they belong to, so they are restored after a restart, and they have the key,
+ * the time they were stored and the id of the upload in their metadata headers.
+ * Copies of the objects are kept in a local directory up to LocalBudget bytes,
+ * hits read them from there or stream the object while they copy it again.
+ * Objects are uploaded in background, the local copy is used meanwhile.
+ */
+type S3Storage struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+
+	// Where the local copies are stored and how many bytes they can use
+	LocalPath   string
+	LocalBudget int64
+
+	client *http.Client
+
+	// The lock protects the local copies, ordered from the most to the least recently used
+	lock      *sync.Mutex
+	local     *list.List
+	locals    map[*S3Content]*list.Element
+	localUsed int64
+	closed    bool
+
+	// Uploads in progress, Close waits for them
+	uploads *sync.WaitGroup
+}
+
+type S3Content struct {
+	storage *S3Storage
+	key     string
+	object  string
+	size    int64
+
+	// Objects are replaced when the same response is stored again, only the upload it made is used
+	uploadID string
+
+	// The local copy, it is written before uploading the object
+	localPath string
+	file      *os.File
+	err       error
+
+	// The response it belongs to, set by SetEntry
+	variant string
+	entry   *HttpCacheEntry
+
+	// Closed when the upload finishes, nil for objects that were already uploaded
+	uploaded chan struct{}
+
+	// Cleared contents don't get a local copy again and their object is removed after
+	// their upload, they are protected by the lock of the storage
+	cleared   bool
+	uploading bool
+}
+
+// The first line of the objects, Code is 0 for responses that can't be restored
+type s3Metadata struct {
+	Key     string
+	Variant string `json:",omitempty"`
+	Size    int64
+	entryMetadata
+}
+
+// The objects of a page of the bucket listing
+type s3ListResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+/**
+ * Creates the storage of the bucket, the credentials and region are taken from
+ * AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_REGION.
+ * The endpoint is used with https if it doesn't have a scheme.
+ */
+func NewS3Storage(endpoint string, bucket string, localPath string) *S3Storage {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = DEFAULT_S3_REGION
+	}
+
+	return &S3Storage{
+		Endpoint:    strings.TrimSuffix(endpoint, "/"),
+		Bucket:      bucket,
+		Region:      region,
+		AccessKey:   os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		LocalPath:   localPath,
+		LocalBudget: DEFAULT_S3_LOCAL_BUDGET,
+		client:      &http.Client{Timeout: time.Duration(5) * time.Minute},
+		lock:        new(sync.Mutex),
+		local:       list.New(),
+		locals:      map[*S3Content]*list.Element{},
+		uploads:     new(sync.WaitGroup),
+	}
+}
+
+// Creates the local directory and checks the bucket can be reached
+func (s *S3Storage) Setup() error {
+	if err := os.MkdirAll(s.LocalPath, 0700); err != nil {
+		return err
+	}
+
+	response, err := s.request("HEAD", "", nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("bucket %s can not be used, status %d", s.Bucket, response.StatusCode)
+	}
+	return nil
+}
+
+func s3Hash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *S3Storage) NewContent(key string) (StorageContent, error) {
+	name := s3Hash(key)
+	id := randSeq(10)
+
+	file, err := os.OpenFile(path.Join(s.LocalPath, name+id), os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Content{
+		storage:   s,
+		key:       key,
+		object:    name + "/" + id,
+		uploadID:  id,
+		localPath: file.Name(),
+		file:      file,
+	}, nil
+}
+
+/**
+ * Indexes again the responses whose objects were stored before a restart.
+ * Objects that can't be read, like the ones of responses that were not public, are skipped.
+ */
+func (s *S3Storage) Restore(push func(key string, variant string, entry *HttpCacheEntry)) error {
+	token := ""
+	for {
+		result, err := s.list(token)
+		if err != nil {
+			return err
+		}
+		for _, object := range result.Contents {
+			if content, metadata := s.restoreObject(object.Key); content != nil {
+				push(metadata.Key, metadata.Variant, metadata.entry(content))
+			}
+		}
+		if !result.IsTruncated {
+			return nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// Lists a page of the objects of the bucket, the first one if token is empty
+func (s *S3Storage) list(token string) (*s3ListResult, error) {
+	query := url.Values{"list-type": []string{"2"}}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	req, err := http.NewRequest("GET", s.Endpoint+"/"+s.Bucket+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, emptyPayloadHash, time.Now().UTC())
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed listing bucket %s, status %d", s.Bucket, response.StatusCode)
+	}
+
+	result := &s3ListResult{}
+	if err := xml.NewDecoder(response.Body).Decode(result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Reads the first line of the object, the content is nil if it can't be restored
+func (s *S3Storage) restoreObject(object string) (*S3Content, *s3Metadata) {
+	response, err := s.request("GET", object, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return nil, nil
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil
+	}
+
+	metadata := &s3Metadata{}
+	line, err := bufio.NewReader(response.Body).ReadBytes('\n')
+	if err != nil || json.Unmarshal(line, metadata) != nil || metadata.Code == 0 {
+		return nil, nil
+	}
+	uploadID := response.Header.Get("X-Amz-Meta-Upload-Id")
+	return &S3Content{
+		storage:   s,
+		key:       metadata.Key,
+		object:    object,
+		size:      metadata.Size,
+		uploadID:  uploadID,
+		localPath: path.Join(s.LocalPath, s3Hash(metadata.Key)+uploadID),
+	}, metadata
+}
+
+/**
+ * Removes the local copies and closes the idle connections once the uploads finish.
+ * The objects are kept in the bucket.
+ */
+func (s *S3Storage) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	for s.local.Len() > 0 {
+		s.unsafeRemoveLocal(s.local.Back().Value.(*S3Content))
+	}
+	s.lock.Unlock()
+
+	s.uploads.Wait()
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// Returns the bytes used by the local copies
+func (s *S3Storage) LocalUsed() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.localUsed
+}
+
+/**
+ * Sends a request to the bucket, or to the object if it is not empty,
+ * signed with AWS Signature Version 4.
+ */
+func (s *S3Storage) request(method string, object string, body io.Reader, size int64, payloadHash string, headers http.Header) (*http.Response, error) {
+	target := s.Endpoint + "/" + s.Bucket
+	if object != "" {
+		target += "/" + object
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Adds the headers of AWS Signature Version 4 to the request
+func (s *S3Storage) sign(req *http.Request, payloadHash string, now time.Time) {
+	date := now.Format("20060102")
+	timestamp := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// Host and the x-amz headers are signed
+	signed := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			signed[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := []string{}
+	for name := range signed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + signed[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Keeps track of the local copy and removes the least recently used ones over the budget
+func (s *S3Storage) addLocal(content *S3Content) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if content.cleared || s.closed {
+		os.Remove(content.localPath)
+		return
+	}
+	if element, ok := s.locals[content]; ok {
+		s.local.MoveToFront(element)
+		return
+	}
+	s.locals[content] = s.local.PushFront(content)
+	s.localUsed += content.size
+
+	for s.localUsed > s.LocalBudget && s.local.Len() > 0 {
+		s.unsafeRemoveLocal(s.local.Back().Value.(*S3Content))
+	}
+}
+
+func (s *S3Storage) touchLocal(content *S3Content) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if element, ok := s.locals[content]; ok {
+		s.local.MoveToFront(element)
+	}
+}
+
+/**
+ * Removes the local copy, it must be called with the lock.
+ * Readers that opened the file before can still read it.
+ */
+func (s *S3Storage) unsafeRemoveLocal(content *S3Content) {
+	element, ok := s.locals[content]
+	if !ok {
+		return
+	}
+	s.local.Remove(element)
+	delete(s.locals, content)
+	s.localUsed -= content.size
+	os.Remove(content.localPath)
+}
+
+// Removes the local copy for good, it returns if the content is still being uploaded
+func (s *S3Storage) clearLocal(content *S3Content) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	content.cleared = true
+	s.unsafeRemoveLocal(content)
+	os.Remove(content.localPath)
+	return content.uploading
+}
+
+// Called before Close, the object is named by the variant so it is replaced when it is stored again
+func (c *S3Content) SetEntry(variant string, entry *HttpCacheEntry) {
+	c.object = s3Hash(c.key) + "/" + s3Hash(indexKey(entry.Vary(), variant))
+	c.variant = variant
+	c.entry = entry
+}
+
+func (c *S3Content) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.file.Write(p)
+	c.size += int64(n)
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+var errS3Closed = errors.New("s3 storage is closed")
+
+/**
+ * Keeps the local copy and uploads it to the bucket in background,
+ * so the response is stored without waiting for the upload.
+ * If the upload fails the local copy is removed, and hits fetch the response again.
+ */
+func (c *S3Content) Close() error {
+	if c.file == nil {
+		return c.err
+	}
+	file := c.file
+	c.file = nil
+
+	metadata := &s3Metadata{Key: c.key, Variant: c.variant, Size: c.size}
+	if c.entry != nil && c.entry.Response != nil {
+		metadata.entryMetadata = newEntryMetadata(c.entry)
+	}
+	c.entry = nil
+	line, err := json.Marshal(metadata)
+	if c.err == nil {
+		c.err = err
+	}
+
+	s := c.storage
+	s.lock.Lock()
+	if c.err == nil && s.closed {
+		c.err = errS3Closed
+	}
+	if c.err != nil {
+		s.lock.Unlock()
+		file.Close()
+		os.Remove(c.localPath)
+		return c.err
+	}
+	c.uploading = true
+	c.uploaded = make(chan struct{})
+	s.uploads.Add(1)
+	s.lock.Unlock()
+
+	s.addLocal(c)
+	go func() {
+		defer s.uploads.Done()
+		err := c.upload(file, append(line, '\n'))
+		file.Close()
+
+		s.lock.Lock()
+		c.uploading = false
+		cleared := c.cleared
+		s.lock.Unlock()
+		close(c.uploaded)
+
+		if err != nil {
+			s.clearLocal(c)
+		} else if cleared {
+			c.removeObject()
+		}
+	}()
+	return nil
+}
+
+// Uploads the line with the response followed by the local copy
+func (c *S3Content) upload(file *os.File, line []byte) error {
+	// The payload is hashed first, so the local copy is read twice
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	hash := sha256.New()
+	hash.Write(line)
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	body := io.MultiReader(bytes.NewReader(line), file)
+
+	headers := http.Header{
+		"Content-Type":         []string{"application/octet-stream"},
+		"X-Amz-Meta-Cache-Key": []string{url.QueryEscape(c.key)},
+		"X-Amz-Meta-Stored":    []string{time.Now().UTC().Format(time.RFC3339)},
+		"X-Amz-Meta-Upload-Id": []string{c.uploadID},
+	}
+	response, err := c.storage.request("PUT", c.object, ioutil.NopCloser(body), int64(len(line))+c.size, hex.EncodeToString(hash.Sum(nil)), headers)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed uploading object %s, status %d", c.object, response.StatusCode)
+	}
+	return nil
+}
+
+/**
+ * Opens the local copy or streams the object from the bucket,
+ * copying it again to the local directory while it is read.
+ * It fails if the object was removed or replaced by other upload.
+ */
+func (c *S3Content) Open() (io.ReadCloser, error) {
+	if file, err := os.Open(c.localPath); err == nil {
+		c.storage.touchLocal(c)
+		return file, nil
+	}
+	if c.uploaded != nil {
+		// The local copy was removed before the object was uploaded
+		<-c.uploaded
+	}
+
+	response, err := c.storage.request("GET", c.object, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("failed downloading object %s, status %d", c.object, response.StatusCode)
+	}
+	if response.Header.Get("X-Amz-Meta-Upload-Id") != c.uploadID {
+		response.Body.Close()
+		return nil, fmt.Errorf("object %s was replaced", c.object)
+	}
+
+	// The body follows the line with the response
+	body := &s3Body{reader: bufio.NewReader(response.Body), body: response.Body}
+	if _, err := body.reader.ReadBytes('\n'); err != nil {
+		body.Close()
+		return nil, fmt.Errorf("failed downloading object %s, %v", c.object, err)
+	}
+
+	local, err := ioutil.TempFile(c.storage.LocalPath, "download")
+	if err != nil {
+		// It can still be streamed without a local copy
+		return body, nil
+	}
+	return &readThrough{body: body, local: local, content: c}, nil
+}
+
+// s3Body reads the body of an object after its first line
+type s3Body struct {
+	reader *bufio.Reader
+	body   io.Closer
+}
+
+func (b *s3Body) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *s3Body) Close() error {
+	return b.body.Close()
+}
+
+// Reads the whole body, from the local copy or the bucket. It is nil if it can't be read
+func (c *S3Content) Bytes() []byte {
+	reader, err := c.Open()
+	if err != nil {
+		return nil
+	}
+	defer reader.Close()
+
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil
+	}
+	return body
+}
+
+// Removes the object unless other upload replaced it, then it belongs to the new content
+func (c *S3Content) Clear() error {
+	if uploading := c.storage.clearLocal(c); uploading {
+		// It is removed when the upload finishes
+		return nil
+	}
+	return c.removeObject()
+}
+
+func (c *S3Content) removeObject() error {
+	response, err := c.storage.request("HEAD", c.object, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode == http.StatusNotFound || response.Header.Get("X-Amz-Meta-Upload-Id") != c.uploadID {
+		return nil
+	}
+
+	response, err = c.storage.request("DELETE", c.object, nil, 0, emptyPayloadHash, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent && response.StatusCode != http.StatusOK {
+		return errors.New("failed deleting object " + c.object + ", status " + strconv.Itoa(response.StatusCode))
+	}
+	return nil
+}
+
+// readThrough copies the object to a temporary file and makes it the local copy if it is read whole
+type readThrough struct {
+	body    io.ReadCloser
+	local   *os.File
+	content *S3Content
+	read    int64
+	failed  bool
+}
+
+func (r *readThrough) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && !r.failed {
+		if _, err := r.local.Write(p[:n]); err != nil {
+			r.failed = true
+		}
+	}
+	r.read += int64(n)
+	return n, err
+}
+
+func (r *readThrough) Close() error {
+	err := r.body.Close()
+	r.local.Close()
+	if r.failed || r.read != r.content.size || os.Rename(r.local.Name(), r.content.localPath) != nil {
+		os.Remove(r.local.Name())
+		return err
+	}
+	r.content.storage.addLocal(r.content)
+	return err
+}
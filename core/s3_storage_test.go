@@ -0,0 +1,436 @@
+package core
+
+import (
+	"bytes"
+	"encoding/xml"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+/**
+ * s3Server is an in-process stand-in of an S3 compatible server with one bucket.
+ */
+type s3Server struct {
+	*httptest.Server
+	bucket   string
+	lock     *sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]http.Header
+	requests map[string]int
+	failPut  bool
+}
+
+func startS3Server(bucket string) *s3Server {
+	server := &s3Server{
+		bucket:   bucket,
+		lock:     new(sync.Mutex),
+		objects:  map[string][]byte{},
+		metadata: map[string]http.Header{},
+		requests: map[string]int{},
+	}
+	server.Server = httptest.NewServer(http.HandlerFunc(server.serve))
+	return server
+}
+
+func (s *s3Server) Count(method string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[method]
+}
+
+// Returns the bodies of the objects, without the line with their response
+func (s *s3Server) Objects() map[string][]byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	objects := map[string][]byte{}
+	for name, object := range s.objects {
+		objects[name] = object[bytes.IndexByte(object, '\n')+1:]
+	}
+	return objects
+}
+
+// Lists one object per page, so the listing is always paginated
+func (s *s3Server) list(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for name := range s.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("continuation-token"))
+	result := s3ListResult{}
+	if start < len(names) {
+		result.Contents = append(result.Contents, struct{ Key string }{names[start]})
+	}
+	if start+1 < len(names) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 1)
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// Removes the objects, like a lifecycle rule of the bucket would
+func (s *s3Server) Expire() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.objects = map[string][]byte{}
+	s.metadata = map[string]http.Header{}
+}
+
+func (s *s3Server) serve(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests[r.Method]++
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") || r.Header.Get("X-Amz-Date") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if parts[0] != s.bucket {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if len(parts) == 1 {
+		if r.Method == "GET" && r.URL.Query().Get("list-type") == "2" {
+			s.list(w, r)
+		}
+		return
+	}
+
+	name := parts[1]
+	switch r.Method {
+	case "PUT":
+		if s.failPut {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		s.objects[name] = body
+		s.metadata[name] = http.Header{
+			"X-Amz-Meta-Cache-Key": r.Header["X-Amz-Meta-Cache-Key"],
+			"X-Amz-Meta-Stored":    r.Header["X-Amz-Meta-Stored"],
+			"X-Amz-Meta-Upload-Id": r.Header["X-Amz-Meta-Upload-Id"],
+		}
+	case "HEAD":
+		if _, ok := s.objects[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for header, values := range s.metadata[name] {
+			w.Header()[header] = values
+		}
+	case "GET":
+		body, ok := s.objects[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for header, values := range s.metadata[name] {
+			w.Header()[header] = values
+		}
+		w.Write(body)
+	case "DELETE":
+		delete(s.objects, name)
+		delete(s.metadata, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func buildS3Storage(t *testing.T, server *s3Server) *S3Storage {
+	localPath, err := ioutil.TempDir("", "caddy-cache-s3")
+	assert.NoError(t, err)
+	storage := NewS3Storage(server.URL, server.bucket, localPath)
+	assert.NoError(t, storage.Setup())
+	return storage
+}
+
+func buildS3Handler(t *testing.T, storage *S3Storage) (*CacheHandler, *TestHandler) {
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+	return handler, backend
+}
+
+/* Actual tests */
+
+func TestS3Content(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+
+	content, err := storage.NewContent("GET /file")
+	assert.NoError(t, err)
+	content.Write([]byte("Hello"))
+	content.Write([]byte(" World"))
+	assert.NoError(t, content.Close())
+	storage.uploads.Wait()
+
+	objects := server.Objects()
+	assert.Len(t, objects, 1)
+	for name, object := range objects {
+		assert.True(t, strings.HasPrefix(name, "acab9bbcb864e9b2"), "Objects are named by the hash of the key, got %s", name)
+		assert.Equal(t, "Hello World", string(object))
+		key, _ := url.QueryUnescape(server.metadata[name].Get("X-Amz-Meta-Cache-Key"))
+		assert.Equal(t, "GET /file", key)
+		assert.NotEmpty(t, server.metadata[name].Get("X-Amz-Meta-Stored"))
+	}
+
+	assert.Equal(t, []byte("Hello World"), content.Bytes())
+	assert.Equal(t, 0, server.Count("GET"), "Hits are read from the local copy")
+	assert.Equal(t, int64(11), storage.LocalUsed())
+
+	assert.NoError(t, content.Clear())
+	assert.Empty(t, server.Objects())
+	assert.Equal(t, int64(0), storage.LocalUsed())
+	_, err = os.Stat(content.(*S3Content).localPath)
+	assert.True(t, os.IsNotExist(err), "The local copy must be removed")
+}
+
+func TestS3LocalReadThrough(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+	storage.LocalBudget = 12
+
+	first, _ := storage.NewContent("GET /first")
+	first.Write([]byte("first body"))
+	assert.NoError(t, first.Close())
+	second, _ := storage.NewContent("GET /second")
+	second.Write([]byte("second body"))
+	assert.NoError(t, second.Close())
+	assert.Equal(t, int64(11), storage.LocalUsed(), "The least recently used copy must be removed")
+
+	assert.Equal(t, []byte("first body"), first.Bytes())
+	assert.Equal(t, 1, server.Count("GET"), "The object is streamed from the bucket")
+	assert.Equal(t, int64(10), storage.LocalUsed(), "The object is copied again to the local directory")
+
+	assert.Equal(t, []byte("first body"), first.Bytes())
+	assert.Equal(t, 1, server.Count("GET"), "The copy must be used")
+}
+
+func TestS3HandlerStreamsHits(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+	storage.LocalBudget = 1
+
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+
+	responses := makeNRequests(handler, 3, buildGetRequest("http://somehost.com/file"))
+	assert.Equal(t, 1, backend.TimesCalled())
+	for _, response := range responses {
+		body, _ := ioutil.ReadAll(response.Body)
+		assert.Equal(t, "Hello :)", string(body))
+	}
+	assert.Equal(t, 1, server.Count("PUT"))
+	assert.True(t, server.Count("GET") > 0, "Hits without a local copy are streamed from the bucket")
+}
+
+func TestS3ObjectsAreRestoredAfterRestart(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+
+	handler, backend := buildS3Handler(t, storage)
+	backend.ResponseHeaders.Set("X-Custom", "value")
+	backend.ResponseBody = []byte("Stored before")
+	req := buildGetRequest("http://somehost.com/file")
+	makeNRequests(handler, 1, req)
+
+	var old *HttpCacheEntry
+	handler.Cache.GetOrSet(getKey(req), requestVariant(req, nil), func(found *HttpCacheEntry) (*HttpCacheEntry, error) {
+		old = found
+		return nil, nil
+	})
+
+	// Objects of responses that are not public or expired are not restored
+	private, _ := storage.NewContent("GET /private")
+	private.Write([]byte("Private"))
+	assert.NoError(t, private.Close())
+	expired, _ := storage.NewContent("GET /expired")
+	expired.(*S3Content).SetEntry("", &HttpCacheEntry{
+		Expiration: time.Now().UTC().Add(-time.Hour),
+		Request:    &Request{HeaderMap: http.Header{}},
+		Response:   &Response{Code: http.StatusOK, HeaderMap: http.Header{}},
+	})
+	expired.Write([]byte("Expired"))
+	assert.NoError(t, expired.Close())
+	assert.NoError(t, storage.Close())
+	assert.Len(t, server.Objects(), 3)
+
+	restarted := buildS3Storage(t, server)
+	defer os.RemoveAll(restarted.LocalPath)
+	handler, backend = buildS3Handler(t, restarted)
+	responses := makeNRequests(handler, 1, req)
+	assert.Equal(t, 0, backend.TimesCalled(), "The response stored before the restart must be restored")
+	body, _ := ioutil.ReadAll(responses[0].Body)
+	assert.Equal(t, "Stored before", string(body))
+	assert.Equal(t, http.StatusOK, responses[0].StatusCode)
+	assert.Equal(t, "value", responses[0].Header.Get("X-Custom"))
+	assert.Len(t, server.Objects(), 2, "The objects of expired responses are removed")
+
+	// Storing the response again replaces its object
+	content, _ := restarted.NewContent(getKey(req))
+	content.(*S3Content).SetEntry(requestVariant(req, nil)(old.Vary()), old)
+	content.Write([]byte("Stored after"))
+	assert.NoError(t, content.Close())
+	assert.NoError(t, restarted.Close())
+
+	_, err := old.Response.Body.(*S3Content).Open()
+	assert.Error(t, err, "The replaced object must not be served")
+	assert.NoError(t, old.Clear())
+	assert.Len(t, server.Objects(), 2, "The new object must not be removed")
+}
+
+func TestS3MissingObjectIsFetchedAgain(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+	storage.LocalBudget = 1
+
+	cache := NewCache(storage)
+	assert.NoError(t, cache.Setup())
+	handler, backend := buildHandlerWithCache(cache)
+	handler.Config.StatusHeader = "X-Cache-Status"
+	backend.ResponseHeaders = http.Header{"Cache-Control": []string{"max-age=60"}}
+
+	req := buildGetRequest("http://somehost.com/file")
+	makeNRequests(handler, 1, req)
+	storage.uploads.Wait()
+	server.Expire()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"))
+	assert.Equal(t, "Hello :)", w.Body.String(), "Missing objects are fetched again instead of sent empty")
+	assert.Equal(t, 2, backend.TimesCalled())
+}
+
+func TestS3UploadFailed(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+	server.failPut = true
+
+	content, _ := storage.NewContent("GET /file")
+	content.Write([]byte("Hello"))
+	assert.NoError(t, content.Close(), "The object is uploaded in background")
+	storage.uploads.Wait()
+	files, _ := ioutil.ReadDir(storage.LocalPath)
+	assert.Empty(t, files, "The local copy must be removed")
+	_, err := content.(*S3Content).Open()
+	assert.Error(t, err)
+
+	handler, backend := buildS3Handler(t, storage)
+	req := buildGetRequest("http://somehost.com/file")
+	for i := 0; i < 2; i++ {
+		responses := makeNRequests(handler, 1, req)
+		storage.uploads.Wait()
+		body, _ := ioutil.ReadAll(responses[0].Body)
+		assert.Equal(t, "Hello :)", string(body), i)
+	}
+	assert.Equal(t, 2, backend.TimesCalled(), "Responses are fetched again if they can't be uploaded")
+}
+
+func TestS3UploadIsNotWaited(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+
+	// The bucket doesn't answer until the response is served
+	handler, backend := buildS3Handler(t, storage)
+	server.lock.Lock()
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, buildGetRequest("http://somehost.com/file"))
+	assert.Equal(t, "Hello :)", w.Body.String())
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, buildGetRequest("http://somehost.com/file"))
+	assert.Equal(t, "Hello :)", w.Body.String(), "Hits read the local copy while it is uploaded")
+	server.lock.Unlock()
+
+	assert.NoError(t, storage.Close())
+	assert.Equal(t, 1, backend.TimesCalled())
+	assert.Len(t, server.Objects(), 1)
+}
+
+func TestS3ClearWhileUploading(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+
+	server.lock.Lock()
+	content, _ := storage.NewContent("GET /file")
+	content.Write([]byte("Hello"))
+	assert.NoError(t, content.Close())
+	assert.NoError(t, content.Clear())
+	server.lock.Unlock()
+
+	storage.uploads.Wait()
+	assert.Empty(t, server.Objects(), "The object is removed once it is uploaded")
+}
+
+func TestS3CloseRemovesLocalCopies(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := buildS3Storage(t, server)
+	defer os.RemoveAll(storage.LocalPath)
+
+	content, _ := storage.NewContent("GET /file")
+	content.Write([]byte("Hello"))
+	assert.NoError(t, content.Close())
+	assert.NoError(t, storage.Close())
+
+	files, _ := ioutil.ReadDir(storage.LocalPath)
+	assert.Empty(t, files, "The local copies must be removed")
+	assert.Len(t, server.Objects(), 1, "The objects are kept in the bucket")
+}
+
+func TestS3MissingBucket(t *testing.T) {
+	server := startS3Server("cache")
+	defer server.Close()
+	storage := NewS3Storage(server.URL, "other", os.TempDir())
+	assert.Error(t, storage.Setup())
+}
+
+func TestS3Directive(t *testing.T) {
+	config := DefaultConfig()
+	assert.NoError(t, ApplyDirective(config, "storage", []string{"s3", "minio:9000", "cache"}))
+	storage := config.Storage.(*S3Storage)
+	assert.Equal(t, "https://minio:9000", storage.Endpoint)
+	assert.Equal(t, "cache", storage.Bucket)
+	assert.Equal(t, DEFAULT_S3_LOCAL_BUDGET, storage.LocalBudget)
+
+	assert.NoError(t, ApplyDirective(config, "storage", []string{"s3", "http://minio:9000/", "cache", "/tmp/s3", "10MB"}))
+	storage = config.Storage.(*S3Storage)
+	assert.Equal(t, "http://minio:9000", storage.Endpoint)
+	assert.Equal(t, "/tmp/s3", storage.LocalPath)
+	assert.Equal(t, int64(10*1024*1024), storage.LocalBudget)
+
+	assert.Error(t, ApplyDirective(config, "storage", []string{"s3", "minio:9000"}))
+	assert.Error(t, ApplyDirective(config, "storage", []string{"s3", "minio:9000", "cache", "/tmp/s3", "lots"}))
+}
@@ -0,0 +1,57 @@
+package core
+
+import (
+	"net/http"
+	"time"
+)
+
+/**
+ * A SharedIndex shares the stored responses between many instances of the cache.
+ * Requests not found in the cache are searched in it before going upstream,
+ * and the responses stored are published to it, like RESPStorage does.
+ * Entries whose body can't be read are removed.
+ */
+type SharedIndex interface {
+	Lookup(key string, variant VariantFunc) (*HttpCacheEntry, error)
+	Publish(key string, variant VariantFunc, entry *HttpCacheEntry, ttl time.Duration) error
+	Remove(key string, variant VariantFunc, entry *HttpCacheEntry) error
+}
+
+// Shares the responses stored through the storage if it is a SharedIndex, it is not shared otherwise
+func (config *Config) shareThrough(storage Storage) {
+	config.Index = nil
+	if index, ok := storage.(SharedIndex); ok {
+		config.Index = index
+	}
+}
+
+// Returns the fresh entry published by other instance or nil, errors are logged as misses
+func (handler *CacheHandler) lookupShared(r *http.Request, key string) *HttpCacheEntry {
+	entry, err := handler.Config.Index.Lookup(key, requestVariant(r, handler.Config.VaryNormalizers))
+	if err != nil {
+		handler.Config.Logger.Warning("failed searching shared index", LogFields{"key": key, "error": err})
+		return nil
+	}
+	if entry == nil || !entry.Expiration.After(time.Now().UTC()) {
+		return nil
+	}
+	return entry
+}
+
+// Publishes the entry if it is stored, it is kept while it is stale like in the cache
+func (handler *CacheHandler) publishShared(r *http.Request, key string, entry *HttpCacheEntry) {
+	if !entry.isPublic {
+		return
+	}
+	ttl := entry.Expiration.Sub(time.Now().UTC()) + handler.Config.StaleTTL
+	if err := handler.Config.Index.Publish(key, requestVariant(r, handler.Config.VaryNormalizers), entry, ttl); err != nil {
+		handler.Config.Logger.Error("failed publishing to shared index", LogFields{"key": key, "error": err})
+	}
+}
+
+// Removes the entry whose body can't be read, so other instances don't use it either
+func (handler *CacheHandler) removeShared(r *http.Request, key string, entry *HttpCacheEntry) {
+	if err := handler.Config.Index.Remove(key, requestVariant(r, handler.Config.VaryNormalizers), entry); err != nil {
+		handler.Config.Logger.Error("failed removing from shared index", LogFields{"key": key, "error": err})
+	}
+}
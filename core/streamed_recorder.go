@@ -0,0 +1,451 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+/**
+* Streamed Recorder is really similar to http.httpRecorder
+* But this implementation is created with a ResponseWriter
+* And sends the response to downstream at the same time
+* the response is being recorded avoiding having to wait to
+* have all the response.
+ */
+
+type StreamedRecorder struct {
+	Code      int         // the HTTP response code from WriteHeader
+	HeaderMap http.Header // the HTTP response headers
+	Body      StorageContent
+	Flushed   bool
+
+	// Bytes written to Body
+	bodySize int64
+
+	// Headers recorded but not sent downstream
+	HiddenHeaders []string
+
+	// The connection was taken by the handler, like in websockets
+	hijacked bool
+
+	result      *http.Response // cache of Result's return value
+	snapHeader  http.Header    // snapshot of HeaderMap at first Write
+	wroteHeader bool
+
+	w http.ResponseWriter // This is the downstream
+
+	calledWriteListener bool
+	firstWriteListener  func(int, http.Header) error
+}
+
+// NewRecorder returns an initialized StreamedRecorder.
+func NewStreamedRecorder(w http.ResponseWriter) *StreamedRecorder {
+	return &StreamedRecorder{
+		HeaderMap:           w.Header(),
+		Body:                nil,
+		Code:                200,
+		firstWriteListener:  nil,
+		w:                   w,
+		calledWriteListener: false,
+	}
+}
+
+// DefaultRemoteAddr is the default remote address to return in RemoteAddr if
+// an explicit DefaultRemoteAddr isn't set on StreamedRecorder.
+const DefaultRemoteAddr = "1.2.3.4"
+
+// Header returns the response headers.
+func (rw *StreamedRecorder) Header() http.Header {
+	return rw.w.Header()
+}
+
+// writeHeader writes a header if it was not written yet and
+// detects Content-Type if needed.
+//
+// bytes or str are the beginning of the response body.
+// We pass both to avoid unnecessarily generate garbage
+// in rw.WriteString which was created for performance reasons.
+// Non-nil bytes win.
+func (rw *StreamedRecorder) writeHeader(b []byte, str string) {
+	if rw.wroteHeader {
+		return
+	}
+	if len(str) > 512 {
+		str = str[:512]
+	}
+
+	m := rw.Header()
+
+	_, hasType := m["Content-Type"]
+	hasTE := m.Get("Transfer-Encoding") != ""
+	if !hasType && !hasTE {
+		if b == nil {
+			b = []byte(str)
+		}
+		m.Set("Content-Type", http.DetectContentType(b))
+	}
+
+	rw.WriteHeader(200)
+}
+
+// Write always succeeds and writes to rw.Body, if not nil.
+func (rw *StreamedRecorder) Write(buf []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.writeHeader(buf, "")
+	}
+
+	if !rw.calledWriteListener {
+		rw.calledWriteListener = true
+		if rw.firstWriteListener != nil {
+			rw.firstWriteListener(rw.Code, rw.snapHeader)
+		}
+	}
+
+	if rw.Body != nil {
+		rw.Body.Write(buf)
+		rw.bodySize += int64(len(buf))
+	}
+
+	return rw.w.Write(buf)
+}
+
+func (rw *StreamedRecorder) UpdateBodyWriter(bw StorageContent) {
+	rw.Body = bw
+}
+
+// WriteHeader sets rw.Code. After it is called, changing rw.Header
+// will not affect rw.HeaderMap.
+func (rw *StreamedRecorder) WriteHeader(code int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.Code = code
+	rw.wroteHeader = true
+	rw.snapHeader = cloneHeader(rw.w.Header())
+	for _, header := range rw.HiddenHeaders {
+		rw.w.Header().Del(header)
+	}
+	rw.w.WriteHeader(code)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for k, vv := range h {
+		vv2 := make([]string, len(vv))
+		copy(vv2, vv)
+		h2[k] = vv2
+	}
+	return h2
+}
+
+// Flush sets rw.Flushed to true.
+func (rw *StreamedRecorder) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(200)
+	}
+
+	if f, ok := rw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	rw.Flushed = true
+}
+
+func (rw *StreamedRecorder) SetFirstWriteListener(fn func(int, http.Header) error) {
+	rw.firstWriteListener = fn
+}
+
+// Result returns the response generated by the handler.
+//
+// The returned Response will have at least its StatusCode,
+// Header and optionally Body populated.
+// More fields may be populated in the future, so callers should
+// not DeepEqual the result in tests.
+//
+// The Response.Header is a snapshot of the headers at the time of the
+// first write call, or at the time of this call, if the handler never
+// did a write.
+//
+// Result must only be called after the handler has finished running.
+func (rw *StreamedRecorder) Result() (*http.Response, StorageContent) {
+	if rw.result != nil {
+		return rw.result, nil
+	}
+	if rw.snapHeader == nil {
+		rw.snapHeader = cloneHeader(rw.w.Header())
+	}
+	res := &http.Response{
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		StatusCode: rw.Code,
+		Header:     rw.snapHeader,
+	}
+	rw.result = res
+	if res.StatusCode == 0 {
+		res.StatusCode = 200
+	}
+	res.Status = http.StatusText(res.StatusCode)
+	res.Trailer = rw.trailers()
+
+	// Trailers set with the prefix before the first write are not headers
+	for k := range res.Header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(res.Header, k)
+		}
+	}
+
+	return res, rw.Body
+}
+
+/**
+ * Returns the trailers set by the handler, the ones declared in the Trailer header
+ * and the ones set with http.TrailerPrefix. Returns nil if there are none.
+ * Declared names only take the values set after the headers were sent,
+ * the ones in the snapshot were already sent as headers.
+ */
+func (rw *StreamedRecorder) trailers() http.Header {
+	var trailers http.Header
+	add := func(name string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		if trailers == nil {
+			trailers = http.Header{}
+		}
+		for _, v := range values {
+			trailers.Add(name, v)
+		}
+	}
+
+	header := rw.w.Header()
+	for _, declared := range rw.snapHeader["Trailer"] {
+		for _, name := range strings.Split(declared, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if values, ok := header[name]; ok && name != "" {
+				add(name, valuesAfterSnapshot(rw.snapHeader[name], values))
+			}
+		}
+	}
+	for k, values := range header {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			add(http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix)), values)
+		}
+	}
+	return trailers
+}
+
+// Returns the values that are not in the snapshot, all of them if the snapshot ones were replaced
+func valuesAfterSnapshot(snapshot, values []string) []string {
+	if len(snapshot) > len(values) {
+		return values
+	}
+	for i, v := range snapshot {
+		if values[i] != v {
+			return values
+		}
+	}
+	return values[len(snapshot):]
+}
+
+// The methods every wrapped recorder has, Flush does nothing when downstream can't flush
+type flushWriter interface {
+	http.ResponseWriter
+	http.Flusher
+}
+
+/**
+ * Returns the recorder as a ResponseWriter that only implements the optional interfaces
+ * of downstream, like httpsnoop does. Handlers find them with type assertions,
+ * so the recorder itself would make them use features that are not there.
+ */
+func (rw *StreamedRecorder) Wrap() http.ResponseWriter {
+	const (
+		hijacker = 1 << iota
+		closeNotifier
+		pusher
+		readerFrom
+	)
+	supported := 0
+	if _, ok := rw.w.(http.Hijacker); ok {
+		supported |= hijacker
+	}
+	if _, ok := rw.w.(http.CloseNotifier); ok {
+		supported |= closeNotifier
+	}
+	if _, ok := rw.w.(http.Pusher); ok {
+		supported |= pusher
+	}
+	if _, ok := rw.w.(io.ReaderFrom); ok {
+		supported |= readerFrom
+	}
+
+	switch supported {
+	case hijacker:
+		return struct {
+			flushWriter
+			http.Hijacker
+		}{rw, rw}
+	case closeNotifier:
+		return struct {
+			flushWriter
+			http.CloseNotifier
+		}{rw, rw}
+	case hijacker | closeNotifier:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.CloseNotifier
+		}{rw, rw, rw}
+	case pusher:
+		return struct {
+			flushWriter
+			http.Pusher
+		}{rw, rw}
+	case hijacker | pusher:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.Pusher
+		}{rw, rw, rw}
+	case closeNotifier | pusher:
+		return struct {
+			flushWriter
+			http.CloseNotifier
+			http.Pusher
+		}{rw, rw, rw}
+	case hijacker | closeNotifier | pusher:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.CloseNotifier
+			http.Pusher
+		}{rw, rw, rw, rw}
+	case readerFrom:
+		return struct {
+			flushWriter
+			io.ReaderFrom
+		}{rw, rw}
+	case hijacker | readerFrom:
+		return struct {
+			flushWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{rw, rw, rw}
+	case closeNotifier | readerFrom:
+		return struct {
+			flushWriter
+			http.CloseNotifier
+			io.ReaderFrom
+		}{rw, rw, rw}
+	case hijacker | closeNotifier | readerFrom:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.CloseNotifier
+			io.ReaderFrom
+		}{rw, rw, rw, rw}
+	case pusher | readerFrom:
+		return struct {
+			flushWriter
+			http.Pusher
+			io.ReaderFrom
+		}{rw, rw, rw}
+	case hijacker | pusher | readerFrom:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.Pusher
+			io.ReaderFrom
+		}{rw, rw, rw, rw}
+	case closeNotifier | pusher | readerFrom:
+		return struct {
+			flushWriter
+			http.CloseNotifier
+			http.Pusher
+			io.ReaderFrom
+		}{rw, rw, rw, rw}
+	case hijacker | closeNotifier | pusher | readerFrom:
+		return struct {
+			flushWriter
+			http.Hijacker
+			http.CloseNotifier
+			http.Pusher
+			io.ReaderFrom
+		}{rw, rw, rw, rw, rw}
+	}
+	return struct{ flushWriter }{rw}
+}
+
+var errNotHijacker = errors.New("the downstream ResponseWriter is not a Hijacker")
+
+// Hijack lets handlers like websocket take the connection
+// Hijacked responses can't be cached
+func (rw *StreamedRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotHijacker
+	}
+	rw.hijacked = true
+	return hijacker.Hijack()
+}
+
+func (rw *StreamedRecorder) Hijacked() bool {
+	return rw.hijacked
+}
+
+// CloseNotify returns a channel that never receives if downstream is not a CloseNotifier
+func (rw *StreamedRecorder) CloseNotify() <-chan bool {
+	if notifier, ok := rw.w.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+func (rw *StreamedRecorder) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := rw.w.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+/**
+ * ReadFrom lets handlers like static send files efficiently.
+ * The first bytes are written as usual to decide if the response is recorded,
+ * if it isn't the rest is sent with the ReadFrom of downstream.
+ */
+func (rw *StreamedRecorder) ReadFrom(src io.Reader) (int64, error) {
+	written := int64(0)
+	if !rw.calledWriteListener {
+		buf := make([]byte, 512)
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return int64(n), err
+			}
+		}
+		written = int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if readerFrom, ok := rw.w.(io.ReaderFrom); ok && rw.Body == nil {
+		n, err := readerFrom.ReadFrom(src)
+		return written + n, err
+	}
+
+	n, err := io.Copy(writerOnly{rw}, src)
+	return written + n, err
+}
+
+// writerOnly hides the ReadFrom of the recorder so io.Copy uses Write
+type writerOnly struct {
+	io.Writer
+}
@@ -0,0 +1,360 @@
+package core
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+ *
+ * Tiered Storage
+ *
+ */
+
+const DEFAULT_TIERED_SMALL_OBJECT_SIZE = int64(64 * 1024)
+const DEFAULT_TIERED_PROMOTE_HITS = 3
+
+// HitAwareContent is implemented by contents that can be moved between
+// storages depending on how many times they were used
+type HitAwareContent interface {
+	Hit(hits int)
+}
+
+/**
+ * TieredStorage keeps small or frequently hit contents in memory
+ * up to a budget. Larger or colder contents are stored on disk.
+ * Contents on disk are promoted to memory when they reach PromoteHits
+ * and the coldest contents in memory are demoted to make room for them.
+ * The lock of a content is always taken before the lock of the storage,
+ * and the lock of the storage is never held while a content is locked by it.
+ */
+type TieredStorage struct {
+	memory Storage
+	disk   Storage
+	budget int64
+
+	// Objects up to this size are written directly to memory
+	SmallObjectSize int64
+	// Hits needed to move a content from disk to memory
+	PromoteHits int
+
+	// This lock protects used and resident
+	lock     *sync.Mutex
+	used     int64
+	resident map[*TieredContent]struct{}
+}
+
+type TieredContent struct {
+	storage *TieredStorage
+	key     string
+
+	// This lock protects memory, disk and reserved
+	// The content is moved between memory and disk while it is being used.
+	// Replaced memory buffers are released by the GC when nobody reads them,
+	// replaced disk contents are kept until Clear is called.
+	lock     *sync.RWMutex
+	memory   StorageContent
+	disk     StorageContent
+	reserved int64
+	closed   bool
+
+	// It must be accessed atomically, so the storage reads it without locking the content
+	hits int64
+}
+
+func NewTieredStorage(budget int64, path string) *TieredStorage {
+	return &TieredStorage{
+		memory:          NewMemoryStorage(),
+		disk:            NewMMapStorage(path),
+		budget:          budget,
+		SmallObjectSize: DEFAULT_TIERED_SMALL_OBJECT_SIZE,
+		PromoteHits:     DEFAULT_TIERED_PROMOTE_HITS,
+		lock:            new(sync.Mutex),
+		resident:        make(map[*TieredContent]struct{}),
+	}
+}
+
+func (s *TieredStorage) Setup() error {
+	if err := s.memory.Setup(); err != nil {
+		return err
+	}
+	return s.disk.Setup()
+}
+
+// Closes the memory and disk storages if they hold resources
+func (s *TieredStorage) Close() error {
+	var err error
+	for _, storage := range []Storage{s.memory, s.disk} {
+		if closer, ok := storage.(io.Closer); ok {
+			if closeErr := closer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+func (s *TieredStorage) NewContent(key string) (StorageContent, error) {
+	memory, err := s.memory.NewContent(key)
+	if err != nil {
+		return nil, err
+	}
+	return &TieredContent{
+		storage: s,
+		key:     key,
+		lock:    new(sync.RWMutex),
+		memory:  memory,
+	}, nil
+}
+
+// reserve tries to take size bytes of the memory budget
+func (s *TieredStorage) reserve(size int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.used+size > s.budget {
+		return false
+	}
+	s.used += size
+	return true
+}
+
+func (s *TieredStorage) release(size int64) {
+	s.lock.Lock()
+	s.used -= size
+	s.lock.Unlock()
+}
+
+// Used returns how many bytes of the memory budget are in use
+func (s *TieredStorage) Used() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.used
+}
+
+func (s *TieredStorage) forget(content *TieredContent) {
+	s.lock.Lock()
+	delete(s.resident, content)
+	s.lock.Unlock()
+}
+
+/**
+ * Moves content to memory if there is room for it.
+ * If there is not, contents in memory with less hits are demoted to disk.
+ * The storage lock is released while the contents are demoted or loaded.
+ */
+func (s *TieredStorage) promote(content *TieredContent, size int64, hits int) {
+	if size > s.budget {
+		return
+	}
+
+	s.lock.Lock()
+	for s.used+size > s.budget {
+		coldest, coldestHits := s.coldest()
+		if coldest == nil || coldestHits >= hits {
+			s.lock.Unlock()
+			return
+		}
+		delete(s.resident, coldest)
+		s.lock.Unlock()
+
+		released, ok := coldest.demote()
+
+		s.lock.Lock()
+		if !ok {
+			s.resident[coldest] = struct{}{}
+			s.lock.Unlock()
+			return
+		}
+		s.used -= released
+	}
+	// The memory is taken before loading, so other promotions don't use it
+	s.used += size
+	s.lock.Unlock()
+
+	if !content.load() {
+		s.release(size)
+		return
+	}
+	s.lock.Lock()
+	s.resident[content] = struct{}{}
+	s.lock.Unlock()
+}
+
+func (s *TieredStorage) coldest() (*TieredContent, int) {
+	var coldest *TieredContent
+	coldestHits := 0
+	for content := range s.resident {
+		hits := content.Hits()
+		if coldest == nil || hits < coldestHits {
+			coldest = content
+			coldestHits = hits
+		}
+	}
+	return coldest, coldestHits
+}
+
+func (c *TieredContent) Write(p []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.disk == nil {
+		size := int64(len(p))
+		if c.reserved+size <= c.storage.SmallObjectSize && c.storage.reserve(size) {
+			c.reserved += size
+			return c.memory.Write(p)
+		}
+		if err := c.spill(); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.disk.Write(p)
+}
+
+// spill moves what was written to memory to a new disk content
+func (c *TieredContent) spill() error {
+	disk, err := c.storage.disk.NewContent(c.key)
+	if err != nil {
+		return err
+	}
+	if _, err := disk.Write(c.memory.Bytes()); err != nil {
+		disk.Clear()
+		return err
+	}
+	c.disk = disk
+	c.memory = nil
+	c.storage.release(c.reserved)
+	c.reserved = 0
+	return nil
+}
+
+func (c *TieredContent) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	if c.disk != nil {
+		defer c.lock.Unlock()
+		return c.disk.Close()
+	}
+	err := c.memory.Close()
+	reserved := c.reserved
+	c.lock.Unlock()
+
+	// Empty contents don't use memory so they are never demoted
+	if reserved == 0 {
+		return err
+	}
+
+	c.storage.lock.Lock()
+	c.storage.resident[c] = struct{}{}
+	c.storage.lock.Unlock()
+	return err
+}
+
+func (c *TieredContent) Bytes() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.memory != nil {
+		return c.memory.Bytes()
+	}
+	return c.disk.Bytes()
+}
+
+func (c *TieredContent) Hit(hits int) {
+	atomic.StoreInt64(&c.hits, int64(hits))
+
+	c.lock.Lock()
+	shouldPromote := c.closed && c.memory == nil && hits >= c.storage.PromoteHits
+	size := int64(0)
+	if shouldPromote {
+		size = int64(len(c.disk.Bytes()))
+	}
+	c.lock.Unlock()
+
+	if shouldPromote {
+		c.storage.promote(c, size, hits)
+	}
+}
+
+func (c *TieredContent) Hits() int {
+	return int(atomic.LoadInt64(&c.hits))
+}
+
+// InMemory returns if the content is currently being served from memory
+func (c *TieredContent) InMemory() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.memory != nil
+}
+
+// load copies the disk content to memory. The disk content is kept
+// because the content may still be read and it is reused if it is demoted.
+func (c *TieredContent) load() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.memory != nil || c.disk == nil {
+		return false
+	}
+
+	memory, err := c.storage.memory.NewContent(c.key)
+	if err != nil {
+		return false
+	}
+	if _, err := memory.Write(c.disk.Bytes()); err != nil {
+		return false
+	}
+	memory.Close()
+	c.memory = memory
+	c.reserved = int64(len(memory.Bytes()))
+	return true
+}
+
+// demote moves the content to disk and returns the released memory
+func (c *TieredContent) demote() (int64, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.memory == nil {
+		return 0, true
+	}
+
+	if c.disk == nil {
+		disk, err := c.storage.disk.NewContent(c.key)
+		if err != nil {
+			return 0, false
+		}
+		if _, err := disk.Write(c.memory.Bytes()); err != nil {
+			disk.Clear()
+			return 0, false
+		}
+		if err := disk.Close(); err != nil {
+			disk.Clear()
+			return 0, false
+		}
+		c.disk = disk
+	}
+
+	released := c.reserved
+	c.memory = nil
+	c.reserved = 0
+	return released, true
+}
+
+func (c *TieredContent) Clear() error {
+	c.storage.forget(c)
+
+	c.lock.Lock()
+	reserved := c.reserved
+	c.reserved = 0
+	c.memory = nil
+	var err error
+	if c.disk != nil {
+		err = c.disk.Clear()
+	}
+	c.lock.Unlock()
+
+	c.storage.release(reserved)
+	return err
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+func buildTieredStorage(budget int64) *TieredStorage {
+	storage := NewTieredStorage(budget, "/tmp/caddy-cache-tests")
+	storage.SmallObjectSize = 10
+	storage.PromoteHits = 2
+	storage.Setup()
+	return storage
+}
+
+func writeTieredContent(t *testing.T, storage *TieredStorage, content []byte) *TieredContent {
+	stored, err := storage.NewContent("key")
+	assert.NoError(t, err, "Failed creating new content")
+	stored.Write(content)
+	stored.Close()
+	return stored.(*TieredContent)
+}
+
+/* Actual tests */
+
+func TestTieredSmallObjectsInMemory(t *testing.T) {
+	storage := buildTieredStorage(100)
+
+	content := writeTieredContent(t, storage, []byte("Hello"))
+	assert.True(t, content.InMemory(), "Small content should be in memory")
+	assert.Equal(t, []byte("Hello"), content.Bytes())
+	assert.Equal(t, int64(5), storage.Used())
+
+	content.Clear()
+	assert.Equal(t, int64(0), storage.Used(), "Memory was not released")
+}
+
+func TestTieredLargeObjectsOnDisk(t *testing.T) {
+	storage := buildTieredStorage(100)
+
+	content := writeTieredContent(t, storage, []byte("Some larger content"))
+	assert.False(t, content.InMemory(), "Large content should be on disk")
+	assert.Equal(t, []byte("Some larger content"), content.Bytes())
+	assert.Equal(t, int64(0), storage.Used())
+	content.Clear()
+}
+
+func TestTieredSpillsWhenBudgetIsFull(t *testing.T) {
+	storage := buildTieredStorage(8)
+
+	a := writeTieredContent(t, storage, []byte("Hello"))
+	b := writeTieredContent(t, storage, []byte("World"))
+
+	assert.True(t, a.InMemory(), "First content should be in memory")
+	assert.False(t, b.InMemory(), "Second content does not fit in memory")
+	assert.Equal(t, []byte("World"), b.Bytes())
+
+	a.Clear()
+	b.Clear()
+}
+
+func TestTieredPromotionAndDemotion(t *testing.T) {
+	storage := buildTieredStorage(25)
+	storage.SmallObjectSize = 20
+
+	cold := writeTieredContent(t, storage, []byte("Cold content"))
+	hot := writeTieredContent(t, storage, bytes.Repeat([]byte("h"), 20))
+	assert.True(t, cold.InMemory())
+	assert.False(t, hot.InMemory())
+
+	hot.Hit(1)
+	assert.False(t, hot.InMemory(), "Content should not be promoted before PromoteHits")
+
+	hot.Hit(2)
+	assert.True(t, hot.InMemory(), "Hot content should have been promoted")
+	assert.False(t, cold.InMemory(), "Cold content should have been demoted")
+	assert.Equal(t, []byte("Cold content"), cold.Bytes())
+	assert.Equal(t, bytes.Repeat([]byte("h"), 20), hot.Bytes())
+	assert.Equal(t, int64(20), storage.Used())
+
+	cold.Clear()
+	hot.Clear()
+	assert.Equal(t, int64(0), storage.Used())
+}
+
+func TestTieredHitsFromCache(t *testing.T) {
+	storage := buildTieredStorage(100)
+	m := NewCache(storage)
+	m.Setup()
+
+	content := writeTieredContent(t, storage, []byte("Some larger content"))
+	push(m, "a", &HttpCacheEntry{
+		Response:   &Response{Body: content},
+		Expiration: time.Now().UTC().Add(time.Duration(5) * time.Second),
+	})
+
+	for i := 0; i < 2; i++ {
+		m.GetOrSet("a", noVariant, func(entry *HttpCacheEntry) (*HttpCacheEntry, error) {
+			return nil, nil
+		})
+	}
+
+	assert.True(t, content.InMemory(), "Content should have been promoted after being hit")
+}
+
+func TestTieredConcurrentPromotionsAndWrites(t *testing.T) {
+	storage := buildTieredStorage(40)
+	storage.SmallObjectSize = 20
+
+	contents := []*TieredContent{}
+	for i := 0; i < 4; i++ {
+		contents = append(contents, writeTieredContent(t, storage, bytes.Repeat([]byte("c"), 15)))
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			contents[i%len(contents)].Hit(i)
+		}(i)
+		go func() {
+			defer wg.Done()
+			content := writeTieredContent(t, storage, bytes.Repeat([]byte("w"), 15))
+			content.Clear()
+		}()
+	}
+	wg.Wait()
+
+	for _, content := range contents {
+		assert.Equal(t, bytes.Repeat([]byte("c"), 15), content.Bytes())
+		content.Clear()
+	}
+	assert.Equal(t, int64(0), storage.Used(), "Memory was not released")
+}
@@ -0,0 +1,217 @@
+package core
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/**
+ * A VaryNormalizer reduces the values of a request header to the value
+ * used to compare requests when the response has that header in Vary.
+ * Requests with different headers but the same normalized value share
+ * the same cached response.
+ */
+type VaryNormalizer interface {
+	Normalize(values []string) string
+
+	// Returns true if the normalized value can be sent upstream instead
+	// of the original header, so the response matches the normalized value
+	Rewrites() bool
+
+	// Returns a header value for each normalized value, used to warm every variant
+	Variants() []string
+}
+
+var DEFAULT_SUPPORTED_ENCODINGS = []string{"gzip"}
+
+const (
+	DEVICE_MOBILE  = "mobile"
+	DEVICE_TABLET  = "tablet"
+	DEVICE_DESKTOP = "desktop"
+	DEVICE_BOT     = "bot"
+)
+
+/* Accept-Encoding */
+
+// Collapses Accept-Encoding to the best of the supported encodings
+// or identity if none of them is accepted
+type AcceptEncodingNormalizer struct {
+	Supported []string
+}
+
+func (n *AcceptEncodingNormalizer) Normalize(values []string) string {
+	best := "identity"
+	bestQuality := float64(0)
+	for _, encoding := range n.Supported {
+		quality := encodingQuality(values, encoding)
+		if quality > bestQuality {
+			best = encoding
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+func (n *AcceptEncodingNormalizer) Rewrites() bool {
+	return true
+}
+
+func (n *AcceptEncodingNormalizer) Variants() []string {
+	return append(append([]string{}, n.Supported...), "identity")
+}
+
+/* Accept-Language */
+
+// Collapses Accept-Language to the best of the configured locales
+// The first locale is used when none of them is accepted
+type AcceptLanguageNormalizer struct {
+	Locales []string
+}
+
+func (n *AcceptLanguageNormalizer) Normalize(values []string) string {
+	if len(n.Locales) == 0 {
+		return ""
+	}
+
+	best := n.Locales[0]
+	bestQuality := float64(0)
+	for _, locale := range n.Locales {
+		quality := float64(0)
+		for _, accepted := range parseQualityValues(values) {
+			if accepted.quality > quality && languageMatches(accepted.value, locale) {
+				quality = accepted.quality
+			}
+		}
+		if quality > bestQuality {
+			best = locale
+			bestQuality = quality
+		}
+	}
+	return best
+}
+
+func (n *AcceptLanguageNormalizer) Rewrites() bool {
+	return true
+}
+
+func (n *AcceptLanguageNormalizer) Variants() []string {
+	return n.Locales
+}
+
+// Languages match if they are equal or one is a more specific version of
+// the other, like en and en-US
+func languageMatches(accepted string, locale string) bool {
+	accepted = strings.ToLower(accepted)
+	locale = strings.ToLower(locale)
+	if accepted == "*" || accepted == locale {
+		return true
+	}
+	return strings.HasPrefix(accepted, locale+"-") || strings.HasPrefix(locale, accepted+"-")
+}
+
+/* User-Agent */
+
+var (
+	botAgents    = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|facebookexternalhit`)
+	tabletAgents = regexp.MustCompile(`(?i)ipad|tablet|kindle|silk|playbook`)
+	mobileAgents = regexp.MustCompile(`(?i)mobi|iphone|ipod|android|blackberry|opera mini|windows phone`)
+)
+
+// A user agent of each device class except bots
+var deviceUserAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Safari/537.36",
+	"Mozilla/5.0 (iPhone; CPU iPhone OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+	"Mozilla/5.0 (iPad; CPU OS 17_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Mobile/15E148",
+}
+
+// Collapses User-Agent to one of mobile, tablet, desktop or bot
+type DeviceClassNormalizer struct{}
+
+func (n *DeviceClassNormalizer) Normalize(values []string) string {
+	agent := strings.Join(values, " ")
+	switch {
+	case botAgents.MatchString(agent):
+		return DEVICE_BOT
+	case tabletAgents.MatchString(agent):
+		return DEVICE_TABLET
+	case strings.Contains(strings.ToLower(agent), "android") && !strings.Contains(strings.ToLower(agent), "mobile"):
+		// Android devices without Mobile in the user agent are tablets
+		return DEVICE_TABLET
+	case mobileAgents.MatchString(agent):
+		return DEVICE_MOBILE
+	default:
+		return DEVICE_DESKTOP
+	}
+}
+
+// The device class is not a valid User-Agent so the original one is sent upstream
+func (n *DeviceClassNormalizer) Rewrites() bool {
+	return false
+}
+
+func (n *DeviceClassNormalizer) Variants() []string {
+	return deviceUserAgents
+}
+
+/* Helpers */
+
+type qualityValue struct {
+	value   string
+	quality float64
+}
+
+/**
+ * Parses headers like Accept-Encoding or Accept-Language
+ * into their values and q params
+ */
+func parseQualityValues(values []string) []qualityValue {
+	parsed := []qualityValue{}
+	for _, header := range values {
+		for _, item := range strings.Split(header, ",") {
+			parts := strings.Split(item, ";")
+			value := strings.TrimSpace(parts[0])
+			if value == "" {
+				continue
+			}
+			quality := float64(1)
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if strings.HasPrefix(param, "q=") {
+					if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+						quality = q
+					}
+				}
+			}
+			parsed = append(parsed, qualityValue{value: value, quality: quality})
+		}
+	}
+	return parsed
+}
+
+/**
+ * Returns the value used to compare the header between requests
+ */
+func normalizeVaryHeader(header string, values []string, normalizers map[string]VaryNormalizer) (string, bool) {
+	normalizer, ok := normalizers[http.CanonicalHeaderKey(header)]
+	if !ok {
+		return "", false
+	}
+	return normalizer.Normalize(values), true
+}
+
+/**
+ * Replaces the headers of the request that have a normalizer that rewrites them
+ * So upstream sees the same value used to find the variant
+ */
+func normalizeRequest(r *http.Request, normalizers map[string]VaryNormalizer) {
+	if r.Header == nil {
+		r.Header = http.Header{}
+	}
+	for header, normalizer := range normalizers {
+		if normalizer.Rewrites() {
+			r.Header[header] = []string{normalizer.Normalize(r.Header[header])}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAcceptEncodingNormalizer(t *testing.T) {
+	normalizer := &AcceptEncodingNormalizer{Supported: []string{"br", "gzip"}}
+
+	tests := []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{"gzip, deflate, br"}, "br"},
+		{[]string{"gzip,deflate"}, "gzip"},
+		{[]string{"gzip;q=0.5, br;q=0.8"}, "br"},
+		{[]string{"br;q=0, gzip"}, "gzip"},
+		{[]string{"deflate"}, "identity"},
+		{[]string{"*"}, "br"},
+		{nil, "identity"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizer.Normalize(test.values), "Invalid normalization of %v", test.values)
+	}
+}
+
+func TestAcceptLanguageNormalizer(t *testing.T) {
+	normalizer := &AcceptLanguageNormalizer{Locales: []string{"en", "fr", "pt-BR"}}
+
+	tests := []struct {
+		values   []string
+		expected string
+	}{
+		{[]string{"fr-CA,fr;q=0.9,en;q=0.8"}, "fr"},
+		{[]string{"en-US,en;q=0.5"}, "en"},
+		{[]string{"pt"}, "pt-BR"},
+		{[]string{"de-DE"}, "en"},
+		{[]string{"de;q=0.9, fr;q=0.1"}, "fr"},
+		{nil, "en"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizer.Normalize(test.values), "Invalid normalization of %v", test.values)
+	}
+}
+
+func TestDeviceClassNormalizer(t *testing.T) {
+	normalizer := &DeviceClassNormalizer{}
+
+	tests := []struct {
+		agent    string
+		expected string
+	}{
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 12_0 like Mac OS X) Mobile/15E148", DEVICE_MOBILE},
+		{"Mozilla/5.0 (Linux; Android 9; SM-G960F) Chrome/74.0 Mobile Safari/537.36", DEVICE_MOBILE},
+		{"Mozilla/5.0 (Linux; Android 9; SM-T820) Chrome/74.0 Safari/537.36", DEVICE_TABLET},
+		{"Mozilla/5.0 (iPad; CPU OS 12_0 like Mac OS X)", DEVICE_TABLET},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) Chrome/74.0 Safari/537.36", DEVICE_DESKTOP},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", DEVICE_BOT},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, normalizer.Normalize([]string{test.agent}), "Invalid device class of %s", test.agent)
+	}
+}
@@ -0,0 +1,303 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const DEFAULT_WARM_CONCURRENCY = 4
+
+// Addresses allowed to request the warm endpoint if none are configured
+var DEFAULT_WARM_ALLOWED = []string{"127.0.0.0/8", "::1"}
+
+// Sitemap indexes can point to other sitemaps, this limits how deep they are followed
+const MAX_SITEMAP_DEPTH = 2
+
+// The client address of the requests made by the warmer, rules like bypass ip 127.0.0.0/8 match them
+const WARM_REMOTE_ADDR = "127.0.0.1:0"
+
+// Where the URLs to warm are read from
+type WarmSource struct {
+	Sitemap  bool   // If it is true Location is the path or URL of a sitemap.xml served by the site
+	Location string // Otherwise it is a local file with one URL per line
+}
+
+/**
+ * The Warmer requests the URLs of its sources through the CacheHandler
+ * so they are stored before clients ask for them.
+ * Each URL is requested once by every variant of the configured Vary normalizers.
+ */
+type Warmer struct {
+	Handler     *CacheHandler
+	Sources     []WarmSource
+	Host        string // The host of the requests of relative URLs
+	Concurrency int
+
+	// It is 1 while warming, it must be accessed atomically
+	running int32
+}
+
+func NewWarmer(handler *CacheHandler, host string) *Warmer {
+	return &Warmer{
+		Handler:     handler,
+		Sources:     handler.Config.WarmSources,
+		Host:        host,
+		Concurrency: handler.Config.WarmConcurrency,
+	}
+}
+
+/**
+ * Requests all the URLs of the sources with every variant.
+ * It returns the number of requests made or an error if it was already warming.
+ */
+func (w *Warmer) Warm() (int, error) {
+	if !atomic.CompareAndSwapInt32(&w.running, 0, 1) {
+		return 0, fmt.Errorf("cache is already being warmed")
+	}
+	defer atomic.StoreInt32(&w.running, 0)
+
+	urls := []string{}
+	for _, source := range w.Sources {
+		found, err := w.readSource(source)
+		if err != nil {
+			w.Handler.Config.Logger.Error("failed reading urls to warm", LogFields{"location": source.Location, "error": err})
+			continue
+		}
+		urls = append(urls, found...)
+	}
+
+	concurrency := w.Concurrency
+	if concurrency <= 0 {
+		concurrency = DEFAULT_WARM_CONCURRENCY
+	}
+
+	requests := 0
+	slots := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for _, url := range urls {
+		for _, variant := range warmVariants(w.Handler.Config.VaryNormalizers) {
+			req, err := w.newRequest(url, variant)
+			if err != nil {
+				w.Handler.Config.Logger.Error("invalid url to warm", LogFields{"url": url, "error": err})
+				break
+			}
+
+			requests++
+			slots <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+				if _, err := w.Handler.ServeHTTP(&warmResponseWriter{header: http.Header{}}, req); err != nil {
+					w.Handler.Config.Logger.Error("failed warming", LogFields{"url": req.URL.String(), "error": err})
+				}
+			}()
+		}
+	}
+	wg.Wait()
+
+	return requests, nil
+}
+
+func (w *Warmer) readSource(source WarmSource) ([]string, error) {
+	if source.Sitemap {
+		return w.readSitemap(source.Location, 0)
+	}
+
+	file, err := os.Open(source.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	urls := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			urls = append(urls, line)
+		}
+	}
+	return urls, scanner.Err()
+}
+
+type sitemap struct {
+	URLs     []string `xml:"url>loc"`
+	Sitemaps []string `xml:"sitemap>loc"`
+}
+
+/**
+ * Fetches the sitemap from upstream, without storing it, and returns its URLs.
+ * The sitemaps of a sitemap index are fetched too.
+ * URLs of other hosts are skipped, the sitemap can't make the cache request other sites.
+ */
+func (w *Warmer) readSitemap(location string, depth int) ([]string, error) {
+	req, err := w.newRequest(location, http.Header{})
+	if err != nil {
+		return nil, err
+	}
+
+	writer := &warmResponseWriter{header: http.Header{}, body: &bytes.Buffer{}}
+	code, err := w.Handler.Next.ServeHTTP(writer, req)
+	if err != nil {
+		return nil, err
+	}
+	if writer.code != 0 {
+		code = writer.code
+	}
+	if code != http.StatusOK {
+		return nil, fmt.Errorf("sitemap responded with status %d", code)
+	}
+
+	parsed := sitemap{}
+	if err := xml.Unmarshal(writer.body.Bytes(), &parsed); err != nil {
+		return nil, err
+	}
+
+	urls := []string{}
+	for _, location := range parsed.URLs {
+		if w.isSiteURL(location) {
+			urls = append(urls, location)
+		}
+	}
+	for _, child := range parsed.Sitemaps {
+		if depth+1 >= MAX_SITEMAP_DEPTH {
+			break
+		}
+		if !w.isSiteURL(child) {
+			continue
+		}
+		found, err := w.readSitemap(strings.TrimSpace(child), depth+1)
+		if err != nil {
+			w.Handler.Config.Logger.Error("failed reading sitemap", LogFields{"location": child, "error": err})
+			continue
+		}
+		urls = append(urls, found...)
+	}
+	return urls, nil
+}
+
+// Returns true if the URL is relative or its host is the one of the site, it is logged if it isn't
+func (w *Warmer) isSiteURL(location string) bool {
+	location = strings.TrimSpace(location)
+	if strings.HasPrefix(location, "/") && !strings.HasPrefix(location, "//") {
+		return true
+	}
+	parsed, err := url.Parse(location)
+	if err == nil && strings.EqualFold(parsed.Host, w.Host) {
+		return true
+	}
+	w.Handler.Config.Logger.Warning("skipped url of other host in sitemap", LogFields{"url": location, "host": w.Host})
+	return false
+}
+
+// Builds a synthetic GET request, relative URLs are requested to the host of the site
+func (w *Warmer) newRequest(url string, header http.Header) (*http.Request, error) {
+	url = strings.TrimSpace(url)
+	if strings.HasPrefix(url, "/") {
+		url = "http://" + w.Host + url
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.RemoteAddr = WARM_REMOTE_ADDR
+	return req, nil
+}
+
+/**
+ * Returns the headers of every variant of the normalizers
+ * For example with Accept-Encoding gzip and Accept-Language en fr it returns
+ * gzip and en, gzip and fr, identity and en, identity and fr.
+ */
+func warmVariants(normalizers map[string]VaryNormalizer) []http.Header {
+	headers := []string{}
+	for header := range normalizers {
+		headers = append(headers, header)
+	}
+	sort.Strings(headers)
+
+	variants := []http.Header{{}}
+	for _, header := range headers {
+		values := normalizers[header].Variants()
+		if len(values) == 0 {
+			continue
+		}
+
+		combined := []http.Header{}
+		for _, variant := range variants {
+			for _, value := range values {
+				next := cloneHeader(variant)
+				next.Set(header, value)
+				combined = append(combined, next)
+			}
+		}
+		variants = combined
+	}
+	return variants
+}
+
+/**
+ * Returns true if the request is for the warm endpoint and serves it.
+ * Warming is started in background and allowed only from WarmAllowed addresses.
+ */
+func (h *CacheHandler) serveWarmEndpoint(w http.ResponseWriter, r *http.Request) (bool, int, error) {
+	if h.Warmer == nil || h.Config.WarmEndpoint == "" || r.URL.Path != h.Config.WarmEndpoint {
+		return false, 0, nil
+	}
+
+	if !h.Config.WarmAllowed.matches(r, 0, &http.Header{}) {
+		return true, http.StatusForbidden, nil
+	}
+	if r.Method != "POST" {
+		return true, http.StatusMethodNotAllowed, nil
+	}
+	if atomic.LoadInt32(&h.Warmer.running) == 1 {
+		return true, http.StatusConflict, nil
+	}
+
+	go h.Warmer.Warm()
+
+	w.WriteHeader(http.StatusAccepted)
+	return true, http.StatusAccepted, nil
+}
+
+// Discards the responses of requests made without a client, except the body of sitemaps
+type warmResponseWriter struct {
+	header http.Header
+	code   int
+	body   *bytes.Buffer
+}
+
+func (w *warmResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *warmResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *warmResponseWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	if w.body != nil {
+		return w.body.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+/* Helpers */
+
+func buildWarmedHandler(sources ...WarmSource) (*CacheHandler, *TestHandler) {
+	handler, backend := buildBasicHandler()
+	handler.Config.CacheRules = []CacheRule{&PathCacheRule{Path: "/"}}
+	handler.Config.WarmSources = sources
+	handler.Config.WarmConcurrency = 2
+	handler.Config.VaryNormalizers = map[string]VaryNormalizer{
+		"Accept-Encoding": &AcceptEncodingNormalizer{Supported: []string{"gzip"}},
+	}
+	handler.Warmer = NewWarmer(handler, "somehost.com")
+	backend.ResponseHeaders = http.Header{"Vary": []string{"Accept-Encoding"}}
+	return handler, backend
+}
+
+// Requests of buildRequest don't have Host, which is part of the key of warmed urls
+func buildHostRequest(path string, headers http.Header) *http.Request {
+	req := buildRequest("http://somehost.com"+path, "GET", headers)
+	req.Host = "somehost.com"
+	return req
+}
+
+func writeURLList(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "caddy-cache-warm")
+	assert.NoError(t, err)
+	file.WriteString(content)
+	file.Close()
+	return file.Name()
+}
+
+/* Actual tests */
+
+func TestWarmVariants(t *testing.T) {
+	variants := warmVariants(map[string]VaryNormalizer{
+		"Accept-Encoding": &AcceptEncodingNormalizer{Supported: []string{"br", "gzip"}},
+		"Accept-Language": &AcceptLanguageNormalizer{Locales: []string{"en", "fr"}},
+	})
+	assert.Len(t, variants, 6)
+	assert.Equal(t, http.Header{"Accept-Encoding": {"br"}, "Accept-Language": {"en"}}, variants[0])
+	assert.Equal(t, http.Header{"Accept-Encoding": {"identity"}, "Accept-Language": {"fr"}}, variants[5])
+
+	assert.Equal(t, []http.Header{{}}, warmVariants(nil))
+}
+
+func TestDeviceClassVariants(t *testing.T) {
+	normalizer := &DeviceClassNormalizer{}
+	classes := []string{}
+	for _, agent := range normalizer.Variants() {
+		classes = append(classes, normalizer.Normalize([]string{agent}))
+	}
+	assert.Equal(t, []string{DEVICE_DESKTOP, DEVICE_MOBILE, DEVICE_TABLET}, classes)
+}
+
+func TestWarmFromFile(t *testing.T) {
+	list := writeURLList(t, "/a\n# comment\n\nhttp://somehost.com/b\n")
+	defer os.Remove(list)
+	handler, backend := buildWarmedHandler(WarmSource{Location: list})
+
+	requests, err := handler.Warmer.Warm()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, requests, "Each url should have been requested with gzip and identity")
+	assert.Equal(t, 4, backend.TimesCalled())
+
+	makeNRequests(handler, 1, buildHostRequest("/a", http.Header{"Accept-Encoding": {"gzip, deflate"}}))
+	makeNRequests(handler, 1, buildHostRequest("/b", http.Header{}))
+	assert.Equal(t, 4, backend.TimesCalled(), "Warmed urls should be hits")
+}
+
+func TestWarmFromSitemap(t *testing.T) {
+	handler, _ := buildWarmedHandler(WarmSource{Sitemap: true, Location: "/sitemap.xml"})
+	handler.Config.VaryNormalizers = nil
+
+	lock := new(sync.Mutex)
+	requested := map[string]int{}
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		lock.Lock()
+		requested[r.URL.Path]++
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/sitemap.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<sitemap><loc>http://somehost.com/pages.xml</loc></sitemap>
+	<sitemap><loc>http://otherhost.com/other.xml</loc></sitemap>
+</sitemapindex>`))
+		case "/pages.xml":
+			w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+	<url><loc>http://somehost.com/</loc></url>
+	<url><loc> http://somehost.com/about </loc></url>
+	<url><loc>http://otherhost.com/secret</loc></url>
+	<url><loc>//otherhost.com/relative</loc></url>
+</urlset>`))
+		default:
+			w.Write([]byte("Hello :)"))
+		}
+		return 200, nil
+	})
+
+	requests, err := handler.Warmer.Warm()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests, "Without Vary each url should have been requested once")
+	assert.Equal(t, map[string]int{"/sitemap.xml": 1, "/pages.xml": 1, "/": 1, "/about": 1}, requested, "Urls of other hosts must be skipped")
+
+	makeNRequests(handler, 1, buildHostRequest("/about", http.Header{}))
+	assert.Equal(t, 1, requested["/about"], "Warmed urls should be hits")
+}
+
+func TestWarmEndpoint(t *testing.T) {
+	list := writeURLList(t, "/a\n")
+	defer os.Remove(list)
+	handler, backend := buildWarmedHandler(WarmSource{Location: list})
+	handler.Config.WarmEndpoint = "/_cache/warm"
+	handler.Config.WarmAllowed = &IPCacheRule{Networks: []*net.IPNet{mustParseNetwork("127.0.0.1")}}
+
+	request := func(method string, remoteAddr string) int {
+		req := buildRequest("http://somehost.com/_cache/warm", method, http.Header{})
+		req.RemoteAddr = remoteAddr
+		code, err := handler.ServeHTTP(httptest.NewRecorder(), req)
+		assert.NoError(t, err)
+		return code
+	}
+
+	assert.Equal(t, http.StatusForbidden, request("POST", "10.0.0.1:1234"))
+	assert.Equal(t, http.StatusMethodNotAllowed, request("GET", "127.0.0.1:1234"))
+	assert.Equal(t, http.StatusAccepted, request("POST", "127.0.0.1:1234"))
+
+	for i := 0; i < 100 && backend.TimesCalled() < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 2, backend.TimesCalled(), "The url should have been warmed in background")
+}
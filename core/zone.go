@@ -0,0 +1,304 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Returned by NewContent when the zone has no room, the response is not stored
+var ErrZoneFull = errors.New("cache zone is full")
+
+/**
+ * A Zone is a cache shared by the sites that use it by name.
+ * Its cache and storage are set up once, and the bytes stored are accounted by site.
+ * The storage is closed when the last handler using the zone is closed.
+ */
+type Zone struct {
+	Name    string
+	Storage Storage
+	Cache   *Cache
+
+	// Responses are not stored while the zone uses MaxSize bytes, 0 means unlimited
+	MaxSize int64
+
+	// The arguments of the zone directive that defined it
+	definition string
+
+	// Handlers using it and the settings of their caches, they are protected by zonesLock
+	refs     int
+	settings string
+
+	setupOnce *sync.Once
+	setupErr  error
+
+	usedLock *sync.Mutex
+	used     map[string]int64
+}
+
+var zonesLock = new(sync.Mutex)
+
+// Zones by name, the last one is the one of the last config, the others are still used by previous configs
+var zones = map[string][]*Zone{}
+
+func newZone(name string, maxSize int64, storage Storage) *Zone {
+	return &Zone{
+		Name:      name,
+		Storage:   storage,
+		Cache:     NewCache(storage),
+		MaxSize:   maxSize,
+		setupOnce: new(sync.Once),
+		usedLock:  new(sync.Mutex),
+		used:      map[string]int64{},
+	}
+}
+
+/**
+ * Defines a zone that can be used by name from many handlers.
+ * It fails if there is already a zone with the name.
+ */
+func DefineZone(name string, maxSize int64, storage Storage) (*Zone, error) {
+	return defineZone(name, maxSize, storage, "")
+}
+
+/**
+ * Defining again a zone with the same definition returns the one defined before,
+ * so the sites keep their cache when caddy reloads the config.
+ * A different definition, like the one of a config changed on reload, replaces it,
+ * the previous zone is closed when the handlers of the previous config are closed.
+ * Zones that no handler used, like the ones of a config that failed, are dropped.
+ */
+func defineZone(name string, maxSize int64, storage Storage, definition string) (*Zone, error) {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	if definition == "" && len(zones[name]) > 0 {
+		return nil, errors.New("Cache zone " + name + " is already defined")
+	}
+
+	var zone *Zone
+	used := []*Zone{}
+	for _, defined := range zones[name] {
+		if definition != "" && defined.definition == definition {
+			zone = defined
+		} else if defined.refs > 0 {
+			used = append(used, defined)
+		}
+	}
+	if zone == nil {
+		zone = newZone(name, maxSize, storage)
+		zone.definition = definition
+	} else if zone.refs == 0 {
+		// The settings are taken again from the sites of this config
+		zone.settings = ""
+	}
+	zones[name] = append(used, zone)
+	return zone, nil
+}
+
+// Returns the zone with the name or nil if it is not defined
+func GetZone(name string) *Zone {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	defined := zones[name]
+	if len(defined) == 0 {
+		return nil
+	}
+	return defined[len(defined)-1]
+}
+
+// Called by the handlers when they set up the zone, it is closed when they are all released
+func (zone *Zone) acquire() {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	zone.refs++
+}
+
+/**
+ * Closes the storage of the zone when no handler uses it anymore,
+ * then the zone is defined again by the next config that uses it.
+ */
+func (zone *Zone) release() error {
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+
+	zone.refs--
+	if zone.refs > 0 {
+		return nil
+	}
+	defined := []*Zone{}
+	for _, other := range zones[zone.Name] {
+		if other != zone {
+			defined = append(defined, other)
+		}
+	}
+	if len(defined) == 0 {
+		delete(zones, zone.Name)
+	} else {
+		zones[zone.Name] = defined
+	}
+	return zone.Cache.Close()
+}
+
+// Sets up the cache and storage of the zone, only the first call does it
+func (zone *Zone) Setup() error {
+	zone.setupOnce.Do(func() {
+		zone.setupErr = zone.Cache.Setup()
+	})
+	return zone.setupErr
+}
+
+/**
+ * Sets the settings of the cache of the zone, the ones of the first site that uses it.
+ * The other sites must have the same ones, and they can't change while the zone is used,
+ * so it fails if they are different.
+ */
+func (zone *Zone) configure(config *Config) error {
+	settings := fmt.Sprintf("max_variants %d and lock_timeout %s with stale %s", config.MaxVariants, config.LockTimeout, config.StaleTTL)
+
+	zonesLock.Lock()
+	defer zonesLock.Unlock()
+	if zone.settings == "" {
+		zone.settings = settings
+		zone.Cache.MaxVariants = config.MaxVariants
+		zone.Cache.LockTimeout = config.LockTimeout
+		zone.Cache.StaleTTL = config.StaleTTL
+		return nil
+	}
+	if zone.settings != settings {
+		return fmt.Errorf("Cache zone %s is used with %s, every site using it must have the same ones", zone.Name, zone.settings)
+	}
+	return nil
+}
+
+/**
+ * Creates a content accounted to the site, it returns ErrZoneFull
+ * if the zone already uses MaxSize bytes.
+ */
+func (zone *Zone) NewContent(site string, key string) (StorageContent, error) {
+	if zone.MaxSize > 0 && zone.Used() >= zone.MaxSize {
+		return nil, ErrZoneFull
+	}
+
+	content, err := zone.Cache.NewContent(key)
+	if err != nil {
+		return nil, err
+	}
+	return &zoneContent{wrappedContent: wrappedContent{content}, zone: zone, site: site}, nil
+}
+
+// Accounts size bytes to the site if the zone has room for them
+func (zone *Zone) reserve(site string, size int64) bool {
+	zone.usedLock.Lock()
+	defer zone.usedLock.Unlock()
+	if zone.MaxSize > 0 {
+		total := size
+		for _, used := range zone.used {
+			total += used
+		}
+		if total > zone.MaxSize {
+			return false
+		}
+	}
+	zone.used[site] += size
+	return true
+}
+
+func (zone *Zone) add(site string, size int64) {
+	zone.usedLock.Lock()
+	defer zone.usedLock.Unlock()
+	zone.used[site] += size
+	if zone.used[site] == 0 {
+		delete(zone.used, site)
+	}
+}
+
+// Returns the bytes stored in the zone by all the sites
+func (zone *Zone) Used() int64 {
+	zone.usedLock.Lock()
+	defer zone.usedLock.Unlock()
+	total := int64(0)
+	for _, size := range zone.used {
+		total += size
+	}
+	return total
+}
+
+// Returns the bytes stored in the zone by each site
+func (zone *Zone) Usage() map[string]int64 {
+	zone.usedLock.Lock()
+	defer zone.usedLock.Unlock()
+	usage := make(map[string]int64, len(zone.used))
+	for site, size := range zone.used {
+		usage[site] = size
+	}
+	return usage
+}
+
+// zoneContent accounts the bytes written to its site until it is cleared
+type zoneContent struct {
+	wrappedContent
+	zone *Zone
+	site string
+	size int64
+
+	// ErrZoneFull if the zone had no room for a write, the content is not stored
+	err error
+}
+
+func (c *zoneContent) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if !c.zone.reserve(c.site, int64(len(p))) {
+		c.err = ErrZoneFull
+		return 0, c.err
+	}
+	n, err := c.StorageContent.Write(p)
+	c.size += int64(n)
+	c.zone.add(c.site, int64(n-len(p)))
+	return n, err
+}
+
+func (c *zoneContent) Close() error {
+	if err := c.StorageContent.Close(); err != nil {
+		return err
+	}
+	return c.err
+}
+
+func (c *zoneContent) Clear() error {
+	c.zone.add(c.site, -c.size)
+	c.size = 0
+	return c.StorageContent.Clear()
+}
+
+/**
+ * Parses the zone directive, a name references a zone defined before
+ * and a name with a size and storage defines it:
+ *
+ *     zone assets 1g mmap /var/cache/assets
+ */
+func parseZone(args []string) (*Zone, error) {
+	if len(args) == 1 {
+		zone := GetZone(args[0])
+		if zone == nil {
+			return nil, errors.New("Unknown cache zone " + args[0] + ", it must be defined before it is used")
+		}
+		return zone, nil
+	}
+	if len(args) < 3 {
+		return nil, errors.New("Invalid zone configs, specify: zone <name> [<max-size> <storage> [args...]]")
+	}
+
+	maxSize, err := ParseSize(args[1])
+	if err != nil || maxSize < 0 {
+		return nil, errors.New("Invalid max size of cache zone " + args[1])
+	}
+	storage, err := parseStorage(args[2:])
+	if err != nil {
+		return nil, err
+	}
+	return defineZone(args[0], maxSize, storage, strings.Join(args[1:], " "))
+}
@@ -0,0 +1,251 @@
+package core
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+func buildZoneHandler(t *testing.T, zone *Zone, site string, timesCalled *int) *CacheHandler {
+	handler, err := New(WithZone(zone, site), WithStatusHeader("X-Cache-Status"))
+	assert.NoError(t, err)
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		*timesCalled++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello :)"))
+		return 0, nil
+	})
+	return handler
+}
+
+func TestZoneShared(t *testing.T) {
+	zone, err := DefineZone("shared-test", 0, NewMemoryStorage())
+	assert.NoError(t, err)
+
+	timesCalled := 0
+	first := buildZoneHandler(t, zone, "first.test", &timesCalled)
+	second := buildZoneHandler(t, zone, "second.test", &timesCalled)
+	assert.Equal(t, first.Cache, second.Cache, "Handlers of the same zone share the cache")
+
+	for i, status := range []string{"miss", "hit"} {
+		for _, handler := range []*CacheHandler{first, second} {
+			req := buildGetRequest("/file")
+			req.Host = handler.Config.Site
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			assert.Equal(t, status, w.Header().Get("X-Cache-Status"), i)
+		}
+	}
+	assert.Equal(t, 2, timesCalled, "Each site stores its own responses")
+
+	second.ServeHTTP(httptest.NewRecorder(), buildGetRequest("/other"))
+	assert.Equal(t, map[string]int64{"first.test": 8, "second.test": 16}, zone.Usage())
+	assert.Equal(t, int64(24), zone.Used())
+}
+
+func TestZoneFull(t *testing.T) {
+	zone, err := DefineZone("full-test", 8, NewMemoryStorage())
+	assert.NoError(t, err)
+
+	timesCalled := 0
+	handler := buildZoneHandler(t, zone, "site.test", &timesCalled)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, buildGetRequest("/first"))
+		assert.Equal(t, "Hello :)", w.Body.String(), i)
+	}
+	assert.Equal(t, 1, timesCalled)
+
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, buildGetRequest("/second"))
+		assert.Equal(t, "Hello :)", w.Body.String(), i)
+		assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"), i)
+	}
+	assert.Equal(t, 3, timesCalled, "Responses are not stored when the zone is full")
+	assert.Equal(t, int64(8), zone.Used())
+}
+
+func TestZoneContentClear(t *testing.T) {
+	zone, err := DefineZone("clear-test", 0, NewMemoryStorage())
+	assert.NoError(t, err)
+	assert.NoError(t, zone.Setup())
+
+	content, err := zone.NewContent("site.test", "GET /file")
+	assert.NoError(t, err)
+	content.Write([]byte("Hello :)"))
+	assert.NoError(t, content.Close())
+	assert.Equal(t, int64(8), zone.Used())
+	assert.Equal(t, "memory", contentStorageName(content))
+
+	assert.NoError(t, content.Clear())
+	assert.Equal(t, int64(0), zone.Used())
+	assert.Empty(t, zone.Usage())
+}
+
+func TestZoneDirective(t *testing.T) {
+	config := DefaultConfig()
+	assert.Error(t, ApplyDirective(config, "zone", []string{"directive-test"}), "Zones must be defined before they are used")
+	assert.Error(t, ApplyDirective(config, "zone", []string{"directive-test", "1g"}))
+	assert.Error(t, ApplyDirective(config, "zone", []string{"directive-test", "many", "memory"}))
+	assert.Error(t, ApplyDirective(config, "zone", []string{"directive-test", "1g", "unknown"}))
+
+	assert.NoError(t, ApplyDirective(config, "zone", []string{"directive-test", "1g", "memory"}))
+	zone := config.Zone
+	assert.Equal(t, "directive-test", zone.Name)
+	assert.Equal(t, int64(1<<30), zone.MaxSize)
+	assert.Equal(t, zone, GetZone("directive-test"))
+
+	other := DefaultConfig()
+	assert.NoError(t, ApplyDirective(other, "zone", []string{"directive-test"}))
+	assert.Equal(t, zone, other.Zone)
+
+	assert.NoError(t, ApplyDirective(other, "zone", []string{"directive-test", "1g", "memory"}), "The same definition can be repeated")
+	assert.Equal(t, zone, other.Zone)
+
+	_, err := DefineZone("directive-test", 0, NewMemoryStorage())
+	assert.Error(t, err)
+}
+
+func TestZoneReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "caddy-cache-zone")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := path.Join(dir, "cache.db")
+
+	buildSite := func(args ...string) (*CacheHandler, *int) {
+		config := DefaultConfig()
+		assert.NoError(t, ApplyDirective(config, "zone", append([]string{"reload-test"}, args...)))
+		timesCalled := 0
+		handler := buildZoneHandler(t, config.Zone, "site.test", &timesCalled)
+		assert.NoError(t, handler.Setup())
+		return handler, &timesCalled
+	}
+
+	old, oldCalls := buildSite("1g", "kv", file)
+	req := buildGetRequest("http://site.test/file")
+	makeNRequests(old, 1, req)
+
+	// The config is reloaded with the same zone, it keeps its cache
+	same, sameCalls := buildSite("1g", "kv", file)
+	assert.Equal(t, old.Cache, same.Cache)
+	assert.NoError(t, old.Close())
+	makeNRequests(same, 1, req)
+	assert.Equal(t, 0, *sameCalls)
+
+	// And with the zone changed, it replaces the previous one
+	changed, changedCalls := buildSite("2g", "kv", file)
+	assert.NotEqual(t, same.Cache, changed.Cache, "The zone must be defined again")
+	assert.Equal(t, int64(2<<30), GetZone("reload-test").MaxSize)
+	makeNRequests(changed, 1, req)
+	assert.Equal(t, 0, *changedCalls, "The file of the previous zone is shared until it is closed")
+
+	assert.NoError(t, same.Close())
+	previous := same.Config.Zone.Storage.(*KVStorage)
+	assert.True(t, previous.isClosed(), "The storage of the replaced zone is closed with its last handler")
+	assert.Equal(t, changed.Config.Zone, GetZone("reload-test"))
+	makeNRequests(changed, 1, req)
+	assert.Equal(t, 0, *changedCalls)
+	assert.Equal(t, 1, *oldCalls)
+
+	assert.NoError(t, changed.Close())
+	assert.Nil(t, GetZone("reload-test"), "Zones without handlers are removed")
+}
+
+func TestZoneFullWhileWriting(t *testing.T) {
+	zone, err := DefineZone("writing-test", 8, NewMemoryStorage())
+	assert.NoError(t, err)
+	assert.NoError(t, zone.Setup())
+
+	content, err := zone.NewContent("site.test", "GET /large")
+	assert.NoError(t, err)
+	n, err := content.Write([]byte("Hello"))
+	assert.Equal(t, 5, n)
+	assert.NoError(t, err)
+	_, err = content.Write([]byte(" world"))
+	assert.Equal(t, ErrZoneFull, err, "The zone is checked on every write")
+	assert.Equal(t, ErrZoneFull, content.Close())
+	assert.Equal(t, int64(5), zone.Used())
+
+	assert.NoError(t, content.Clear())
+	assert.Equal(t, int64(0), zone.Used())
+
+	timesCalled := 0
+	handler := buildZoneHandler(t, zone, "site.test", &timesCalled)
+	handler.Next = UpstreamFunc(func(w http.ResponseWriter, r *http.Request) (int, error) {
+		timesCalled++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("Larger than the zone"))
+		return 0, nil
+	})
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, buildGetRequest("/large"))
+		assert.Equal(t, "Larger than the zone", w.Body.String(), i)
+		assert.Equal(t, "miss", w.Header().Get("X-Cache-Status"), i)
+	}
+	assert.Equal(t, 2, timesCalled, "Responses larger than the zone are not stored")
+	assert.Equal(t, int64(0), zone.Used())
+}
+
+func TestZoneSettingsMustMatch(t *testing.T) {
+	first := DefaultConfig()
+	assert.NoError(t, ApplyDirective(first, "zone", []string{"settings-test", "1g", "memory"}))
+	assert.NoError(t, ApplyDirective(first, "max_variants", []string{"5"}))
+	assert.NoError(t, first.Validate())
+	assert.Equal(t, 5, first.Zone.Cache.MaxVariants)
+
+	same := DefaultConfig()
+	assert.NoError(t, ApplyDirective(same, "zone", []string{"settings-test"}))
+	assert.NoError(t, ApplyDirective(same, "max_variants", []string{"5"}))
+	assert.NoError(t, same.Validate())
+
+	for _, directive := range [][]string{{"max_variants", "10"}, {"lock_timeout", "1s"}, {"lock_timeout", "1s", "stale", "10s"}} {
+		other := DefaultConfig()
+		assert.NoError(t, ApplyDirective(other, "zone", []string{"settings-test"}))
+		assert.NoError(t, ApplyDirective(other, "max_variants", []string{"5"}))
+		assert.NoError(t, ApplyDirective(other, directive[0], directive[1:]))
+		assert.Error(t, other.Validate(), "%v", directive)
+	}
+	assert.Equal(t, 5, first.Zone.Cache.MaxVariants)
+
+	_, err := New(WithZone(first.Zone, "site.test"), WithMaxVariants(10))
+	assert.Error(t, err)
+}
+
+func TestZoneUsedFromSetup(t *testing.T) {
+	buildConfig := func(maxVariants string) *Config {
+		config := DefaultConfig()
+		assert.NoError(t, ApplyDirective(config, "zone", []string{"setup-test", "1g", "memory"}))
+		assert.NoError(t, ApplyDirective(config, "max_variants", []string{maxVariants}))
+		assert.NoError(t, config.Validate())
+		return config
+	}
+
+	// A config that fails to parse after the zone creates its handler but never sets it up
+	failed, err := NewCacheHandler(buildConfig("5"))
+	assert.NoError(t, err)
+	assert.NoError(t, failed.Close())
+	assert.Equal(t, failed.Config.Zone, GetZone("setup-test"))
+
+	// So the next config can use the zone with other settings
+	handler, err := NewCacheHandler(buildConfig("10"))
+	assert.NoError(t, err)
+	assert.Equal(t, failed.Config.Zone, handler.Config.Zone)
+	assert.NoError(t, handler.Setup())
+	assert.NoError(t, handler.Setup())
+	assert.Equal(t, 10, handler.Cache.MaxVariants)
+
+	config := DefaultConfig()
+	assert.NoError(t, ApplyDirective(config, "zone", []string{"setup-test", "1g", "memory"}))
+	assert.NoError(t, ApplyDirective(config, "max_variants", []string{"5"}))
+	assert.Error(t, config.Validate(), "The settings of a zone in use can't change")
+
+	assert.NoError(t, handler.Close())
+	assert.Nil(t, GetZone("setup-test"), "The zone is released once")
+}
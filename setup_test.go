@@ -2,88 +2,409 @@ package cache
 
 import (
 	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyhttp/httpserver"
+	"github.com/nicolasazrak/caddy-cache/core"
 	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
 	"strconv"
 	"testing"
 	"time"
 )
 
+func limitedMMapStorage(path string, maxOpenFiles int64) *core.MMapStorage {
+	storage := core.NewMMapStorage(path)
+	storage.MaxOpenFiles = maxOpenFiles
+	return storage
+}
+
 func TestParsingConfig(t *testing.T) {
-	cacheAssetsRule := PathCacheRule{
+	cacheAssetsRule := core.PathCacheRule{
 		Path: "/assets",
 	}
 
 	tests := []struct {
 		input     string
 		shouldErr bool
-		expect    Config
+		expect    core.Config
 	}{
-		{"cache", false, Config{
-			Storage:       NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules:    []CacheRule{},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n match path /assets \n} }", false, Config{
-			Storage:       NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules:    []CacheRule{&cacheAssetsRule},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n match path /assets \n match path /api \n} \n}", false, Config{
-			Storage: NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules: []CacheRule{
+		{"cache", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match path /assets \n} }", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{&cacheAssetsRule},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match path /assets \n match path /api \n} \n}", false, core.Config{
+			Storage: core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules: []core.CacheRule{
 				&cacheAssetsRule,
-				&PathCacheRule{Path: "/api"},
+				&core.PathCacheRule{Path: "/api"},
 			},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n match path /assets \n default_max_age 30 \n}", false, Config{
-			Storage:       NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules:    []CacheRule{&cacheAssetsRule},
-			DefaultMaxAge: time.Second * time.Duration(30),
-		}},
-		{"cache {\n default_max_age 30 \n match path /public \n}", false, Config{
-			Storage:       NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules:    []CacheRule{&PathCacheRule{Path: "/public"}},
-			DefaultMaxAge: time.Second * time.Duration(30),
-		}},
-		{"cache {\n match header Content-Type image/png image/gif \n match path /assets \n}", false, Config{
-			Storage: NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules: []CacheRule{
-				&HeaderCacheRule{
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match path /assets \n default_max_age 30 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{&cacheAssetsRule},
+			DefaultMaxAge:   time.Second * time.Duration(30),
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n default_max_age 30 \n match path /public \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{&core.PathCacheRule{Path: "/public"}},
+			DefaultMaxAge:   time.Second * time.Duration(30),
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match header Content-Type image/png image/gif \n match path /assets \n}", false, core.Config{
+			Storage: core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules: []core.CacheRule{
+				&core.HeaderCacheRule{
 					Header: "Content-Type",
 					Value:  []string{"image/png", "image/gif"},
 				},
 				&cacheAssetsRule,
 			},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n status_header X-Custom-Header \n}", false, Config{
-			Storage:       NewMMapStorage("/tmp/caddy-cache"),
-			CacheRules:    []CacheRule{},
-			StatusHeader:  "X-Custom-Header",
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n storage mmap /some/path \n}", false, Config{
-			Storage:       NewMMapStorage("/some/path"),
-			CacheRules:    []CacheRule{},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n storage memory \n}", false, Config{
-			Storage:       NewMemoryStorage(),
-			CacheRules:    []CacheRule{},
-			DefaultMaxAge: DEFAULT_MAX_AGE,
-		}},
-		{"cache {\n status_header aheader another \n}", true, Config{}},    // status_header with invalid number of parameters
-		{"cache {\n default_max_age anumber \n}", true, Config{}},          // max_age with invalid number
-		{"cache {\n default_max_age 45 morepareters \n}", true, Config{}},  // More parameters
-		{"cache {\n default_max_age \n}", true, Config{}},                  // Missing parameters
-		{"cache {\n max_age 50 \n}", true, Config{}},                       // Unknown parameters
-		{"cache {\n default_max_age 20 \n max_age 50 \n}", true, Config{}}, // Mixed valid and invalid parameters
-		{"cache {\n match path / ea \n}", true, Config{}},         // Invalid number of parameters in match
-		{"cache {\n match unknown \n}", true, Config{}},           // Unknown condition in match
-		{"cache {\n match \n}", true, Config{}},          // Unknown "invalid"
-		{"cache {\n storage pepe \n}", true, Config{}},                     // Unknown storage "pepe"
-		{"cache {\n storage mmap \n}", true, Config{}},                     // Missing path
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n status_header X-Custom-Header \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			StatusHeader:    "X-Custom-Header",
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n storage mmap /some/path \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/some/path"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n storage mmap /some/path 100 \n}", false, core.Config{
+			Storage:         limitedMMapStorage("/some/path", 100),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n storage memory \n}", false, core.Config{
+			Storage:         core.NewMemoryStorage(),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n storage tiered 64mb /some/path \n}", false, core.Config{
+			Storage:         core.NewTieredStorage(64*1024*1024, "/some/path"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n compress \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			Compress:        true,
+			CompressTypes:   core.DEFAULT_COMPRESS_TYPES,
+		}},
+		{"cache {\n compress text/html application/json \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			Compress:        true,
+			CompressTypes:   []string{"text/html", "application/json"},
+		}},
+		{"cache {\n vary_normalize accept-encoding br gzip \n vary_normalize User-Agent \n max_variants 10 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			VaryNormalizers: map[string]core.VaryNormalizer{
+				"Accept-Encoding": &core.AcceptEncodingNormalizer{Supported: []string{"br", "gzip"}},
+				"User-Agent":      &core.DeviceClassNormalizer{},
+			},
+			MaxVariants: 10,
+		}},
+		{"cache {\n vary_normalize Accept-Language en fr \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			VaryNormalizers: map[string]core.VaryNormalizer{
+				"Accept-Language": &core.AcceptLanguageNormalizer{Locales: []string{"en", "fr"}},
+			},
+		}},
+		{"cache {\n match path /api content_type application/json status 200 not cookie session* \n}", false, core.Config{
+			Storage: core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules: []core.CacheRule{
+				&core.AllCacheRule{Rules: []core.CacheRule{
+					&core.PathCacheRule{Path: "/api"},
+					&core.ContentTypeCacheRule{Types: []string{"application/json"}},
+					&core.StatusCacheRule{Codes: []int{200}},
+					&core.NotCacheRule{Rule: &core.CookieCacheRule{Name: "session*", Value: []string{}}},
+				}},
+			},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match path_regex \\.(css|js)$ \n match status 200 301 404 \n match query lang en es \n match request_header X-Debug \n match method GET \n}", false, core.Config{
+			Storage: core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules: []core.CacheRule{
+				&core.PathRegexCacheRule{Regex: regexp.MustCompile(`\.(css|js)$`)},
+				&core.StatusCacheRule{Codes: []int{200, 301, 404}},
+				&core.QueryCacheRule{Param: "lang", Value: []string{"en", "es"}},
+				&core.RequestHeaderCacheRule{Header: "X-Debug", Value: []string{}},
+				&core.MethodCacheRule{Methods: []string{"GET"}},
+			},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n match path /static ttl 1d \n match path /api status 200 ttl 10m override \n ttl_by_status 200 10m 301 1h \n ttl_by_status 404 30s \n}", false, core.Config{
+			Storage: core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules: []core.CacheRule{
+				&core.TTLCacheRule{Rule: &core.PathCacheRule{Path: "/static"}, TTL: 24 * time.Hour},
+				&core.TTLCacheRule{
+					Rule: &core.AllCacheRule{Rules: []core.CacheRule{
+						&core.PathCacheRule{Path: "/api"},
+						&core.StatusCacheRule{Codes: []int{200}},
+					}},
+					TTL:      10 * time.Minute,
+					Override: true,
+				},
+			},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			StatusTTLs: map[int]time.Duration{
+				200: 10 * time.Minute,
+				301: time.Hour,
+				404: 30 * time.Second,
+			},
+		}},
+		{"cache {\n cache_errors 404 10s 502 5s \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			ErrorTTLs: map[int]time.Duration{
+				404: 10 * time.Second,
+				502: 5 * time.Second,
+			},
+		}},
+		{"cache {\n bypass cookie wordpress_logged_in_* \n bypass query nocache \n bypass ip 10.0.0.0/8 127.0.0.1 request_header X-Debug 1 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			BypassRules: []core.CacheRule{
+				&core.CookieCacheRule{Name: "wordpress_logged_in_*", Value: []string{}},
+				&core.QueryCacheRule{Param: "nocache", Value: []string{}},
+				&core.AllCacheRule{Rules: []core.CacheRule{
+					&core.IPCacheRule{Networks: []*net.IPNet{
+						{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+						{IP: net.IP{127, 0, 0, 1}, Mask: net.CIDRMask(32, 32)},
+					}},
+					&core.RequestHeaderCacheRule{Header: "X-Debug", Value: []string{"1"}},
+				}},
+			},
+		}},
+		{"cache {\n strip_set_cookie \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			StripSetCookie:  true,
+		}},
+		{"cache {\n targeted_cache_control Caddy X-Edge-Cache-Control \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			TargetedHeaders: []string{"Caddy-Cache-Control", "X-Edge-Cache-Control"},
+		}},
+		{"cache {\n heuristic_freshness 20% 7d warning \n}", false, core.Config{
+			Storage:          core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:       []core.CacheRule{},
+			DefaultMaxAge:    core.DEFAULT_MAX_AGE,
+			HeuristicFactor:  0.2,
+			HeuristicMaxAge:  7 * 24 * time.Hour,
+			HeuristicWarning: true,
+		}},
+		{"cache {\n heuristic_freshness off \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+		}},
+		{"cache {\n warm file /etc/urls.txt \n warm sitemap /sitemap.xml \n warm_concurrency 8 \n warm_endpoint /_cache/warm 10.0.0.0/8 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			WarmSources: []core.WarmSource{
+				{Location: "/etc/urls.txt"},
+				{Sitemap: true, Location: "/sitemap.xml"},
+			},
+			WarmConcurrency: 8,
+			WarmEndpoint:    "/_cache/warm",
+			WarmAllowed: &core.IPCacheRule{Networks: []*net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+			}},
+		}},
+		{"cache {\n refresh_ahead 10% 5 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			RefreshFactor:   0.1,
+			RefreshMinHits:  5,
+		}},
+		{"cache {\n refresh_ahead xfetch 1 2.5 \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			RefreshBeta:     2.5,
+			RefreshMinHits:  1,
+		}},
+		{"cache {\n lock_timeout 2s \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			LockTimeout:     2 * time.Second,
+		}},
+		{"cache {\n lock_timeout 500ms stale 1h \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			LockTimeout:     500 * time.Millisecond,
+			StaleTTL:        time.Hour,
+		}},
+		{"cache {\n log info \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			LogLevel:        core.LOG_INFO,
+		}},
+		{"cache {\n log DEBUG /var/log/cache.log \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			LogLevel:        core.LOG_DEBUG,
+			LogFile:         "/var/log/cache.log",
+		}},
+		{"cache {\n harden \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			Harden:          true,
+			UnkeyedHeaders:  core.DEFAULT_UNKEYED_HEADERS,
+		}},
+		{"cache {\n harden strip x-forwarded-host X-Original-URL \n}", false, core.Config{
+			Storage:             core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:          []core.CacheRule{},
+			DefaultMaxAge:       core.DEFAULT_MAX_AGE,
+			HeuristicFactor:     core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge:     core.DEFAULT_HEURISTIC_MAX_AGE,
+			Harden:              true,
+			UnkeyedHeaders:      []string{"X-Forwarded-Host", "X-Original-Url"},
+			StripUnkeyedHeaders: true,
+		}},
+		{"cache {\n cache_errors \n}", false, core.Config{
+			Storage:         core.NewMMapStorage("/tmp/caddy-cache"),
+			CacheRules:      []core.CacheRule{},
+			DefaultMaxAge:   core.DEFAULT_MAX_AGE,
+			HeuristicFactor: core.DEFAULT_HEURISTIC_FACTOR,
+			HeuristicMaxAge: core.DEFAULT_HEURISTIC_MAX_AGE,
+			ErrorTTLs:       core.DEFAULT_ERROR_TTLS,
+		}},
+		{"cache {\n status_header aheader another \n}", true, core.Config{}},    // status_header with invalid number of parameters
+		{"cache {\n default_max_age anumber \n}", true, core.Config{}},          // max_age with invalid number
+		{"cache {\n default_max_age 45 morepareters \n}", true, core.Config{}},  // More parameters
+		{"cache {\n default_max_age \n}", true, core.Config{}},                  // Missing parameters
+		{"cache {\n max_age 50 \n}", true, core.Config{}},                       // Unknown parameters
+		{"cache {\n default_max_age 20 \n max_age 50 \n}", true, core.Config{}}, // Mixed valid and invalid parameters
+		{"cache {\n match path / ea \n}", true, core.Config{}},                  // Invalid number of parameters in match
+		{"cache {\n match unknown \n}", true, core.Config{}},                    // Unknown condition in match
+		{"cache {\n match \n}", true, core.Config{}},                            // Unknown "invalid"
+		{"cache {\n storage pepe \n}", true, core.Config{}},                     // Unknown storage "pepe"
+		{"cache {\n storage mmap \n}", true, core.Config{}},                     // Missing path
+		{"cache {\n storage tiered 64mb \n}", true, core.Config{}},              // Missing path
+		{"cache {\n match path /static ttl \n}", true, core.Config{}},           // Missing ttl
+		{"cache {\n match path /static ttl forever \n}", true, core.Config{}},   // Invalid ttl
+		{"cache {\n match ttl 1d \n}", true, core.Config{}},                     // ttl without condition
+		{"cache {\n ttl_by_status 200 \n}", true, core.Config{}},                // Missing ttl
+		{"cache {\n ttl_by_status ok 10m \n}", true, core.Config{}},             // Invalid status
+		{"cache {\n strip_set_cookie yes \n}", true, core.Config{}},             // Unexpected argument
+		{"cache {\n targeted_cache_control \n}", true, core.Config{}},           // Missing name
+		{"cache {\n heuristic_freshness 200% \n}", true, core.Config{}},         // Invalid percent
+		{"cache {\n heuristic_freshness 10% soon \n}", true, core.Config{}},     // Invalid max age
+		{"cache {\n warm /etc/urls.txt \n}", true, core.Config{}},               // Missing type of source
+		{"cache {\n warm_concurrency 0 \n}", true, core.Config{}},               // Invalid concurrency
+		{"cache {\n warm_endpoint /_cache/warm \n}", true, core.Config{}},       // Endpoint without sources
+		{"cache {\n refresh_ahead \n}", true, core.Config{}},                    // Missing percent
+		{"cache {\n refresh_ahead 150% \n}", true, core.Config{}},               // Invalid percent
+		{"cache {\n refresh_ahead 10% 2 1.5 \n}", true, core.Config{}},          // Beta without xfetch
+		{"cache {\n lock_timeout 2s later \n}", true, core.Config{}},            // Unknown fallback
+		{"cache {\n lock_timeout 2s origin 1h \n}", true, core.Config{}},        // stale_ttl without stale
+		{"cache {\n log \n}", true, core.Config{}},                              // Missing level
+		{"cache {\n log verbose \n}", true, core.Config{}},                      // Unknown level
+		{"cache {\n bypass \n}", true, core.Config{}},                           // Missing conditions
+		{"cache {\n bypass status 200 \n}", true, core.Config{}},                // Condition of the response
+		{"cache {\n bypass ip 10.0.0.0/33 \n}", true, core.Config{}},            // Invalid range
+		{"cache {\n cache_errors 502 \n}", true, core.Config{}},                 // Missing ttl
+		{"cache {\n cache_errors 502 0 \n}", true, core.Config{}},               // Invalid ttl
+		{"cache {\n match path_regex ( \n}", true, core.Config{}},               // Invalid regex
+		{"cache {\n match status ok \n}", true, core.Config{}},                  // Invalid status code
+		{"cache {\n match path /api not \n}", true, core.Config{}},              // not without condition
+		{"cache {\n match path /api status \n}", true, core.Config{}},           // Missing status codes
+		{"cache {\n vary_normalize Accept-Language \n}", true, core.Config{}},   // Missing locales
+		{"cache {\n vary_normalize Cookie \n}", true, core.Config{}},            // Unknown normalizer
+		{"cache {\n max_variants many \n}", true, core.Config{}},                // Invalid number
+		{"cache {\n storage tiered lots /some/path \n}", true, core.Config{}},   // Invalid budget
+		{"cache {\n storage mmap /some/path many \n}", true, core.Config{}},     // Invalid max open files
 	}
 
 	for i, test := range tests {
@@ -105,3 +426,30 @@ func TestParsingConfig(t *testing.T) {
 	}
 
 }
+
+type testReplacer struct {
+	values map[string]string
+}
+
+func (r *testReplacer) Replace(s string) string {
+	return s
+}
+
+func (r *testReplacer) Set(key, value string) {
+	r.values[key] = value
+}
+
+func TestPlaceholders(t *testing.T) {
+	replacer := &testReplacer{values: map[string]string{}}
+	recorder := httpserver.NewResponseRecorder(httptest.NewRecorder())
+	recorder.Replacer = replacer
+	req, _ := http.NewRequest("GET", "/assets/a.css", nil)
+
+	setPlaceholders(recorder, req, "GET /assets/a.css", "hit")
+	assert.Equal(t, map[string]string{"cache_status": "hit", "cache_key": "GET /assets/a.css"}, replacer.values)
+
+	// Responses without log, or with a log without replacer, are ignored
+	req, _ = http.NewRequest("GET", "/", nil)
+	setPlaceholders(httptest.NewRecorder(), req, "GET /", "miss")
+	setPlaceholders(httpserver.NewResponseRecorder(httptest.NewRecorder()), req, "GET /", "miss")
+}